@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/lucastomic/fuckdopamine/pkg/blocklist"
+	"github.com/lucastomic/fuckdopamine/pkg/config"
+	"github.com/lucastomic/fuckdopamine/pkg/matcher"
+)
+
+// newBlocklists creates the manager for the blocklists in cfg and loads the
+// ones available without the network, local files and cached downloads
+func newBlocklists(cfg *config.Config) (*blocklist.Manager, error) {
+	opts := make([]blocklist.Options, 0, len(cfg.Blocklists))
+	for _, b := range cfg.Blocklists {
+		format, err := blocklist.ParseFormat(b.Format)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, blocklist.Options{Name: b.Name, Source: b.Source, Format: format})
+	}
+
+	// Rebuilt asynchronously, the manager may be stopped while holding rulesMutex
+	m, err := blocklist.NewManager(opts, config.GetBlocklistCacheDir(), func() { go applyBlocklists() })
+	if err != nil {
+		return nil, err
+	}
+	m.Load()
+	return m, nil
+}
+
+// startBlocklists starts refreshing m
+func startBlocklists(cfg *config.Config, m *blocklist.Manager) {
+	interval := time.Duration(cfg.BlocklistRefreshInterval)
+	if interval <= 0 {
+		interval = time.Duration(config.Default().BlocklistRefreshInterval)
+	}
+	m.Start(interval)
+}
+
+func blocklistsChanged(old, cfg *config.Config) bool {
+	return !reflect.DeepEqual(old.Blocklists, cfg.Blocklists) ||
+		old.BlocklistRefreshInterval != cfg.BlocklistRefreshInterval
+}
+
+// rulesetWith combines the rules from the config with the rules of the
+// blocklists in m. Only rules that always apply count as duplicates, a
+// listed domain stays blocked when a group that also has it is disabled.
+func rulesetWith(m *blocklist.Manager, configured []matcher.Rule) (*matcher.Ruleset, error) {
+	var always []matcher.Rule
+	for _, rule := range configured {
+		if rule.Group == "" && rule.Schedule == "" {
+			always = append(always, rule)
+		}
+	}
+	return matcher.NewRuleset(append(configured, m.Rules(always)...))
+}
+
+// configuredRules returns the rules of rs that come from the config file
+// rather than from a blocklist
+func configuredRules(rs *matcher.Ruleset, action matcher.Action) []matcher.Rule {
+	all := rs.Rules(action)
+	configured := all[:0]
+	for _, rule := range all {
+		if rule.Source == "" {
+			configured = append(configured, rule)
+		}
+	}
+	return configured
+}
+
+// applyBlocklists swaps in the current contents of the blocklists
+func applyBlocklists() {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	s := current()
+	ruleset, err := rulesetWith(s.blocklists, configuredRules(s.rules, ""))
+	if err != nil {
+		log.Printf("[BLOCKLIST] Failed to apply blocklists: %v", err)
+		return
+	}
+	update(func(s *snapshot) { s.rules = ruleset })
+	log.Printf("[BLOCKLIST] %s", rulesSummary(ruleset, s.groups))
+}
+
+// rulesSummary counts the rules of rs by where they come from
+func rulesSummary(rs *matcher.Ruleset, gs *groupSet) string {
+	blocked := len(siteRules(rs, matcher.ActionBlock))
+	allowed := len(rs.Rules(matcher.ActionAllow))
+	grouped := len(configuredRules(rs, matcher.ActionBlock)) - blocked
+	summary := fmt.Sprintf("%d blocked sites and %d allowlist exceptions", blocked, allowed)
+	if grouped > 0 {
+		summary += fmt.Sprintf(", %d rules in %d groups", grouped, len(gs.names))
+	}
+	if listed := rs.Len() - blocked - allowed - grouped; listed > 0 {
+		summary += fmt.Sprintf(", %d domains from blocklists", listed)
+	}
+	return summary
+}
+
+func blocklistStatus() []blocklist.Status {
+	return current().blocklists.Status()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/lucastomic/fuckdopamine/pkg/blocklist"
+	"github.com/lucastomic/fuckdopamine/pkg/config"
+	"github.com/lucastomic/fuckdopamine/pkg/upstream"
+)
+
+// checkConfig adds the problems only the daemon can find, such as upstreams
+// it can't set up, to the validation report of cfg
+func checkConfig(cfg *config.Config, report *config.Report) {
+	for i, u := range cfg.Upstreams {
+		field := fmt.Sprintf("upstreams[%d]", i)
+		if report.Has(field) {
+			continue
+		}
+		if _, err := upstream.NewPool([]upstream.Options{upstreamOptions(u)}, ""); err != nil {
+			report.Errorf(field, "%v", err)
+		}
+	}
+
+	for i, addr := range cfg.ListenAddresses {
+		if _, err := listenAddresses([]string{addr}); err != nil {
+			report.Errorf(fmt.Sprintf("listen_addresses[%d]", i), "%v", err)
+		}
+	}
+}
+
+// checkBlocklistFiles parses the local blocklists of cfg and reports the
+// lines that would be skipped. The daemon logs these itself when it reads
+// the lists, so only --check-config needs it.
+func checkBlocklistFiles(cfg *config.Config, report *config.Report) {
+	for i, b := range cfg.Blocklists {
+		field := fmt.Sprintf("blocklists[%d]", i)
+		if blocklist.IsURL(b.Source) || report.Has(field+".source") || report.Has(field+".format") {
+			continue
+		}
+		format, _ := blocklist.ParseFormat(b.Format)
+		f, err := os.Open(b.Source)
+		if err != nil {
+			report.Errorf(field+".source", "%v", err)
+			continue
+		}
+		result, err := blocklist.Parse(f, format)
+		f.Close()
+		if err != nil {
+			report.Errorf(field+".source", "%v", err)
+			continue
+		}
+
+		if len(result.Domains) == 0 {
+			report.Errorf(field+".source", "%s has no domains in %s format", b.Source, result.Format)
+		}
+		for _, e := range result.Errors {
+			report.Warnf(field+".source", "%s %s", b.Source, e)
+		}
+		if more := result.ErrorCount - len(result.Errors); more > 0 {
+			report.Warnf(field+".source", "%s has %d more lines that can't be parsed", b.Source, more)
+		}
+	}
+}
+
+// logProblems writes the problems of a config to the daemon log
+func logProblems(report *config.Report) {
+	for _, p := range report.Problems {
+		if p.Warning {
+			log.Printf("[CONFIG] Warning: %s", p)
+		} else {
+			log.Printf("[CONFIG] Error: %s", p)
+		}
+	}
+}
+
+// runConfigCheck validates the config file at path for --check-config,
+// printing every problem as "path:line: error: field: message". It returns
+// the exit code, 1 if the file has errors.
+func runConfigCheck(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	cfg, report := config.Check(data)
+	if cfg != nil {
+		checkConfig(cfg, report)
+		checkBlocklistFiles(cfg, report)
+	}
+
+	errCount, warnCount := 0, 0
+	for _, p := range report.Problems {
+		where := path
+		if p.Line > 0 {
+			where += ":" + strconv.Itoa(p.Line)
+		}
+		kind := "error"
+		if p.Warning {
+			kind = "warning"
+			warnCount++
+		} else {
+			errCount++
+		}
+		if p.Field != "" {
+			fmt.Printf("%s: %s: %s: %s\n", where, kind, p.Field, p.Message)
+		} else {
+			fmt.Printf("%s: %s: %s\n", where, kind, p.Message)
+		}
+	}
+
+	if errCount > 0 {
+		fmt.Printf("%s has %d error(s) and %d warning(s)\n", path, errCount, warnCount)
+		return 1
+	}
+	fmt.Printf("%s is valid (%d warning(s))\n", path, warnCount)
+	return 0
+}
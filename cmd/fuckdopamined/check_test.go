@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// captureStdout returns what fn prints to stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	fn()
+	w.Close()
+	return <-out
+}
+
+func TestRunConfigCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{
+  "version": 1,
+  "log_file_path": "/tmp/fuckdopamine-test/dns_requests.json",
+  "listen_addresses": ["127.0.0.1:99999"],
+  "blocked_sites": [
+    "https://www.reddit.com/r/all",
+    "youtube.com",
+    "youtube.com"
+  ]
+}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var code int
+	got := captureStdout(t, func() { code = runConfigCheck(path) })
+	want := path + `:6: error: blocked_sites[0]: "https://www.reddit.com/r/all" is a URL, use just the domain name "www.reddit.com"
+` + path + `:8: warning: blocked_sites[2]: "youtube.com" is a duplicate of blocked_sites[1]
+` + path + `:4: error: listen_addresses[0]: invalid listen address "127.0.0.1:99999": bad port "99999"
+` + path + ` has 2 error(s) and 1 warning(s)
+`
+	if got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+	if code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+
+	valid := `{"version": 1, "log_file_path": "/tmp/fuckdopamine-test/dns_requests.json", "blocked_sites": ["reddit.com"]}`
+	if err := os.WriteFile(path, []byte(valid), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got = captureStdout(t, func() { code = runConfigCheck(path) })
+	if want := path + " is valid (0 warning(s))\n"; got != want || code != 0 {
+		t.Errorf("valid config: %q, exit code %d", got, code)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+
+	"github.com/lucastomic/fuckdopamine/pkg/config"
+	"github.com/lucastomic/fuckdopamine/pkg/ipc"
+	"github.com/lucastomic/fuckdopamine/pkg/matcher"
+)
+
+// groupSet is the enabled flag and schedule of every configured group
+type groupSet struct {
+	names     []string // In config order
+	enabled   map[string]bool
+	schedules map[string]string
+}
+
+// groupsFromConfig builds the groups of cfg with their enabled flags
+func groupsFromConfig(cfg *config.Config) *groupSet {
+	set := &groupSet{
+		enabled:   make(map[string]bool, len(cfg.Groups)),
+		schedules: make(map[string]string),
+	}
+	for _, g := range cfg.Groups {
+		if _, ok := set.enabled[g.Name]; ok {
+			continue
+		}
+		set.names = append(set.names, g.Name)
+		set.enabled[g.Name] = g.IsEnabled()
+		if g.Schedule != "" {
+			set.schedules[g.Name] = g.Schedule
+		}
+	}
+	return set
+}
+
+// setGroupEnabled turns a group on or off and persists it to the config file
+func setGroupEnabled(name string, enabled bool) error {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	set := current().groups
+	was, ok := set.enabled[name]
+	if !ok {
+		if len(set.names) == 0 {
+			return fmt.Errorf("unknown group %q, no groups are configured", name)
+		}
+		return fmt.Errorf("unknown group %q (groups: %s)", name, strings.Join(set.names, ", "))
+	}
+	if was == enabled {
+		return fmt.Errorf("group %s is already %s", name, enabledWord(enabled))
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	found := false
+	for i := range cfg.Groups {
+		if cfg.Groups[i].Name == name {
+			cfg.Groups[i].Enabled = &enabled
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("group %s is not in the config file, reload the config first", name)
+	}
+
+	// Save to config file before making the change visible
+	if err := config.Save(cfg); err != nil {
+		return err
+	}
+	configStamp = statConfig()
+
+	next := &groupSet{names: set.names, enabled: maps.Clone(set.enabled), schedules: set.schedules}
+	next.enabled[name] = enabled
+	update(func(s *snapshot) { s.groups = next })
+
+	log.Printf("[GROUP] Group %s %s", name, enabledWord(enabled))
+	return nil
+}
+
+func enabledWord(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+// listGroups returns every group with its rules
+func listGroups() []ipc.GroupInfo {
+	s := current()
+	set := s.groups
+	members := make(map[string][]string)
+	for _, rule := range s.rules.Rules(matcher.ActionBlock) {
+		if rule.Group != "" {
+			members[rule.Group] = append(members[rule.Group], rule.String())
+		}
+	}
+
+	infos := make([]ipc.GroupInfo, 0, len(set.names))
+	for _, name := range set.names {
+		infos = append(infos, ipc.GroupInfo{
+			Name:    name,
+			Enabled: set.enabled[name],
+			Rules:   append([]string{}, members[name]...),
+		})
+	}
+	return infos
+}
+
+// siteRules returns the rules of rs listed in blocked_sites or allowed_sites,
+// leaving out groups and blocklists
+func siteRules(rs *matcher.Ruleset, action matcher.Action) []matcher.Rule {
+	configured := configuredRules(rs, action)
+	sites := configured[:0]
+	for _, rule := range configured {
+		if rule.Group == "" {
+			sites = append(sites, rule)
+		}
+	}
+	return sites
+}
@@ -3,36 +3,49 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/lucastomic/fuckdopamine/pkg/blockpage"
+	"github.com/lucastomic/fuckdopamine/pkg/blockresponse"
+	"github.com/lucastomic/fuckdopamine/pkg/cache"
 	"github.com/lucastomic/fuckdopamine/pkg/config"
+	"github.com/lucastomic/fuckdopamine/pkg/dnsconfig"
 	"github.com/lucastomic/fuckdopamine/pkg/ipc"
+	"github.com/lucastomic/fuckdopamine/pkg/matcher"
 	"github.com/lucastomic/fuckdopamine/pkg/stats"
+	"github.com/lucastomic/fuckdopamine/pkg/upstream"
 	"github.com/miekg/dns"
 )
 
 var (
-	forbidden      map[string]bool
-	forbiddenMutex sync.RWMutex
-	statsData      *stats.Stats
-	logFile        *os.File
-	logMutex       sync.Mutex
-	logFilePath    string
+	rulesMutex    sync.Mutex // Serializes rule and config changes, lookups go through the active snapshot
+	statsData     *stats.Stats
+	logFile       *os.File
+	logMutex      sync.Mutex
+	logFilePath   string
+	upstreams     atomic.Pointer[upstream.Pool] // Swapped on reload
+	responseCache *cache.Cache                  // nil when caching is disabled
+	dnsManager    *dnsconfig.Manager            // nil when the system DNS settings are left alone
 
 	// Pause state
-	pauseMutex sync.RWMutex
-	isPaused   bool
-	pauseUntil time.Time
+	pauseMutex   sync.RWMutex
+	isPaused     bool
+	pauseStart   time.Time
+	pauseUntil   time.Time
+	scopedPauses = make(map[pauseScope]pausePeriod) // Pauses of a single domain, rule or group
+	pauseTimer   *time.Timer                        // Ends the next pause to run out
 
 	// Activity tracking for sparkline (last 60 seconds)
 	activityBuffer [60]uint64
@@ -46,9 +59,38 @@ type DNSLogEntry struct {
 	Domain    string `json:"domain"`
 	Blocked   bool   `json:"blocked"`
 	QueryType string `json:"query_type"`
+	Reason    string `json:"reason"`          // Why the request was blocked or allowed
+	Rule      string `json:"rule,omitempty"`  // Rule that decided the request
+	Group     string `json:"group,omitempty"` // Group of that rule
+	Error     string `json:"error,omitempty"` // Upstream failure, if any
 }
 
-func logToFile(domain string, blocked bool, queryType string) {
+// Decision reasons recorded in DNSLogEntry
+const (
+	reasonBlockedByRule      = "blocked-by-rule"
+	reasonAllowedByException = "allowed-by-exception"
+	reasonPaused             = "paused"
+	reasonNoRule             = "no-matching-rule"
+	reasonAllowedByQuota     = "allowed-by-quota"
+	reasonQuotaExhausted     = "quota-exhausted"
+)
+
+// TamperLogEntry records system DNS settings changed away from the daemon
+type TamperLogEntry struct {
+	Timestamp  string   `json:"timestamp"`
+	Event      string   `json:"event"` // Always "dns_tamper"
+	Interface  string   `json:"interface"`
+	OldServers []string `json:"old_servers"`
+	NewServers []string `json:"new_servers"`
+}
+
+func logToFile(entry DNSLogEntry) {
+	entry.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	writeLogLine(entry)
+}
+
+// writeLogLine appends v to the DNS log as a line of JSON
+func writeLogLine(v any) {
 	if logFile == nil {
 		return
 	}
@@ -56,14 +98,7 @@ func logToFile(domain string, blocked bool, queryType string) {
 	logMutex.Lock()
 	defer logMutex.Unlock()
 
-	entry := DNSLogEntry{
-		Timestamp: time.Now().UTC().Format(time.RFC3339),
-		Domain:    domain,
-		Blocked:   blocked,
-		QueryType: queryType,
-	}
-
-	jsonData, err := json.Marshal(entry)
+	jsonData, err := json.Marshal(v)
 	if err != nil {
 		return
 	}
@@ -114,14 +149,16 @@ func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
 	// Record activity for sparkline
 	recordActivity()
 
-	// Check if pause expired and auto-resume
-	checkAndResumePause()
-
-	// Check if currently paused
+	// Check if currently paused, pauseTimer resumes blocking when a pause runs out
 	pauseMutex.RLock()
 	paused := isPaused
 	pauseMutex.RUnlock()
 
+	// Rules of disabled groups and outside their schedule don't apply
+	now := clock()
+	s := current()
+	active := s.activeAt(now)
+
 	for _, q := range r.Question {
 		host := q.Name
 		queryType := dns.TypeToString[q.Qtype]
@@ -129,75 +166,194 @@ func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
 		// Remove trailing dot for display
 		cleanDomain := strings.TrimSuffix(host, ".")
 
-		// If paused, allow all requests
-		blocked := false
-		if !paused {
-			// Check if this domain or any parent domain is blocked
-			forbiddenMutex.RLock()
-			if forbidden[host] {
-				// Exact match (e.g., linkedin.com.)
-				blocked = true
+		// Find the most specific rule for the domain or any parent domain,
+		// e.g., perf.linkedin.com. is matched by linkedin.com unless an
+		// allowlist exception for perf.linkedin.com exists
+		entry := DNSLogEntry{Domain: cleanDomain, QueryType: queryType, Reason: reasonNoRule}
+		rule := s.rules.Match(host, active)
+		if rule != nil {
+			entry.Rule = rule.String()
+			entry.Group = rule.Group
+			if rule.Action == matcher.ActionAllow {
+				entry.Reason = reasonAllowedByException
 			} else {
-				// Check if it's a subdomain of any blocked domain
-				// e.g., perf.linkedin.com. should match linkedin.com.
-				for blockedDomain := range forbidden {
-					if host != blockedDomain && strings.HasSuffix(host, "."+blockedDomain) {
-						blocked = true
-						break
-					}
-				}
+				entry.Reason = reasonBlockedByRule
+			}
+		}
+
+		// If paused, allow all requests, or those of a paused domain, rule or group
+		if entry.Reason == reasonBlockedByRule && (paused || scopedPauseCovers(matcher.Normalize(host), rule)) {
+			entry.Reason = reasonPaused
+		}
+
+		// Domains with a quota are let through until it is used up
+		if entry.Reason == reasonBlockedByRule && rule.Quota != nil {
+			if useQuota(rule, now) {
+				entry.Reason = reasonAllowedByQuota
+			} else {
+				entry.Reason = reasonQuotaExhausted
 			}
-			forbiddenMutex.RUnlock()
 		}
 
-		if blocked {
-			m.Rcode = dns.RcodeRefused
+		if entry.Reason == reasonBlockedByRule || entry.Reason == reasonQuotaExhausted {
+			m = rule.Response.Merge(s.blockResponse).Reply(r)
+			entry.Blocked = true
 			statsData.RecordRequest(cleanDomain, true)
-			logToFile(cleanDomain, true, queryType)
-			w.WriteMsg(m)
+			statsData.RecordRuleHit(rule.String())
+			logToFile(entry)
+			writeResponse(w, r, m)
 			return
 		} else {
 			resp, err := forwardDNSQuery(r)
-			if err == nil {
+			if err != nil {
+				log.Printf("[DNS] Failed to forward %s: %v", cleanDomain, err)
+				m.Rcode = dns.RcodeServerFailure
+				entry.Error = err.Error()
+			} else {
 				m = resp
+				if entry.Reason == reasonAllowedByQuota {
+					capTTL(m, quotaTTL)
+				}
 			}
 			statsData.RecordRequest(cleanDomain, false)
-			logToFile(cleanDomain, false, queryType)
+			logToFile(entry)
 		}
 	}
 
+	writeResponse(w, r, m)
+}
+
+// writeResponse sends m, truncating it to the size the client accepts.
+// Truncated UDP responses have the TC bit set so the client retries over TCP.
+func writeResponse(w dns.ResponseWriter, r, m *dns.Msg) {
+	size := dns.MaxMsgSize
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size = dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+	}
+	m.Truncate(size)
 	w.WriteMsg(m)
 }
 
 func forwardDNSQuery(r *dns.Msg) (*dns.Msg, error) {
-	c := new(dns.Client)
-	resp, _, err := c.Exchange(r, "8.8.8.8:53")
+	if responseCache == nil {
+		return upstreams.Load().Exchange(r)
+	}
+
+	resp, hit, err := responseCache.Exchange(r)
+	statsData.RecordCacheLookup(hit)
 	return resp, err
 }
 
-// Pause functions
-func pauseBlocking() {
+// newUpstreamPool builds the upstream pool from the configuration,
+// falling back to the default resolvers if none are configured
+func newUpstreamPool(cfg *config.Config) (*upstream.Pool, error) {
+	defaults := config.Default()
+
+	upstreamCfgs := cfg.Upstreams
+	if len(upstreamCfgs) == 0 {
+		upstreamCfgs = defaults.Upstreams
+	}
+
+	opts := make([]upstream.Options, 0, len(upstreamCfgs))
+	for _, u := range upstreamCfgs {
+		opts = append(opts, upstreamOptions(u))
+	}
+
+	return upstream.NewPool(opts, upstream.Strategy(cfg.UpstreamStrategy))
+}
+
+// upstreamOptions converts an upstream from the configuration
+func upstreamOptions(u config.UpstreamConfig) upstream.Options {
+	return upstream.Options{
+		Address:    u.Address,
+		Protocol:   upstream.Protocol(u.Protocol),
+		Timeout:    time.Duration(u.Timeout),
+		ServerName: u.ServerName,
+		Pins:       u.PinSHA256,
+		CAFile:     u.CAFile,
+		Method:     u.Method,
+		Bootstrap:  u.Bootstrap,
+	}
+}
+
+// pauseBlocking pauses blocking for d, zero means the configured default,
+// if the pause limits allow it
+func pauseBlocking(d time.Duration) error {
 	pauseMutex.Lock()
 	defer pauseMutex.Unlock()
 
-	if !isPaused {
-		isPaused = true
-		pauseUntil = time.Now().Add(10 * time.Minute)
-		statsData.StartPause()
-		log.Printf("[PAUSE] Blocking paused for 10 minutes until %s", pauseUntil.Format("15:04:05"))
+	now := time.Now()
+	endExpiredPauses(now)
+	if isPaused {
+		return fmt.Errorf("blocking is already paused until %s", pauseUntil.Format("15:04"))
+	}
+
+	period := quotaPeriod(now)
+	d, err := current().pause.allow(d, statsData.GetPauseUsage(period), now)
+	if err != nil {
+		log.Printf("[PAUSE] Pause denied: %v", err)
+		return err
 	}
+
+	isPaused = true
+	pauseStart = now
+	pauseUntil = now.Add(d)
+	statsData.StartPause("", period, pauseUntil)
+	schedulePauseTimer()
+	log.Printf("[PAUSE] Blocking paused for %s until %s", shortDuration(d), pauseUntil.Format("15:04:05"))
+	return nil
 }
 
+// checkAndResumePause ends the pauses that ran out, called by pauseTimer
 func checkAndResumePause() {
 	pauseMutex.Lock()
 	defer pauseMutex.Unlock()
 
-	if isPaused && time.Now().After(pauseUntil) {
+	endExpiredPauses(time.Now())
+	schedulePauseTimer()
+}
+
+// endExpiredPauses resumes blocking for the pauses over at now, the caller
+// holds pauseMutex
+func endExpiredPauses(now time.Time) {
+	if isPaused && !now.Before(pauseUntil) {
 		isPaused = false
-		pauseUntil = time.Time{}
-		statsData.EndPause()
+		statsData.EndPause("", pauseUntil)
+		pauseStart, pauseUntil = time.Time{}, time.Time{}
 		log.Println("[PAUSE] Blocking resumed")
 	}
+	for scope, p := range scopedPauses {
+		if !now.Before(p.until) {
+			delete(scopedPauses, scope)
+			statsData.EndPause(scope.String(), p.until)
+			log.Printf("[PAUSE] Blocking of %s resumed", scope.describe())
+		}
+	}
+}
+
+// schedulePauseTimer sets pauseTimer to fire when the next running pause
+// ends, the caller holds pauseMutex
+func schedulePauseTimer() {
+	var next time.Time
+	if isPaused {
+		next = pauseUntil
+	}
+	for _, p := range scopedPauses {
+		if next.IsZero() || p.until.Before(next) {
+			next = p.until
+		}
+	}
+
+	if pauseTimer != nil {
+		pauseTimer.Stop()
+		pauseTimer = nil
+	}
+	if !next.IsZero() {
+		pauseTimer = time.AfterFunc(time.Until(next), checkAndResumePause)
+	}
 }
 
 func isPausedFn() bool {
@@ -212,134 +368,521 @@ func pauseUntilFn() time.Time {
 	return pauseUntil
 }
 
-// Block functions for managing blocked sites at runtime
-func blockDomain(domain string) error {
-	// Normalize domain (remove trailing dot if present, then add it)
-	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
-	if domain == "" {
-		return errors.New("domain cannot be empty")
+// rulesFromConfig builds the block rules and allowlist exceptions from the
+// configuration, returning the valid rules and an error describing each
+// invalid one. Per-rule responses are validated against the global policy.
+func rulesFromConfig(cfg *config.Config, policy *blockresponse.Policy) ([]matcher.Rule, error) {
+	var rules []matcher.Rule
+	var errs []error
+
+	for _, rc := range cfg.BlockedSites {
+		rule, err := ruleFromConfig(rc, policy)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("blocked site %q: %w", rc.Rule, err))
+			continue
+		}
+		rules = append(rules, rule)
 	}
 
-	key := domain + "."
+	for _, g := range cfg.Groups {
+		for _, rc := range g.Domains {
+			rule, err := ruleFromConfig(rc, policy)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("group %s: %q: %w", g.Name, rc.Rule, err))
+				continue
+			}
+			rule.Group = g.Name
+			rules = append(rules, rule)
+		}
+	}
+
+	allowRules, err := matcher.ParseRules(cfg.AllowedSites, matcher.ActionAllow)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("allowed sites: %w", err))
+	}
+	rules = append(rules, allowRules...)
 
-	forbiddenMutex.Lock()
-	defer forbiddenMutex.Unlock()
+	return rules, errors.Join(errs...)
+}
 
-	if forbidden[key] {
-		return errors.New("domain is already blocked")
+// ruleFromConfig converts a blocking rule from the configuration
+func ruleFromConfig(rc config.RuleConfig, policy *blockresponse.Policy) (matcher.Rule, error) {
+	rule, err := matcher.ParseRule(rc.Rule)
+	if err == nil && rc.Response != nil {
+		rule.Response, err = policyFromConfig(*rc.Response)
+		if err == nil {
+			err = rule.Response.Merge(policy).Validate()
+		}
 	}
+	rule.Schedule = rc.Schedule
+	rule.Quota = quotaFromConfig(rc.Quota)
+	return rule, err
+}
 
-	forbidden[key] = true
+// policyFromConfig converts a block response from the configuration
+func policyFromConfig(rc config.BlockResponseConfig) (*blockresponse.Policy, error) {
+	return blockresponse.New(rc.Mode, rc.IPv4, rc.IPv6, rc.TTL)
+}
 
-	// Save to config file
-	if err := saveBlockedSitesToConfig(); err != nil {
-		// Rollback
-		delete(forbidden, key)
+// policyToConfig converts a block response back into its configuration form
+func policyToConfig(p *blockresponse.Policy) *config.BlockResponseConfig {
+	if p == nil {
+		return nil
+	}
+	rc := &config.BlockResponseConfig{Mode: string(p.Mode), TTL: p.TTL}
+	if p.IPv4 != nil {
+		rc.IPv4 = p.IPv4.String()
+	}
+	if p.IPv6 != nil {
+		rc.IPv6 = p.IPv6.String()
+	}
+	return rc
+}
+
+// parseRule parses a rule sent over IPC, kind overrides any kind given in the domain itself
+func parseRule(domain, kind string, action matcher.Action) (matcher.Rule, error) {
+	var rule matcher.Rule
+	var err error
+	if kind != "" {
+		rule, err = matcher.NewRule(matcher.Kind(kind), domain)
+	} else {
+		rule, err = matcher.ParseRule(domain)
+	}
+	rule.Action = action
+	return rule, err
+}
+
+// addRule adds a rule at runtime and persists it to the config file
+func addRule(rule matcher.Rule) error {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	s := current()
+	if existing := siteRule(s.rules, rule); existing != nil {
+		if existing.Schedule != "" {
+			return fmt.Errorf("domain is already %s on schedule %q", actionVerb(rule.Action), existing.Schedule)
+		}
+		return fmt.Errorf("domain is already %s", actionVerb(rule.Action))
+	}
+
+	// A rule that is also in a blocklist becomes part of the config
+	next, err := rulesetWith(s.blocklists, append(configuredRules(s.rules, ""), rule))
+	if err != nil {
+		return err
+	}
+
+	// Save to config file before making the change visible
+	if err := saveRulesToConfig(next); err != nil {
 		return err
 	}
+	update(func(s *snapshot) { s.rules = next })
 
-	log.Printf("[BLOCK] Added %s to block list", domain)
 	return nil
 }
 
-func unblockDomain(domain string) error {
-	// Normalize domain
-	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
-	if domain == "" {
-		return errors.New("domain cannot be empty")
+// siteRule returns the rule of blocked_sites or allowed_sites with the action
+// and pattern of rule, whatever its schedule, or nil
+func siteRule(rs *matcher.Ruleset, rule matcher.Rule) *matcher.Rule {
+	for _, r := range siteRules(rs, rule.Action) {
+		if r.String() == rule.String() {
+			return &r
+		}
 	}
+	return nil
+}
 
-	key := domain + "."
+// actionVerb describes a rule with action in messages
+func actionVerb(action matcher.Action) string {
+	if action == matcher.ActionAllow {
+		return "allowed"
+	}
+	return "blocked"
+}
 
-	forbiddenMutex.Lock()
-	defer forbiddenMutex.Unlock()
+// removeRule removes a rule at runtime and persists the change to the config file
+func removeRule(rule matcher.Rule) error {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
 
-	if !forbidden[key] {
-		return errors.New("domain is not blocked")
+	s := current()
+	existing := siteRule(s.rules, rule)
+	if existing == nil {
+		if listed := s.rules.Get(rule); listed != nil && listed.Source != "" {
+			return fmt.Errorf("%s comes from blocklist %q, add an allowlist exception to unblock it", rule, listed.Source)
+		}
+		return fmt.Errorf("domain is not %s", actionVerb(rule.Action))
 	}
 
-	delete(forbidden, key)
+	// Without the config's copy, a blocklist may still block it
+	without, err := s.rules.Without(*existing)
+	if err != nil {
+		return err
+	}
+	next, err := rulesetWith(s.blocklists, configuredRules(without, ""))
+	if err != nil {
+		return err
+	}
 
-	// Save to config file
-	if err := saveBlockedSitesToConfig(); err != nil {
-		// Rollback
-		forbidden[key] = true
+	// Save to config file before making the change visible
+	if err := saveRulesToConfig(next); err != nil {
 		return err
 	}
+	update(func(s *snapshot) { s.rules = next })
 
-	log.Printf("[BLOCK] Removed %s from block list", domain)
 	return nil
 }
 
-func listBlockedDomains() []string {
-	forbiddenMutex.RLock()
-	defer forbiddenMutex.RUnlock()
+// Block functions for managing blocked sites at runtime
+func blockDomain(domain, kind, response string) error {
+	rule, err := parseRule(domain, kind, matcher.ActionBlock)
+	if err != nil {
+		return err
+	}
+	if response != "" {
+		if rule.Response, err = blockresponse.New(response, "", "", 0); err != nil {
+			return err
+		}
+		if err := rule.Response.Merge(current().blockResponse).Validate(); err != nil {
+			return err
+		}
+	}
+	if err := addRule(rule); err != nil {
+		return err
+	}
 
-	domains := make([]string, 0, len(forbidden))
-	for domain := range forbidden {
-		// Remove trailing dot for display
-		domains = append(domains, strings.TrimSuffix(domain, "."))
+	log.Printf("[BLOCK] Added %s to block list", rule)
+	return nil
+}
+
+func unblockDomain(domain, kind string) error {
+	rule, err := parseRule(domain, kind, matcher.ActionBlock)
+	if err != nil {
+		return err
+	}
+	if err := removeRule(rule); err != nil {
+		return err
+	}
+
+	log.Printf("[BLOCK] Removed %s from block list", rule)
+	return nil
+}
+
+// listBlockedRules returns the rules of blocked_sites, groups are listed by
+// listGroups and blocklists only summarized by blocklistStatus
+func listBlockedRules() []matcher.Rule {
+	return siteRules(current().rules, matcher.ActionBlock)
+}
+
+// Allow functions for managing allowlist exceptions at runtime
+func allowDomain(domain, kind string) error {
+	rule, err := parseRule(domain, kind, matcher.ActionAllow)
+	if err != nil {
+		return err
+	}
+	if err := addRule(rule); err != nil {
+		return err
+	}
+
+	log.Printf("[ALLOW] Added %s to allowlist", rule)
+	return nil
+}
+
+func disallowDomain(domain, kind string) error {
+	rule, err := parseRule(domain, kind, matcher.ActionAllow)
+	if err != nil {
+		return err
+	}
+	if err := removeRule(rule); err != nil {
+		return err
+	}
+
+	log.Printf("[ALLOW] Removed %s from allowlist", rule)
+	return nil
+}
+
+func listAllowedRules() []matcher.Rule {
+	return siteRules(current().rules, matcher.ActionAllow)
+}
+
+// blockingRule returns the rule that blocks domain, used by the block page
+func blockingRule(domain string) (string, bool) {
+	rule, _, blocked := lookupBlock(domain)
+	return rule, blocked
+}
+
+// lookupBlock returns the rule that blocks domain and its group, used to annotate stats.
+// Domains with quota left or under a scoped pause aren't blocked right now.
+func lookupBlock(domain string) (string, string, bool) {
+	now := clock()
+	rule := current().match(domain, now)
+	if rule == nil || rule.Action != matcher.ActionBlock || (rule.Quota != nil && quotaLeft(rule, now)) || scopedPauseCovers(matcher.Normalize(domain), rule) {
+		return "", "", false
 	}
-	sort.Strings(domains)
-	return domains
+	return rule.String(), rule.Group, true
 }
 
-func saveBlockedSitesToConfig() error {
+func saveRulesToConfig(rs *matcher.Ruleset) error {
+	// Saving over a file that can't be read would lose the rest of its settings
 	cfg, err := config.Load()
 	if err != nil {
-		cfg = config.Default()
+		return err
+	}
+
+	// Update blocked and allowed sites from the new ruleset, leaving out groups and blocklists
+	blocked := siteRules(rs, matcher.ActionBlock)
+	cfg.BlockedSites = make([]config.RuleConfig, 0, len(blocked))
+	for _, rule := range blocked {
+		cfg.BlockedSites = append(cfg.BlockedSites, config.RuleConfig{
+			Rule:     rule.String(),
+			Response: policyToConfig(rule.Response),
+			Schedule: rule.Schedule,
+			Quota:    quotaToConfig(rule.Quota),
+		})
 	}
+	cfg.AllowedSites = ruleSpecs(siteRules(rs, matcher.ActionAllow))
 
-	// Update blocked sites from current forbidden map
-	sites := make([]string, 0, len(forbidden))
-	for domain := range forbidden {
-		sites = append(sites, strings.TrimSuffix(domain, "."))
+	if err := config.Save(cfg); err != nil {
+		return err
 	}
-	sort.Strings(sites)
-	cfg.BlockedSites = sites
+	// Our own write doesn't need to be reloaded
+	configStamp = statConfig()
+	return nil
+}
 
-	return config.Save(cfg)
+func ruleSpecs(rules []matcher.Rule) []string {
+	specs := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		specs = append(specs, rule.String())
+	}
+	return specs
 }
 
-func startDNSServer() error {
+// startDNSServers serves DNS over UDP and TCP on every address, errors are sent to errChan
+func startDNSServers(addrs []string, errChan chan<- error) []*dns.Server {
 	dns.HandleFunc(".", handleDNSRequest)
 
-	server := &dns.Server{
-		Addr: ":53",
-		Net:  "udp",
+	var servers []*dns.Server
+	for _, addr := range addrs {
+		for _, network := range []string{"udp", "tcp"} {
+			server := &dns.Server{
+				Addr: addr,
+				Net:  network,
+			}
+			servers = append(servers, server)
+
+			go func() {
+				if err := server.ListenAndServe(); err != nil {
+					errChan <- fmt.Errorf("%s listener on %s: %w", network, addr, err)
+				}
+			}()
+		}
 	}
 
-	return server.ListenAndServe()
+	return servers
 }
 
-func backupAndModifyDNSSettings() (string, error) {
-	out, err := exec.Command("networksetup", "-getdnsservers", "Wi-Fi").Output()
-	if err != nil {
-		return "", err
+// listenAddresses validates the configured DNS listen addresses, adding
+// port 53 where none is given ("::1" becomes "[::1]:53")
+func listenAddresses(addrs []string) ([]string, error) {
+	if len(addrs) == 0 {
+		addrs = config.Default().ListenAddresses
 	}
-	backup := strings.TrimSpace(string(out))
 
-	err = exec.Command("networksetup", "-setdnsservers", "Wi-Fi", "127.0.0.1").Run()
-	if err != nil {
-		return "", err
+	result := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			host, port = strings.Trim(addr, "[]"), "53"
+		}
+		if host != "" && net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid listen address %q: host must be an IP address", addr)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			return nil, fmt.Errorf("invalid listen address %q: bad port %q", addr, port)
+		}
+		result = append(result, net.JoinHostPort(host, port))
 	}
+	return result, nil
+}
+
+// listFlag is a command-line flag that can be repeated or given a comma separated list
+type listFlag []string
 
-	return backup, nil
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
 }
 
-func restoreDNSSettings(backup string) {
-	if backup == "" || backup == "There aren't any DNS Servers set on Wi-Fi." {
-		exec.Command("networksetup", "-setdnsservers", "Wi-Fi", "Empty").Run()
-	} else {
-		exec.Command("networksetup", "-setdnsservers", "Wi-Fi", backup).Run()
+func (f *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*f = append(*f, v)
+		}
+	}
+	return nil
+}
+
+// systemResolvers returns the DNS servers the system is pointed at while the
+// daemon listens on addrs, as returned by listenAddresses. The system can only
+// be given servers on port 53, so other ports are left out, and addresses
+// listening on every interface are reached over loopback.
+func systemResolvers(addrs []string) ([]string, error) {
+	var servers []string
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || port != "53" {
+			continue
+		}
+		var ips []string
+		switch ip := net.ParseIP(host); {
+		case host == "":
+			ips = []string{"127.0.0.1", "::1"}
+		case ip.Equal(net.IPv4zero):
+			ips = []string{"127.0.0.1"}
+		case ip.Equal(net.IPv6unspecified):
+			ips = []string{"::1"}
+		default:
+			ips = []string{ip.String()}
+		}
+		for _, ip := range ips {
+			if !seen[ip] {
+				seen[ip] = true
+				servers = append(servers, ip)
+			}
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("none of the listen addresses (%s) is on port 53, which the system DNS settings need, run with --system-dns=false to listen elsewhere", strings.Join(addrs, ", "))
+	}
+	return servers, nil
+}
+
+// dnsStatus returns the DNS state of every managed network interface
+func dnsStatus() []dnsconfig.InterfaceStatus {
+	if dnsManager == nil {
+		return nil
+	}
+	return dnsManager.Status()
+}
+
+// recordTamper records DNS settings changed away from the daemon in the stats and the DNS log
+func recordTamper(name string, expected, found []string) {
+	now := time.Now().UTC()
+	statsData.RecordTamper(stats.TamperEvent{
+		Timestamp:  now,
+		Interface:  name,
+		OldServers: expected,
+		NewServers: found,
+	})
+	writeLogLine(TamperLogEntry{
+		Timestamp:  now.Format(time.RFC3339),
+		Event:      "dns_tamper",
+		Interface:  name,
+		OldServers: expected,
+		NewServers: found,
+	})
+}
+
+// restoreSavedDNSSettings restores the settings left in the state file by a
+// run that didn't shut down cleanly, and reports whether there were any
+func restoreSavedDNSSettings() (bool, error) {
+	backup, err := dnsconfig.RestoreSaved(config.GetDNSStatePath())
+	if err != nil || backup == nil {
+		return false, err
+	}
+	log.Printf("[DNS] Restored DNS settings using %s: %s", backup.Backend, backup)
+	return true, nil
+}
+
+// startBlockPage starts the block page server on its loopback addresses
+// and returns the sinkhole policy pointing blocked queries at it
+func startBlockPage(cfg config.BlockPageConfig) (*blockpage.Server, *blockresponse.Policy, error) {
+	defaults := config.Default().BlockPage
+	if cfg.IPv4 == "" && cfg.IPv6 == "" {
+		cfg.IPv4, cfg.IPv6 = defaults.IPv4, defaults.IPv6
 	}
+	if cfg.HTTPPort == 0 {
+		cfg.HTTPPort = defaults.HTTPPort
+	}
+	switch {
+	case cfg.HTTPSPort == 0:
+		cfg.HTTPSPort = defaults.HTTPSPort
+	case cfg.HTTPSPort < 0:
+		cfg.HTTPSPort = 0
+	}
+
+	policy, err := blockresponse.New(string(blockresponse.ModeSinkhole), cfg.IPv4, cfg.IPv6, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	server := blockpage.New(blockpage.Funcs{
+		Lookup: blockingRule,
+		PauseStatus: func() blockpage.PauseStatus {
+			return blockpage.PauseStatus{
+				Paused: isPausedFn(),
+				Until:  pauseUntilFn(),
+				Budget: pauseBudget(),
+			}
+		},
+		Pause: func() error {
+			return pauseBlocking(0)
+		},
+		RecordHit: func(domain string, https bool) {
+			statsData.RecordBlockPageHit(https)
+			if https {
+				log.Printf("[BLOCKPAGE] HTTPS request to blocked site %s", domain)
+			}
+		},
+	})
+
+	for _, ip := range []string{cfg.IPv4, cfg.IPv6} {
+		if ip == "" {
+			continue
+		}
+		if err := server.Listen(ip, cfg.HTTPPort, cfg.HTTPSPort); err != nil {
+			server.Close()
+			return nil, nil, err
+		}
+	}
+
+	return server, policy, nil
 }
 
 func startIPCServer(listener net.Listener) {
 	blockFuncs := ipc.BlockFuncs{
 		Block:       blockDomain,
 		Unblock:     unblockDomain,
-		ListBlocked: listBlockedDomains,
+		ListBlocked: listBlockedRules,
+		Allow:       allowDomain,
+		Disallow:    disallowDomain,
+		ListAllowed: listAllowedRules,
+
+		ListBlocklists: blocklistStatus,
+
+		SetGroupEnabled: setGroupEnabled,
+		ListGroups:      listGroups,
+
+		Quotas: quotaStatus,
+	}
+	pauseFuncs := ipc.PauseFuncs{
+		IsPaused:   isPausedFn,
+		PauseUntil: pauseUntilFn,
+		Pause:      pauseBlocking,
+		Budget:     pauseBudget,
+
+		PauseScoped:  pauseScoped,
+		ScopedPauses: listScopedPauses,
+
+		Resume: resumePause,
+		Extend: extendPause,
+	}
+	daemonFuncs := ipc.DaemonFuncs{
+		UpstreamStatus: upstreamStatus,
+		DNSStatus:      dnsStatus,
+		ScheduleStatus: scheduleStatus,
+		Reload:         reloadConfig,
 	}
 
 	for {
@@ -347,13 +890,40 @@ func startIPCServer(listener net.Listener) {
 		if err != nil {
 			continue
 		}
-		go ipc.HandleConnection(conn, statsData, forbidden, isPausedFn, pauseUntilFn, pauseBlocking, getActivityData, blockFuncs)
+		go ipc.HandleConnection(conn, statsData, lookupBlock, pauseFuncs, getActivityData, blockFuncs, daemonFuncs)
 	}
 }
 
 func main() {
+	var listenFlag listFlag
+	configPath := flag.String("config", config.GetConfigPath(), "path to the config file")
+	flag.Var(&listenFlag, "listen", "DNS listen address, e.g. 127.0.0.1:5353 or [::1]:5353 (repeatable, overrides listen_addresses)")
+	socketPath := flag.String("socket", "", "IPC socket path (overrides socket_path)")
+	restoreDNS := flag.Bool("restore-dns", false, "restore the DNS settings saved by a daemon that didn't shut down cleanly, then exit")
+	systemDNS := flag.Bool("system-dns", true, "point the system DNS settings at the daemon, disable for unprivileged test instances")
+	checkConfigOnly := flag.Bool("check-config", false, "validate the config file, print every problem and exit non-zero if it has errors")
+	flag.Parse()
+
+	config.SetConfigPath(*configPath)
+
+	if *checkConfigOnly {
+		os.Exit(runConfigCheck(config.GetConfigPath()))
+	}
+
+	// Recovery mode, for when the daemon can't be started to clean up after itself
+	if *restoreDNS {
+		restored, err := restoreSavedDNSSettings()
+		if err != nil {
+			log.Fatalf("[DNS] Failed to restore DNS settings: %v", err)
+		}
+		if !restored {
+			log.Println("[DNS] No saved DNS settings to restore")
+		}
+		return
+	}
+
 	// Setup logging
-	logDir := "/var/log/fuckdopamine"
+	logDir := config.GetLogDir()
 	os.MkdirAll(logDir, 0755)
 
 	daemonLog, err := os.OpenFile(filepath.Join(logDir, "daemon.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -369,6 +939,11 @@ func main() {
 
 	// Load configuration
 	cfg, err := config.Load()
+	var versionErr *config.VersionError
+	if errors.As(err, &versionErr) {
+		// Starting with defaults would overwrite the newer file
+		log.Fatalf("[CONFIG] %v", err)
+	}
 	if err != nil {
 		log.Printf("[CONFIG] Failed to load config: %v, using defaults", err)
 		cfg = config.Default()
@@ -377,12 +952,72 @@ func main() {
 		}
 	}
 
-	// Initialize forbidden sites map
-	forbidden = make(map[string]bool)
-	for _, site := range cfg.BlockedSites {
-		forbidden[site+"."] = true
+	report := cfg.Validate()
+	checkConfig(cfg, report)
+	logProblems(report)
+
+	// Initialize block response, falling back to REFUSED if it is invalid
+	policy, err := blockResponseFromConfig(cfg)
+	if err != nil {
+		log.Printf("[CONFIG] Invalid block response: %v, using refused", err)
+		policy = &blockresponse.Policy{Mode: blockresponse.ModeRefused}
+	}
+
+	// Initialize rule matcher, skipping invalid rules
+	configRules, err := rulesFromConfig(cfg, policy)
+	if err != nil {
+		log.Printf("[CONFIG] Ignoring invalid rules: %v", err)
+	}
+
+	// Load the blocklists available offline, downloads are refreshed in the background
+	lists, err := newBlocklists(cfg)
+	if err != nil {
+		log.Printf("[BLOCKLIST] Ignoring blocklists: %v", err)
+		lists, _ = newBlocklists(&config.Config{})
+	}
+
+	ruleset, err := rulesetWith(lists, configRules)
+	if err != nil {
+		log.Fatalf("[CONFIG] Failed to build block list: %v", err)
+	}
+
+	scheduleSet, err := schedulesFromConfig(cfg)
+	if err != nil {
+		log.Printf("[CONFIG] Ignoring invalid schedules, their rules always apply: %v", err)
+	}
+	state.Store(&snapshot{
+		rules:          ruleset,
+		groups:         groupsFromConfig(cfg),
+		schedules:      scheduleSet,
+		pause:          pauseLimitsFromConfig(cfg),
+		blockResponse:  policy,
+		quotaResetHour: quotaResetHourFromConfig(cfg),
+		blocklists:     lists,
+	})
+	log.Printf("[CONFIG] Loaded %s", rulesSummary(ruleset, current().groups))
+	startBlocklists(cfg, lists)
+
+	// Setup upstream resolvers
+	pool, err := newUpstreamPool(cfg)
+	if err != nil {
+		log.Fatalf("[UPSTREAM] Invalid upstream configuration: %v", err)
+	}
+	startUpstreamPool(cfg, pool)
+	defer func() {
+		upstreams.Load().Stop()
+	}()
+
+	// Setup response cache
+	if !cfg.Cache.Disabled {
+		responseCache = cache.New(cache.Options{
+			Size:     cfg.Cache.Size,
+			MaxTTL:   time.Duration(cfg.Cache.MaxTTL),
+			Prefetch: cfg.Cache.Prefetch,
+		}, func(r *dns.Msg) (*dns.Msg, error) {
+			return upstreams.Load().Exchange(r)
+		})
+		log.Printf("[CACHE] Response cache enabled")
 	}
-	log.Printf("[CONFIG] Loaded %d blocked sites", len(forbidden))
 
 	// Load or create stats
 	statsPath := config.GetStatsPath()
@@ -406,6 +1041,21 @@ func main() {
 		}
 	}()
 
+	// Start block page, blocked A/AAAA queries are answered with its address
+	if cfg.BlockPage.Enabled {
+		server, policy, err := startBlockPage(cfg.BlockPage)
+		if err != nil {
+			log.Printf("[BLOCKPAGE] Failed to start block page: %v", err)
+		} else {
+			defer server.Close()
+			rulesMutex.Lock()
+			blockPagePolicy = policy
+			update(func(s *snapshot) { s.blockResponse = withBlockPage(s.blockResponse) })
+			rulesMutex.Unlock()
+			log.Printf("[BLOCKPAGE] Serving block page on %s %s", cfg.BlockPage.IPv4, cfg.BlockPage.IPv6)
+		}
+	}
+
 	// Open log file for DNS requests
 	logFilePath = cfg.LogFilePath
 	os.MkdirAll(filepath.Dir(logFilePath), 0755)
@@ -417,49 +1067,109 @@ func main() {
 		defer logFile.Close()
 	}
 
-	// Backup and modify DNS settings
-	originalDNS, err := backupAndModifyDNSSettings()
+	// Resolve listen addresses, command-line flags win over the config file
+	listen := cfg.ListenAddresses
+	if len(listenFlag) > 0 {
+		listen = listenFlag
+	}
+	dnsAddrs, err := listenAddresses(listen)
 	if err != nil {
-		log.Fatalf("[DNS] Failed to modify DNS settings: %v", err)
+		log.Fatalf("[CONFIG] %v", err)
 	}
-	log.Printf("[DNS] Backed up DNS settings: %s", originalDNS)
-	defer func() {
-		log.Println("[SHUTDOWN] Restoring DNS settings...")
-		restoreDNSSettings(originalDNS)
-	}()
+	var resolvers []string
+	if *systemDNS {
+		if resolvers, err = systemResolvers(dnsAddrs); err != nil {
+			log.Fatalf("[CONFIG] %v", err)
+		}
+	}
+	socket := cfg.SocketPath
+	if *socketPath != "" {
+		socket = *socketPath
+	}
+	if socket == "" {
+		socket = ipc.DefaultSocketPath
+	}
+	ipc.SocketPath = socket
 
 	// Remove old socket if it exists
-	os.Remove(ipc.SocketPath)
+	os.Remove(socket)
 
-	// Start IPC server
-	listener, err := net.Listen("unix", ipc.SocketPath)
+	// Create the IPC socket before touching the system DNS settings, the
+	// deferred restore doesn't run if the daemon exits with log.Fatalf
+	listener, err := net.Listen("unix", socket)
 	if err != nil {
 		log.Fatalf("[IPC] Failed to create Unix socket: %v", err)
 	}
 	defer listener.Close()
-	defer os.Remove(ipc.SocketPath)
+	defer os.Remove(socket)
 
 	// Make socket accessible
-	os.Chmod(ipc.SocketPath, 0666)
-
-	log.Println("[IPC] Starting IPC server...")
-	go startIPCServer(listener)
+	os.Chmod(socket, 0666)
 
-	// Setup signal handling
+	// Setup signal handling, so a signal during startup still restores DNS
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-	// Start DNS server in goroutine
-	go func() {
-		log.Println("[DNS] Starting DNS server on port 53...")
-		if err := startDNSServer(); err != nil {
-			log.Fatalf("[DNS] Failed to start DNS server: %v", err)
+	// Backup and modify DNS settings. Nothing after this may exit with
+	// log.Fatalf, errors have to go through the shutdown below.
+	if *systemDNS {
+		// A previous run that crashed left the system pointed at itself
+		if restored, err := restoreSavedDNSSettings(); err != nil {
+			log.Fatalf("[DNS] Failed to restore DNS settings from previous run: %v", err)
+		} else if restored {
+			log.Println("[DNS] Restored DNS settings left behind by previous run")
 		}
-	}()
 
-	// Wait for shutdown signal
-	sig := <-sigChan
-	log.Printf("[SHUTDOWN] Received signal: %v", sig)
+		configurator, err := dnsconfig.New(cfg.DNSBackend)
+		if err != nil {
+			log.Fatalf("[CONFIG] %v", err)
+		}
+
+		// Point every network interface at the daemon, including ones that
+		// appear later, and put them back if they are changed
+		dnsManager = dnsconfig.NewManager(configurator, resolvers, config.GetDNSStatePath(), recordTamper)
+		if err := dnsManager.Start(); err != nil {
+			log.Fatalf("[DNS] Failed to modify DNS settings using %s: %v", configurator.Name(), err)
+		}
+		checkInterval := time.Duration(cfg.DNSCheckInterval)
+		if checkInterval <= 0 {
+			checkInterval = time.Duration(config.Default().DNSCheckInterval)
+		}
+		dnsManager.Watch(checkInterval)
+		defer func() {
+			log.Println("[SHUTDOWN] Restoring DNS settings...")
+			if err := dnsManager.Stop(); err != nil {
+				log.Printf("[SHUTDOWN] Failed to restore DNS settings: %v, run fuckdopamined --restore-dns", err)
+			}
+		}()
+	} else {
+		log.Println("[DNS] Leaving system DNS settings untouched")
+	}
+
+	// Reload the config when the file changes or on SIGHUP
+	watchConfig(cfg)
+
+	log.Println("[IPC] Starting IPC server...")
+	go startIPCServer(listener)
+
+	// Start DNS servers for UDP and TCP
+	log.Printf("[DNS] Starting DNS server on %s (UDP and TCP)...", strings.Join(dnsAddrs, ", "))
+	dnsErrChan := make(chan error, 2*len(dnsAddrs))
+	dnsServers := startDNSServers(dnsAddrs, dnsErrChan)
+
+	// Wait for shutdown signal, or for a DNS listener to fail
+	select {
+	case sig := <-sigChan:
+		log.Printf("[SHUTDOWN] Received signal: %v", sig)
+	case err := <-dnsErrChan:
+		log.Printf("[DNS] DNS server failed: %v", err)
+	}
+
+	for _, server := range dnsServers {
+		if err := server.Shutdown(); err != nil {
+			log.Printf("[SHUTDOWN] Failed to stop %s DNS server: %v", server.Net, err)
+		}
+	}
 
 	// Save stats before exit
 	if err := statsData.Save(statsPath); err != nil {
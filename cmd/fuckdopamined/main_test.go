@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucastomic/fuckdopamine/pkg/config"
+	"github.com/lucastomic/fuckdopamine/pkg/stats"
+	"github.com/lucastomic/fuckdopamine/pkg/upstream"
+	"github.com/miekg/dns"
+)
+
+// upstreamIP is the address the test upstream answers every A query with
+const upstreamIP = "192.0.2.1"
+
+// useConfig makes the daemon check queries against the config in data,
+// saved in a temporary config file, with fresh stats and an upstream
+// answering upstreamIP. Everything is restored when the test ends.
+func useConfig(t *testing.T, data string) {
+	t.Helper()
+	var cfg config.Config
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.SetConfigPath(path)
+	t.Cleanup(func() { config.SetConfigPath("") })
+
+	policy, err := blockResponseFromConfig(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configRules, err := rulesFromConfig(&cfg, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lists, err := newBlocklists(&config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ruleset, err := rulesetWith(lists, configRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduleSet, err := schedulesFromConfig(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldState, oldStats, oldPool, oldClock := state.Load(), statsData, upstreams.Load(), clock
+	t.Cleanup(func() {
+		state.Store(oldState)
+		statsData = oldStats
+		upstreams.Store(oldPool)
+		clock = oldClock
+	})
+
+	state.Store(&snapshot{
+		rules:          ruleset,
+		groups:         groupsFromConfig(&cfg),
+		schedules:      scheduleSet,
+		pause:          pauseLimitsFromConfig(&cfg),
+		blockResponse:  policy,
+		quotaResetHour: quotaResetHourFromConfig(&cfg),
+		blocklists:     lists,
+	})
+	statsData = stats.New()
+	upstreams.Store(startUpstream(t))
+	t.Cleanup(resetPauses)
+}
+
+// resetPauses ends every pause without recording it
+func resetPauses() {
+	pauseMutex.Lock()
+	defer pauseMutex.Unlock()
+
+	if pauseTimer != nil {
+		pauseTimer.Stop()
+		pauseTimer = nil
+	}
+	isPaused = false
+	pauseStart, pauseUntil = time.Time{}, time.Time{}
+	clear(scopedPauses)
+}
+
+// startUpstream returns a pool of one local server answering upstreamIP
+func startUpstream(t *testing.T) *upstream.Pool {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A " + upstreamIP)
+			m.Answer = append(m.Answer, rr)
+			w.WriteMsg(m)
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+
+	pool, err := upstream.NewPool([]upstream.Options{{Address: pc.LocalAddr().String(), Timeout: time.Second}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Stop)
+	return pool
+}
+
+// recorder is a dns.ResponseWriter keeping the response written to it
+type recorder struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *recorder) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53000}
+}
+
+func (w *recorder) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// query sends an A query for domain through handleDNSRequest
+func query(t *testing.T, domain string) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+	w := &recorder{}
+	handleDNSRequest(w, r)
+	if w.msg == nil {
+		t.Fatalf("no response to %s", domain)
+	}
+	return w.msg
+}
+
+// forwarded reports whether resp is the test upstream's answer
+func forwarded(resp *dns.Msg) bool {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		return false
+	}
+	a, ok := resp.Answer[0].(*dns.A)
+	return ok && a.A.String() == upstreamIP
+}
+
+func TestAddRemoveScheduledRule(t *testing.T) {
+	useConfig(t, `{"version": 1, "blocked_sites": [{"rule": "news.com", "schedule": "work"}], "allowed_sites": ["docs.news.com"]}`)
+
+	err := blockDomain("news.com", "", "")
+	if err == nil || !strings.Contains(err.Error(), `schedule "work"`) {
+		t.Errorf("blocking a domain blocked on a schedule: %v", err)
+	}
+	if err := allowDomain("docs.news.com", ""); err == nil {
+		t.Error("allowed a domain twice")
+	}
+
+	if err := unblockDomain("news.com", ""); err != nil {
+		t.Fatalf("unblocking a domain blocked on a schedule: %v", err)
+	}
+	if rules := listBlockedRules(); len(rules) != 0 {
+		t.Errorf("blocked rules after unblocking = %v", rules)
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.BlockedSites) != 0 {
+		t.Errorf("saved blocked sites = %v", cfg.BlockedSites)
+	}
+
+	if err := unblockDomain("news.com", ""); err == nil || err.Error() != "domain is not blocked" {
+		t.Errorf("unblocking twice: %v", err)
+	}
+	if err := blockDomain("news.com", "", ""); err != nil {
+		t.Errorf("blocking again: %v", err)
+	}
+}
+
+func TestSaveRulesUnreadableConfig(t *testing.T) {
+	useConfig(t, `{"version": 1, "blocked_sites": ["reddit.com"]}`)
+	broken := []byte(`{"version": 1, "blocked_sites": ["reddit.com"],`)
+	if err := os.WriteFile(config.GetConfigPath(), broken, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := blockDomain("youtube.com", "", ""); err == nil {
+		t.Error("blocked a domain with an unreadable config file")
+	}
+	if err := unblockDomain("reddit.com", ""); err == nil {
+		t.Error("unblocked a domain with an unreadable config file")
+	}
+
+	// The file is left for the user to fix and the rules are unchanged
+	if data, err := os.ReadFile(config.GetConfigPath()); err != nil || string(data) != string(broken) {
+		t.Errorf("config file = %q, %v", data, err)
+	}
+	if rules := listBlockedRules(); len(rules) != 1 {
+		t.Errorf("blocked rules = %v", rules)
+	}
+}
+
+func TestSystemResolvers(t *testing.T) {
+	tests := []struct {
+		addrs []string
+		want  []string
+	}{
+		{[]string{"127.0.0.1:53"}, []string{"127.0.0.1"}},
+		{[]string{"127.0.0.2:53"}, []string{"127.0.0.2"}},
+		{[]string{"[::1]:53"}, []string{"::1"}},
+		{[]string{"127.0.0.1:53", "[::1]:53", "127.0.0.1:53"}, []string{"127.0.0.1", "::1"}},
+		{[]string{"0.0.0.0:53"}, []string{"127.0.0.1"}},
+		{[]string{"[::]:53"}, []string{"::1"}},
+		{[]string{":53"}, []string{"127.0.0.1", "::1"}},
+		{[]string{"127.0.0.1:5353", "[::1]:53"}, []string{"::1"}}, // Other ports are left out
+		{[]string{"127.0.0.1:5353"}, nil},
+	}
+	for _, tt := range tests {
+		got, err := systemResolvers(tt.addrs)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("systemResolvers(%v) = %v, want an error", tt.addrs, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("systemResolvers(%v) = %v, %v, want %v", tt.addrs, got, err, tt.want)
+		}
+	}
+}
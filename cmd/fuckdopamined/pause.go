@@ -0,0 +1,466 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lucastomic/fuckdopamine/pkg/config"
+	"github.com/lucastomic/fuckdopamine/pkg/matcher"
+	"github.com/lucastomic/fuckdopamine/pkg/stats"
+)
+
+// defaultPauseDuration is the length of a pause when the config doesn't set one
+const defaultPauseDuration = 10 * time.Minute
+
+// pauseLimits rations pauses, zero limits are unlimited
+type pauseLimits struct {
+	defaultDuration time.Duration
+	maxDuration     time.Duration
+	maxPerDay       int
+	maxTimePerDay   time.Duration
+	cooldown        time.Duration
+}
+
+// pauseLimitsFromConfig builds the pause limits of cfg
+func pauseLimitsFromConfig(cfg *config.Config) *pauseLimits {
+	pc := cfg.Pause
+	limits := &pauseLimits{
+		defaultDuration: time.Duration(pc.DefaultDuration),
+		maxDuration:     time.Duration(pc.MaxDuration),
+		maxPerDay:       max(pc.MaxPerDay, 0),
+		maxTimePerDay:   time.Duration(max(pc.MaxMinutesPerDay, 0)) * time.Minute,
+		cooldown:        max(time.Duration(pc.Cooldown), 0),
+	}
+	if limits.defaultDuration <= 0 {
+		limits.defaultDuration = defaultPauseDuration
+	}
+	if limits.maxDuration <= 0 {
+		limits.maxDuration = limits.defaultDuration
+	}
+	limits.defaultDuration = min(limits.defaultDuration, limits.maxDuration)
+	return limits
+}
+
+// allow returns how long a pause asked to last d can last, or why it is
+// denied. A zero d asks for the default duration, which is shortened
+// to fit in the minutes left today.
+func (l *pauseLimits) allow(d time.Duration, usage stats.PauseUsage, now time.Time) (time.Duration, error) {
+	requested := d != 0
+	if d < 0 {
+		return 0, errors.New("pause duration must be positive")
+	}
+	if !requested {
+		d = l.defaultDuration
+	}
+	if d > l.maxDuration {
+		return 0, fmt.Errorf("pause duration %s is longer than the %s allowed", shortDuration(d), shortDuration(l.maxDuration))
+	}
+
+	if next := l.nextPause(usage, now); next.After(now) {
+		reason := l.usedToday(usage)
+		if reason == "" {
+			reason = fmt.Sprintf("pauses need a %s cooldown", shortDuration(l.cooldown))
+		}
+		return 0, fmt.Errorf("%s, next available at %s", reason, clockTime(next, now))
+	}
+
+	if left := l.timeLeft(usage); l.maxTimePerDay > 0 && d > left {
+		if requested {
+			return 0, fmt.Errorf("%s, pause for at most %s", l.usedToday(usage), shortDuration(left))
+		}
+		d = left
+	}
+	return d, nil
+}
+
+// allowExtension returns how much longer the pause p can last when asked
+// to last d longer, or why it can't. A zero d asks for the default duration,
+// which is shortened to fit in the limits. Extending doesn't count as a new
+// pause, but the extra time counts towards the minutes per day.
+func (l *pauseLimits) allowExtension(p pausePeriod, d time.Duration, usage stats.PauseUsage) (time.Duration, error) {
+	requested := d != 0
+	if d < 0 {
+		return 0, errors.New("extension must be positive")
+	}
+	if !requested {
+		d = l.defaultDuration
+	}
+
+	// Shortens d to fit in left, or explains why it doesn't
+	limit := func(left time.Duration, reason string) error {
+		left = max(left, 0).Truncate(time.Second)
+		switch {
+		case d <= left:
+		case left < time.Second:
+			return fmt.Errorf("%s, the pause can't be extended", reason)
+		case requested:
+			return fmt.Errorf("%s, extend by at most %s", reason, shortDuration(left))
+		default:
+			d = left
+		}
+		return nil
+	}
+	if err := limit(l.maxDuration-p.until.Sub(p.start), "pauses last at most "+shortDuration(l.maxDuration)); err != nil {
+		return 0, err
+	}
+	if l.maxTimePerDay > 0 {
+		if err := limit(l.timeLeft(usage), l.usedToday(usage)); err != nil {
+			return 0, err
+		}
+	}
+	return d, nil
+}
+
+// nextPause returns when the next pause can start, now if it can right
+// away. The cooldown runs from the latest end of any pause, whatever its scope.
+func (l *pauseLimits) nextPause(usage stats.PauseUsage, now time.Time) time.Time {
+	next := now
+	tomorrow := usage.Period.AddDate(0, 0, 1)
+	if l.maxPerDay > 0 && usage.Count >= l.maxPerDay {
+		next = tomorrow
+	}
+	// Pauses shorter than a minute aren't worth taking
+	if l.maxTimePerDay > 0 && l.timeLeft(usage) < time.Minute {
+		next = tomorrow
+	}
+	if l.cooldown > 0 {
+		for _, end := range usage.LastEnds {
+			if ready := end.Add(l.cooldown); ready.After(next) {
+				next = ready
+			}
+		}
+	}
+	return next
+}
+
+// timeLeft returns the pause time left today
+func (l *pauseLimits) timeLeft(usage stats.PauseUsage) time.Duration {
+	return max(l.maxTimePerDay-usage.Time, 0).Truncate(time.Second)
+}
+
+// usedToday describes how much of the daily limits is used, such as
+// "2 of 3 pauses used today", or returns "" when there are none
+func (l *pauseLimits) usedToday(usage stats.PauseUsage) string {
+	var used []string
+	if l.maxPerDay > 0 {
+		used = append(used, fmt.Sprintf("%d of %d pauses", usage.Count, l.maxPerDay))
+	}
+	if l.maxTimePerDay > 0 {
+		used = append(used, fmt.Sprintf("%d of %d pause minutes", wholeMinutes(usage.Time), wholeMinutes(l.maxTimePerDay)))
+	}
+	if len(used) == 0 {
+		return ""
+	}
+	return strings.Join(used, " and ") + " used today"
+}
+
+// budget describes the pauses of all blocking left, shown on the block page
+// and in stats
+func (l *pauseLimits) budget(usage stats.PauseUsage, now time.Time) string {
+	var parts []string
+	if l.maxPerDay > 0 {
+		parts = append(parts, fmt.Sprintf("%d of %d pauses left today", max(l.maxPerDay-usage.Count, 0), l.maxPerDay))
+	} else {
+		parts = append(parts, "unlimited pauses")
+	}
+	if l.maxTimePerDay > 0 {
+		parts = append(parts, fmt.Sprintf("%d of %d minutes left today", wholeMinutes(l.timeLeft(usage)), wholeMinutes(l.maxTimePerDay)))
+	}
+	parts = append(parts, "up to "+shortDuration(l.maxDuration)+" each")
+	if l.cooldown > 0 {
+		parts = append(parts, shortDuration(l.cooldown)+" cooldown between pauses")
+	}
+	if next := l.nextPause(usage, now); next.After(now) {
+		parts = append(parts, "next available at "+clockTime(next, now))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// pauseScope is what a scoped pause unblocks, the zero scope is all blocking
+type pauseScope struct {
+	kind   string // "domain", "rule" or "group"
+	target string
+}
+
+func (s pauseScope) String() string {
+	if s.kind == "" {
+		return ""
+	}
+	return s.kind + ":" + s.target
+}
+
+// describe names the scope in messages, such as "domain linkedin.com"
+func (s pauseScope) describe() string {
+	if s.kind == "" {
+		return "blocking"
+	}
+	return s.kind + " " + s.target
+}
+
+// pausePeriod is when a running pause started and when it ends
+type pausePeriod struct {
+	start, until time.Time
+}
+
+// covers reports whether the pause lets domain through when rule blocks it.
+// A domain pause covers its subdomains too.
+func (s pauseScope) covers(domain string, rule *matcher.Rule) bool {
+	switch s.kind {
+	case "domain":
+		return domain == s.target || strings.HasSuffix(domain, "."+s.target)
+	case "rule":
+		return rule.String() == s.target
+	case "group":
+		return rule.Group == s.target
+	}
+	return false
+}
+
+// parsePauseScope normalizes the target of a pause, an empty kind is all blocking
+func parsePauseScope(kind, target string) (pauseScope, error) {
+	switch kind {
+	case "":
+		return pauseScope{}, nil
+	case "domain":
+		return pauseScope{kind: kind, target: matcher.Normalize(target)}, nil
+	case "rule":
+		rule, err := matcher.ParseRule(target)
+		if err != nil {
+			return pauseScope{}, err
+		}
+		return pauseScope{kind: kind, target: rule.String()}, nil
+	case "group":
+		return pauseScope{kind: kind, target: target}, nil
+	}
+	return pauseScope{}, fmt.Errorf("unknown pause scope %q (expected domain, rule or group)", kind)
+}
+
+// resolvePauseScope normalizes the target of a scoped pause and checks that
+// it blocks something
+func resolvePauseScope(kind, target string) (pauseScope, error) {
+	scope, err := parsePauseScope(kind, target)
+	if err != nil {
+		return pauseScope{}, err
+	}
+	s := current()
+	switch scope.kind {
+	case "domain":
+		if rule := s.rules.Match(scope.target, nil); rule == nil || rule.Action != matcher.ActionBlock {
+			return pauseScope{}, fmt.Errorf("%s is not blocked by any rule", scope.target)
+		}
+	case "rule":
+		for _, r := range s.rules.Rules(matcher.ActionBlock) {
+			if r.String() == scope.target {
+				return scope, nil
+			}
+		}
+		return pauseScope{}, fmt.Errorf("no blocking rule %s", scope.target)
+	case "group":
+		if _, ok := s.groups.enabled[scope.target]; !ok {
+			return pauseScope{}, fmt.Errorf("unknown group %q", scope.target)
+		}
+	}
+	return scope, nil
+}
+
+// pauseScoped pauses blocking for a single domain, rule or group for d,
+// zero means the configured default, if the pause limits allow it, and
+// returns when the pause ends
+func pauseScoped(kind, target string, d time.Duration) (time.Time, error) {
+	scope, err := resolvePauseScope(kind, target)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	pauseMutex.Lock()
+	defer pauseMutex.Unlock()
+
+	now := time.Now()
+	endExpiredPauses(now)
+	if isPaused {
+		return time.Time{}, fmt.Errorf("blocking is already paused until %s", pauseUntil.Format("15:04"))
+	}
+	if p, ok := scopedPauses[scope]; ok {
+		return time.Time{}, fmt.Errorf("%s is already paused until %s", scope.describe(), p.until.Format("15:04"))
+	}
+
+	period := quotaPeriod(now)
+	d, err = current().pause.allow(d, statsData.GetPauseUsage(period), now)
+	if err != nil {
+		log.Printf("[PAUSE] Pause of %s denied: %v", scope.describe(), err)
+		return time.Time{}, err
+	}
+
+	until := now.Add(d)
+	scopedPauses[scope] = pausePeriod{start: now, until: until}
+	statsData.StartPause(scope.String(), period, until)
+	schedulePauseTimer()
+	log.Printf("[PAUSE] Paused %s for %s until %s", scope.describe(), shortDuration(d), until.Format("15:04:05"))
+	return until, nil
+}
+
+// runningPause returns the pause of scope, the caller holds pauseMutex
+func runningPause(scope pauseScope) (pausePeriod, error) {
+	if scope.kind == "" {
+		if !isPaused {
+			return pausePeriod{}, errors.New("blocking is not paused")
+		}
+		return pausePeriod{start: pauseStart, until: pauseUntil}, nil
+	}
+	p, ok := scopedPauses[scope]
+	if !ok {
+		return pausePeriod{}, fmt.Errorf("%s is not paused", scope.describe())
+	}
+	return p, nil
+}
+
+// resumePause ends the pause of all blocking, or of a single domain, rule
+// or group, before it runs out. The unused time goes back to the daily limit.
+func resumePause(kind, target string) error {
+	scope, err := parsePauseScope(kind, target)
+	if err != nil {
+		return err
+	}
+
+	pauseMutex.Lock()
+	defer pauseMutex.Unlock()
+
+	now := time.Now()
+	endExpiredPauses(now)
+	if _, err := runningPause(scope); err != nil {
+		return err
+	}
+
+	if scope.kind == "" {
+		isPaused = false
+		pauseStart, pauseUntil = time.Time{}, time.Time{}
+	} else {
+		delete(scopedPauses, scope)
+	}
+	statsData.EndPause(scope.String(), now)
+	schedulePauseTimer()
+	if scope.kind == "" {
+		log.Println("[PAUSE] Blocking resumed early")
+	} else {
+		log.Printf("[PAUSE] Blocking of %s resumed early", scope.describe())
+	}
+	return nil
+}
+
+// extendPause makes a running pause last d longer, zero means the default
+// duration, if the pause limits allow it, and returns when it now ends
+func extendPause(kind, target string, d time.Duration) (time.Time, error) {
+	scope, err := parsePauseScope(kind, target)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	pauseMutex.Lock()
+	defer pauseMutex.Unlock()
+
+	now := time.Now()
+	endExpiredPauses(now)
+	p, err := runningPause(scope)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	period := quotaPeriod(now)
+	d, err = current().pause.allowExtension(p, d, statsData.GetPauseUsage(period))
+	if err != nil {
+		log.Printf("[PAUSE] Extension of the pause of %s denied: %v", scope.describe(), err)
+		return time.Time{}, err
+	}
+
+	p.until = p.until.Add(d)
+	if scope.kind == "" {
+		pauseUntil = p.until
+	} else {
+		scopedPauses[scope] = p
+	}
+	statsData.ExtendPause(scope.String(), period, p.until)
+	schedulePauseTimer()
+	log.Printf("[PAUSE] Pause of %s extended by %s until %s", scope.describe(), shortDuration(d), p.until.Format("15:04:05"))
+	return p.until, nil
+}
+
+// scopedPauseCovers reports whether a scoped pause lets domain through when
+// rule blocks it
+func scopedPauseCovers(domain string, rule *matcher.Rule) bool {
+	pauseMutex.RLock()
+	defer pauseMutex.RUnlock()
+
+	for scope := range scopedPauses {
+		if scope.covers(domain, rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// listScopedPauses returns the running scoped pauses, earliest end first
+func listScopedPauses() []stats.ScopedPause {
+	pauseMutex.RLock()
+	defer pauseMutex.RUnlock()
+
+	now := time.Now()
+	list := make([]stats.ScopedPause, 0, len(scopedPauses))
+	for scope, p := range scopedPauses {
+		if p.until.After(now) {
+			list = append(list, stats.ScopedPause{Scope: scope.kind, Target: scope.target, Until: p.until.Format(time.RFC3339)})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Until != list[j].Until {
+			return list[i].Until < list[j].Until
+		}
+		return list[i].Target < list[j].Target
+	})
+	return list
+}
+
+// pauseBudget describes the pauses left right now
+func pauseBudget() string {
+	now := time.Now()
+	return current().pause.budget(statsData.GetPauseUsage(quotaPeriod(now)), now)
+}
+
+// wholeMinutes rounds d to the nearest minute
+func wholeMinutes(d time.Duration) int {
+	return int(d.Round(time.Minute) / time.Minute)
+}
+
+// shortDuration formats d without trailing zero units, "30m" rather than "30m0s"
+func shortDuration(d time.Duration) string {
+	s := d.Round(time.Second).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// clockTime formats t as a time of day relative to now, rounded up to the
+// minute so nothing is available before the time shown
+func clockTime(t, now time.Time) string {
+	if !t.Truncate(time.Minute).Equal(t) {
+		t = t.Truncate(time.Minute).Add(time.Minute)
+	}
+	ty, tm, td := t.Date()
+	ny, nm, nd := now.Date()
+	ay, am, ad := now.AddDate(0, 0, 1).Date()
+	switch {
+	case ty == ny && tm == nm && td == nd:
+		return t.Format("15:04")
+	case ty == ay && tm == am && td == ad:
+		return t.Format("15:04") + " tomorrow"
+	default:
+		return t.Format("Mon Jan 2 15:04")
+	}
+}
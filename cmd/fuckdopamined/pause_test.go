@@ -0,0 +1,324 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lucastomic/fuckdopamine/pkg/stats"
+	"github.com/miekg/dns"
+)
+
+const pauseConfig = `{
+	"version": 1,
+	"blocked_sites": ["reddit.com", "youtube.com"],
+	"pause": {"default_duration": "10m", "max_duration": "20m", "max_minutes_per_day": 30}
+}`
+
+// blocked reports whether a query for domain is refused
+func blocked(t *testing.T, domain string) bool {
+	t.Helper()
+	return query(t, domain).Rcode == dns.RcodeRefused
+}
+
+func TestResumePause(t *testing.T) {
+	useConfig(t, pauseConfig)
+
+	if err := pauseBlocking(10 * time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if blocked(t, "reddit.com") {
+		t.Error("reddit.com blocked while paused")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if err := resumePause("", ""); err != nil {
+		t.Fatal(err)
+	}
+	if !blocked(t, "reddit.com") {
+		t.Error("reddit.com not blocked after resuming")
+	}
+
+	// Only the time actually paused counts
+	count, total, _ := statsData.GetPauseStats()
+	if count != 1 || total < 50*time.Millisecond || total > time.Second {
+		t.Errorf("pause stats = %d pauses for %s, want 1 for about 50ms", count, total)
+	}
+	usage := statsData.GetPauseUsage(quotaPeriod(time.Now()))
+	if usage.Count != 1 || usage.Time > time.Second {
+		t.Errorf("usage = %d pauses for %s, the unused time wasn't given back", usage.Count, usage.Time)
+	}
+
+	if err := resumePause("", ""); err == nil || err.Error() != "blocking is not paused" {
+		t.Errorf("resuming twice: %v", err)
+	}
+}
+
+func TestResumeScopedPause(t *testing.T) {
+	useConfig(t, pauseConfig)
+
+	if _, err := pauseScoped("domain", "reddit.com", 10*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if blocked(t, "www.reddit.com") || !blocked(t, "youtube.com") {
+		t.Error("the pause of reddit.com doesn't cover just reddit.com")
+	}
+
+	if err := resumePause("domain", "youtube.com"); err == nil {
+		t.Error("resumed a domain that isn't paused")
+	}
+	if err := resumePause("domain", "Reddit.com."); err != nil {
+		t.Fatal(err)
+	}
+	if !blocked(t, "www.reddit.com") {
+		t.Error("reddit.com not blocked after resuming")
+	}
+	if count, total := statsData.GetScopedPauseStats(); count != 1 || total > time.Second {
+		t.Errorf("scoped pause stats = %d pauses for %s", count, total)
+	}
+}
+
+func TestExtendPause(t *testing.T) {
+	useConfig(t, pauseConfig)
+
+	if err := pauseBlocking(15 * time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	start := pauseStart
+
+	// Pauses last at most 20m however they are extended
+	if _, err := extendPause("", "", 10*time.Minute); err == nil || err.Error() != "pauses last at most 20m, extend by at most 5m" {
+		t.Errorf("extending past the max duration: %v", err)
+	}
+	until, err := extendPause("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := start.Add(20 * time.Minute); !until.Equal(want) || !pauseUntil.Equal(want) {
+		t.Errorf("extended until %s, want the 20m max %s", until, want)
+	}
+	if _, err := extendPause("", "", 0); err == nil || err.Error() != "pauses last at most 20m, the pause can't be extended" {
+		t.Errorf("extending a pause at the max duration: %v", err)
+	}
+
+	// The extension counts towards the minutes per day, but not as a pause
+	usage := statsData.GetPauseUsage(quotaPeriod(time.Now()))
+	if usage.Count != 1 || usage.Time < 20*time.Minute-time.Second || usage.Time > 20*time.Minute {
+		t.Errorf("usage = %d pauses for %s, want 1 for 20m", usage.Count, usage.Time)
+	}
+
+	if _, err := extendPause("group", "social", 0); err == nil {
+		t.Error("extended a pause that isn't running")
+	}
+}
+
+func TestExtendPauseMinutesPerDay(t *testing.T) {
+	useConfig(t, `{"version": 1, "blocked_sites": ["reddit.com"], "pause": {"max_duration": "1h", "max_minutes_per_day": 20}}`)
+
+	until, err := pauseScoped("domain", "reddit.com", 15*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := extendPause("domain", "reddit.com", 10*time.Minute); err == nil || err.Error() != "15 of 20 pause minutes used today, extend by at most 5m" {
+		t.Errorf("extending past the minutes per day: %v", err)
+	}
+	extended, err := extendPause("domain", "reddit.com", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := extended.Sub(until); got != 5*time.Minute {
+		t.Errorf("default extension shortened to %s, want the 5m left today", got)
+	}
+}
+
+func TestPauseTimer(t *testing.T) {
+	useConfig(t, pauseConfig)
+
+	if err := pauseBlocking(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pauseScoped("domain", "youtube.com", 150*time.Millisecond); err == nil {
+		t.Error("paused a domain while all blocking is paused")
+	}
+
+	// Without any queries coming in, the timer ends the pause
+	waitResumed(t, func() bool { return !isPausedFn() })
+	if count, total, _ := statsData.GetPauseStats(); count != 1 || !about(total, 100*time.Millisecond) {
+		t.Errorf("pause stats = %d pauses for %s, want 1 for 100ms", count, total)
+	}
+
+	if _, err := pauseScoped("domain", "youtube.com", 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	waitResumed(t, func() bool { return scopedPauseCount() == 0 })
+	if count, total := statsData.GetScopedPauseStats(); count != 1 || !about(total, 100*time.Millisecond) {
+		t.Errorf("scoped pause stats = %d pauses for %s, want 1 for 100ms", count, total)
+	}
+	if !blocked(t, "youtube.com") {
+		t.Error("youtube.com not blocked after its pause ran out")
+	}
+}
+
+// waitResumed waits for resumed to report that the pause timer ended a pause
+func waitResumed(t *testing.T, resumed func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !resumed() {
+		if time.Now().After(deadline) {
+			t.Fatal("pause not ended by the timer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// about reports whether d is want, give or take the time between the daemon
+// and the stats reading the clock
+func about(d, want time.Duration) bool {
+	return d > want-10*time.Millisecond && d <= want
+}
+
+// scopedPauseCount returns the number of scoped pauses still recorded
+func scopedPauseCount() int {
+	pauseMutex.RLock()
+	defer pauseMutex.RUnlock()
+	return len(scopedPauses)
+}
+
+// pauseDay is the start of the day the synthetic pause usage counts towards
+var pauseDay = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// at returns the time of day on pauseDay
+func at(hour, minute int) time.Time {
+	return pauseDay.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+}
+
+// usage returns the pauses of pauseDay, the last of them ending at lastEnd
+func usage(count int, minutes int, lastEnd time.Time) stats.PauseUsage {
+	u := stats.PauseUsage{Period: pauseDay, Count: count, Time: time.Duration(minutes) * time.Minute, LastEnds: map[string]time.Time{}}
+	if !lastEnd.IsZero() {
+		u.LastEnds[""] = lastEnd
+	}
+	return u
+}
+
+func TestPauseAllow(t *testing.T) {
+	limits := &pauseLimits{
+		defaultDuration: 10 * time.Minute,
+		maxDuration:     30 * time.Minute,
+		maxPerDay:       3,
+		maxTimePerDay:   45 * time.Minute,
+		cooldown:        20 * time.Minute,
+	}
+
+	tests := []struct {
+		name    string
+		d       time.Duration
+		usage   stats.PauseUsage
+		now     time.Time
+		want    time.Duration
+		wantErr string
+	}{
+		{"default", 0, usage(0, 0, time.Time{}), at(9, 0), 10 * time.Minute, ""},
+		{"requested", 25 * time.Minute, usage(0, 0, time.Time{}), at(9, 0), 25 * time.Minute, ""},
+		{"negative", -time.Minute, usage(0, 0, time.Time{}), at(9, 0), 0, "pause duration must be positive"},
+		{"too long", 31 * time.Minute, usage(0, 0, time.Time{}), at(9, 0), 0, "pause duration 31m is longer than the 30m allowed"},
+		{"after the cooldown", 0, usage(2, 20, at(14, 0)), at(14, 20), 10 * time.Minute, ""},
+		{"in the cooldown", 0, usage(2, 20, at(14, 0)), at(14, 5), 0, "2 of 3 pauses and 20 of 45 pause minutes used today, next available at 14:20"},
+		{"cooldown of a scoped pause", 0, stats.PauseUsage{Period: pauseDay, Count: 1, Time: 5 * time.Minute, LastEnds: map[string]time.Time{
+			"":                  at(8, 0),
+			"domain:reddit.com": at(13, 59),
+		}}, at(14, 0), 0, "1 of 3 pauses and 5 of 45 pause minutes used today, next available at 14:19"},
+		{"all pauses used", 0, usage(3, 30, at(10, 0)), at(14, 0), 0, "3 of 3 pauses and 30 of 45 pause minutes used today, next available at 00:00 tomorrow"},
+		{"default shortened to the minutes left", 0, usage(2, 40, at(10, 0)), at(14, 0), 5 * time.Minute, ""},
+		{"requested over the minutes left", 10 * time.Minute, usage(2, 40, at(10, 0)), at(14, 0), 0, "2 of 3 pauses and 40 of 45 pause minutes used today, pause for at most 5m"},
+		{"less than a minute left", 0, stats.PauseUsage{Period: pauseDay, Count: 2, Time: 44*time.Minute + 30*time.Second}, at(14, 0), 0,
+			"2 of 3 pauses and 45 of 45 pause minutes used today, next available at 00:00 tomorrow"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := limits.allow(tt.d, tt.usage, tt.now)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("allow = %s, %v, want error %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("allow = %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPauseAllowCooldown(t *testing.T) {
+	limits := &pauseLimits{defaultDuration: 10 * time.Minute, maxDuration: 10 * time.Minute, maxPerDay: 3, cooldown: 20 * time.Minute}
+	_, err := limits.allow(0, usage(2, 20, at(14, 0)), at(14, 1))
+	if want := "2 of 3 pauses used today, next available at 14:20"; err == nil || err.Error() != want {
+		t.Errorf("allow in the cooldown: %v, want %q", err, want)
+	}
+
+	limits = &pauseLimits{defaultDuration: 10 * time.Minute, maxDuration: 10 * time.Minute, cooldown: time.Hour}
+	_, err = limits.allow(0, usage(5, 50, at(23, 30)), at(23, 40))
+	if want := "pauses need a 1h cooldown, next available at 00:30 tomorrow"; err == nil || err.Error() != want {
+		t.Errorf("allow in the cooldown: %v, want %q", err, want)
+	}
+}
+
+func TestNextPause(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits pauseLimits
+		usage  stats.PauseUsage
+		now    time.Time
+		want   time.Time
+	}{
+		{"unlimited", pauseLimits{}, usage(10, 300, at(13, 59)), at(14, 0), at(14, 0)},
+		{"pauses left", pauseLimits{maxPerDay: 3}, usage(2, 0, time.Time{}), at(14, 0), at(14, 0)},
+		{"no pauses left", pauseLimits{maxPerDay: 3}, usage(3, 0, time.Time{}), at(14, 0), pauseDay.AddDate(0, 0, 1)},
+		{"no minutes left", pauseLimits{maxTimePerDay: time.Hour}, usage(1, 60, time.Time{}), at(14, 0), pauseDay.AddDate(0, 0, 1)},
+		{"cooldown", pauseLimits{cooldown: 20 * time.Minute}, usage(1, 10, at(14, 0)), at(14, 10), at(14, 20)},
+		{"cooldown over", pauseLimits{cooldown: 20 * time.Minute}, usage(1, 10, at(14, 0)), at(14, 30), at(14, 30)},
+		// A cooldown running past the reset delays the next day's first pause
+		{"cooldown past tomorrow", pauseLimits{maxPerDay: 1, cooldown: time.Hour}, usage(1, 10, at(23, 30)), at(23, 40), at(24, 30)},
+		{"latest of any scope", pauseLimits{cooldown: 20 * time.Minute}, stats.PauseUsage{Period: pauseDay, LastEnds: map[string]time.Time{
+			"":                at(12, 0),
+			"group:social":    at(14, 5),
+			"rule:reddit.com": at(13, 0),
+		}}, at(14, 10), at(14, 25)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.limits.nextPause(tt.usage, tt.now); !got.Equal(tt.want) {
+				t.Errorf("nextPause = %s, want %s", got.Format(time.DateTime), tt.want.Format(time.DateTime))
+			}
+		})
+	}
+}
+
+func TestPauseBudget(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits pauseLimits
+		usage  stats.PauseUsage
+		now    time.Time
+		want   string
+	}{
+		{"unlimited", pauseLimits{maxDuration: 10 * time.Minute}, usage(5, 50, time.Time{}), at(14, 0),
+			"unlimited pauses, up to 10m each"},
+		{"in the cooldown", pauseLimits{maxDuration: 10 * time.Minute, maxPerDay: 3, cooldown: 20 * time.Minute}, usage(2, 20, at(14, 0)), at(14, 5),
+			"1 of 3 pauses left today, up to 10m each, 20m cooldown between pauses, next available at 14:20"},
+		{"minutes", pauseLimits{maxDuration: time.Hour, maxTimePerDay: 90 * time.Minute}, usage(1, 30, at(10, 0)), at(14, 0),
+			"unlimited pauses, 60 of 90 minutes left today, up to 1h each"},
+		{"used up", pauseLimits{maxDuration: 15 * time.Minute, maxPerDay: 2}, usage(2, 20, at(10, 0)), at(14, 0),
+			"0 of 2 pauses left today, up to 15m each, next available at 00:00 tomorrow"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.limits.budget(tt.usage, tt.now); got != tt.want {
+				t.Errorf("budget = %q\n want %q", got, tt.want)
+			}
+		})
+	}
+}
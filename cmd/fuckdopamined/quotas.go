@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lucastomic/fuckdopamine/pkg/config"
+	"github.com/lucastomic/fuckdopamine/pkg/matcher"
+	"github.com/lucastomic/fuckdopamine/pkg/stats"
+	"github.com/miekg/dns"
+)
+
+// quotaTTL caps the TTL of answers for domains under a quota, in seconds,
+// so clients keep querying while the site is used and every active minute
+// is counted
+const quotaTTL = 60
+
+// quotaResetHourFromConfig returns the local hour daily quotas and pause
+// limits start over
+func quotaResetHourFromConfig(cfg *config.Config) int {
+	hour := cfg.QuotaResetHour
+	if hour < 0 || hour > 23 {
+		hour = 0
+	}
+	return hour
+}
+
+// quotaPeriod returns when the quota day containing now started
+func quotaPeriod(now time.Time) time.Time {
+	start := time.Date(now.Year(), now.Month(), now.Day(), current().quotaResetHour, 0, 0, 0, now.Location())
+	if now.Before(start) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start
+}
+
+// quotaFromConfig converts a quota from the configuration
+func quotaFromConfig(qc *config.QuotaConfig) *matcher.Quota {
+	if qc == nil {
+		return nil
+	}
+	return &matcher.Quota{Minutes: qc.Minutes, Queries: uint64(qc.Queries)}
+}
+
+// quotaToConfig converts a quota back into its configuration form
+func quotaToConfig(q *matcher.Quota) *config.QuotaConfig {
+	if q == nil {
+		return nil
+	}
+	return &config.QuotaConfig{Minutes: q.Minutes, Queries: int(q.Queries)}
+}
+
+// useQuota counts a query against the quota of rule, reporting whether it
+// is let through
+func useQuota(rule *matcher.Rule, now time.Time) bool {
+	return statsData.UseQuota(rule.String(), quotaPeriod(now), now, rule.Quota.Queries, rule.Quota.Minutes)
+}
+
+// quotaLeft reports whether rule still has quota at now, without using any
+func quotaLeft(rule *matcher.Rule, now time.Time) bool {
+	return !quotaStatusOf(rule, now).Exhausted
+}
+
+func quotaStatusOf(rule *matcher.Rule, now time.Time) stats.QuotaStatus {
+	period := quotaPeriod(now)
+	usage := statsData.GetQuotaUsage(rule.String(), period)
+	st := stats.QuotaStatus{
+		Rule:        rule.String(),
+		Group:       rule.Group,
+		MaxMinutes:  rule.Quota.Minutes,
+		MaxQueries:  rule.Quota.Queries,
+		UsedMinutes: usage.ActiveMinutes,
+		UsedQueries: usage.Queries,
+		ResetsAt:    period.AddDate(0, 0, 1).Format(time.RFC3339),
+	}
+	if st.MaxMinutes > 0 {
+		st.RemainingMinutes = max(st.MaxMinutes-st.UsedMinutes, 0)
+		st.Exhausted = st.RemainingMinutes == 0
+	}
+	if st.MaxQueries > 0 {
+		st.RemainingQueries = st.MaxQueries - min(st.UsedQueries, st.MaxQueries)
+		st.Exhausted = st.Exhausted || st.RemainingQueries == 0
+	}
+	return st
+}
+
+// quotaStatus returns the quota of the rule that applies to domain, or of
+// every rule with a quota when domain is empty
+func quotaStatus(domain string) ([]stats.QuotaStatus, error) {
+	now := clock()
+	s := current()
+	if domain != "" {
+		rule := s.match(domain, now)
+		if rule == nil || rule.Action != matcher.ActionBlock {
+			return nil, fmt.Errorf("%s is not blocked", domain)
+		}
+		if rule.Quota == nil {
+			return nil, fmt.Errorf("%s is blocked by %s, which has no quota", domain, rule)
+		}
+		return []stats.QuotaStatus{quotaStatusOf(rule, now)}, nil
+	}
+
+	var statuses []stats.QuotaStatus
+	for _, rule := range s.rules.Rules(matcher.ActionBlock) {
+		if rule.Quota != nil {
+			statuses = append(statuses, quotaStatusOf(&rule, now))
+		}
+	}
+	return statuses, nil
+}
+
+// capTTL lowers the TTL of every record in m to at most ttl seconds
+func capTTL(m *dns.Msg, ttl uint32) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT && h.Ttl > ttl {
+				h.Ttl = ttl
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const quotaConfig = `{
+	"version": 1,
+	"quota_reset_hour": 4,
+	"blocked_sites": [
+		{"rule": "reddit.com", "quota": {"minutes": 2}},
+		{"rule": "youtube.com", "quota": {"queries": 3}}
+	]
+}`
+
+func TestQuotaPeriod(t *testing.T) {
+	useConfig(t, quotaConfig)
+
+	tests := []struct {
+		now  time.Time
+		want time.Time
+	}{
+		{time.Date(2024, time.January, 2, 12, 0, 0, 0, time.UTC), time.Date(2024, time.January, 2, 4, 0, 0, 0, time.UTC)},
+		{time.Date(2024, time.January, 2, 4, 0, 0, 0, time.UTC), time.Date(2024, time.January, 2, 4, 0, 0, 0, time.UTC)},
+		{time.Date(2024, time.January, 2, 3, 59, 0, 0, time.UTC), time.Date(2024, time.January, 1, 4, 0, 0, 0, time.UTC)},
+		// Past midnight still counts towards the day before
+		{time.Date(2024, time.January, 2, 0, 30, 0, 0, time.UTC), time.Date(2024, time.January, 1, 4, 0, 0, 0, time.UTC)},
+		{time.Date(2024, time.January, 1, 23, 30, 0, 0, time.UTC), time.Date(2024, time.January, 1, 4, 0, 0, 0, time.UTC)},
+		{time.Date(2024, time.January, 1, 1, 0, 0, 0, time.UTC), time.Date(2023, time.December, 31, 4, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := quotaPeriod(tt.now); !got.Equal(tt.want) {
+			t.Errorf("quotaPeriod(%s) = %s, want %s", tt.now.Format(time.DateTime), got.Format(time.DateTime), tt.want.Format(time.DateTime))
+		}
+	}
+}
+
+func TestQuotaMinutes(t *testing.T) {
+	useConfig(t, quotaConfig)
+	rule := current().match("reddit.com", clock())
+
+	steps := []struct {
+		at      time.Time
+		allowed bool
+	}{
+		{time.Date(2024, time.January, 1, 23, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, time.January, 1, 23, 0, 40, 0, time.UTC), true},
+		{time.Date(2024, time.January, 2, 0, 10, 0, 0, time.UTC), true}, // Past midnight, same quota day
+		{time.Date(2024, time.January, 2, 0, 11, 0, 0, time.UTC), false},
+		{time.Date(2024, time.January, 2, 3, 59, 0, 0, time.UTC), false},
+		{time.Date(2024, time.January, 2, 4, 0, 0, 0, time.UTC), true}, // Reset
+	}
+	for _, st := range steps {
+		clock = func() time.Time { return st.at }
+
+		resp := query(t, "www.reddit.com")
+		if st.allowed {
+			if !forwarded(resp) {
+				t.Fatalf("query at %s wasn't forwarded: %v", st.at.Format(time.DateTime), resp)
+			}
+			if ttl := resp.Answer[0].Header().Ttl; ttl != quotaTTL {
+				t.Errorf("TTL of an answer under a quota = %d, want %d", ttl, quotaTTL)
+			}
+		} else if resp.Rcode != dns.RcodeRefused {
+			t.Errorf("query at %s answered with %s, want it blocked", st.at.Format(time.DateTime), dns.RcodeToString[resp.Rcode])
+		}
+
+		// Blocked as far as the stats and block page are concerned once used up
+		if _, _, blocked := lookupBlock("www.reddit.com"); blocked == quotaLeft(rule, st.at) {
+			t.Errorf("lookupBlock at %s = %v with quota left %v", st.at.Format(time.DateTime), blocked, quotaLeft(rule, st.at))
+		}
+	}
+}
+
+func TestQuotaStatus(t *testing.T) {
+	useConfig(t, quotaConfig)
+	now := time.Date(2024, time.January, 2, 1, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if resp := query(t, "youtube.com"); !forwarded(resp) {
+			t.Fatalf("query %d wasn't forwarded: %v", i+1, resp)
+		}
+	}
+	if resp := query(t, "youtube.com"); resp.Rcode != dns.RcodeRefused {
+		t.Errorf("query over the quota answered with %s", dns.RcodeToString[resp.Rcode])
+	}
+	query(t, "reddit.com")
+
+	statuses, err := quotaStatus("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("got %d quotas, want 2", len(statuses))
+	}
+	reddit, youtube := statuses[0], statuses[1]
+	if reddit.Rule != "reddit.com" || reddit.UsedMinutes != 1 || reddit.RemainingMinutes != 1 || reddit.UsedQueries != 1 || reddit.Exhausted {
+		t.Errorf("reddit.com = %+v", reddit)
+	}
+	if youtube.Rule != "youtube.com" || youtube.UsedQueries != 3 || youtube.RemainingQueries != 0 || !youtube.Exhausted {
+		t.Errorf("youtube.com = %+v", youtube)
+	}
+	if reddit.ResetsAt != "2024-01-02T04:00:00Z" {
+		t.Errorf("quota resets at %s, want 2024-01-02T04:00:00Z", reddit.ResetsAt)
+	}
+
+	if st, err := quotaStatus("m.youtube.com"); err != nil || len(st) != 1 || st[0].Rule != "youtube.com" {
+		t.Errorf("quotaStatus(m.youtube.com) = %+v, %v", st, err)
+	}
+	if _, err := quotaStatus("example.com"); err == nil {
+		t.Error("quota status of a domain that isn't blocked")
+	}
+}
+
+func TestCapTTL(t *testing.T) {
+	m := new(dns.Msg)
+	for _, s := range []string{"a.com. 300 IN A 192.0.2.1", "a.com. 30 IN A 192.0.2.2"} {
+		rr, _ := dns.NewRR(s)
+		m.Answer = append(m.Answer, rr)
+	}
+	soa, _ := dns.NewRR("com. 900 IN SOA ns.com. admin.com. 1 7200 3600 1209600 3600")
+	m.Ns = append(m.Ns, soa)
+	m.SetEdns0(4096, false)
+
+	capTTL(m, 60)
+
+	for i, want := range []uint32{60, 30} {
+		if ttl := m.Answer[i].Header().Ttl; ttl != want {
+			t.Errorf("answer %d TTL = %d, want %d", i, ttl, want)
+		}
+	}
+	if ttl := m.Ns[0].Header().Ttl; ttl != 60 {
+		t.Errorf("authority TTL = %d, want 60", ttl)
+	}
+	// The OPT record's TTL holds the extended flags
+	if opt := m.IsEdns0(); opt == nil || opt.UDPSize() != 4096 || opt.Hdr.Ttl != 0 {
+		t.Errorf("OPT record changed: %v", opt)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lucastomic/fuckdopamine/pkg/blockresponse"
+	"github.com/lucastomic/fuckdopamine/pkg/config"
+	"github.com/lucastomic/fuckdopamine/pkg/upstream"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 2 * time.Second
+
+var (
+	activeConfig    *config.Config        // Config currently in effect, guarded by rulesMutex
+	startupConfig   *config.Config        // Config the daemon started with, for settings that can't be reloaded
+	configStamp     fileStamp             // Config file version last seen, guarded by rulesMutex
+	blockPagePolicy *blockresponse.Policy // Sinkhole policy of the block page, nil when it isn't running
+)
+
+// fileStamp identifies a version of a file without reading it
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statConfig() fileStamp {
+	info, err := os.Stat(config.GetConfigPath())
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// blockResponseFromConfig builds the global block response policy
+func blockResponseFromConfig(cfg *config.Config) (*blockresponse.Policy, error) {
+	policy, err := policyFromConfig(cfg.BlockResponse)
+	if err != nil {
+		return nil, err
+	}
+	policy = policy.Merge(&blockresponse.Policy{Mode: blockresponse.ModeRefused})
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// withBlockPage points policy at the block page while it is running
+func withBlockPage(policy *blockresponse.Policy) *blockresponse.Policy {
+	if blockPagePolicy == nil {
+		return policy
+	}
+	p := *blockPagePolicy
+	p.TTL = policy.TTL
+	return &p
+}
+
+// startUpstreamPool starts health checks on pool and makes it the active pool
+func startUpstreamPool(cfg *config.Config, pool *upstream.Pool) {
+	healthInterval := time.Duration(cfg.HealthCheckInterval)
+	if healthInterval <= 0 {
+		healthInterval = time.Duration(config.Default().HealthCheckInterval)
+	}
+	pool.StartHealthChecks(healthInterval)
+	upstreams.Store(pool)
+	for _, u := range pool.Status() {
+		log.Printf("[UPSTREAM] Using %s", u.Address)
+	}
+}
+
+func upstreamStatus() []upstream.Status {
+	return upstreams.Load().Status()
+}
+
+// watchConfig reloads the config when the file changes or on SIGHUP
+func watchConfig(cfg *config.Config) {
+	rulesMutex.Lock()
+	activeConfig, startupConfig = cfg, cfg
+	configStamp = statConfig()
+	rulesMutex.Unlock()
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	go func() {
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hupChan:
+				log.Println("[CONFIG] Received SIGHUP, reloading config")
+				reloadConfig()
+
+			case <-ticker.C:
+				rulesMutex.Lock()
+				stamp := statConfig()
+				changed := stamp != configStamp && stamp != (fileStamp{})
+				if changed {
+					// Also when the reload fails, so a broken file is reported once
+					configStamp = stamp
+					log.Println("[CONFIG] Config file changed, reloading")
+					reloadConfigLocked()
+				}
+				rulesMutex.Unlock()
+			}
+		}
+	}()
+}
+
+// reloadConfig re-reads the config file and swaps in its rules and
+// settings, returning a summary. Nothing changes if the file can't be read
+// or anything in it is invalid.
+func reloadConfig() (string, error) {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	configStamp = statConfig()
+	return reloadConfigLocked()
+}
+
+func reloadConfigLocked() (string, error) {
+	summary, err := applyConfig()
+	if err != nil {
+		log.Printf("[CONFIG] Reload failed, keeping the current config: %v", err)
+		return "", err
+	}
+	log.Printf("[CONFIG] %s", summary)
+	return summary, nil
+}
+
+// applyConfig validates the config file and makes it active
+func applyConfig() (string, error) {
+	cfg, report, err := config.LoadChecked()
+	if err != nil {
+		return "", err
+	}
+	checkConfig(cfg, report)
+	if err := report.Err(); err != nil {
+		return "", err
+	}
+	logProblems(report)
+
+	// Validate everything before changing anything
+	policy, err := blockResponseFromConfig(cfg)
+	if err != nil {
+		return "", fmt.Errorf("block response: %w", err)
+	}
+	configRules, err := rulesFromConfig(cfg, policy)
+	if err != nil {
+		return "", err
+	}
+	old := current()
+	lists := old.blocklists
+	if blocklistsChanged(activeConfig, cfg) {
+		if lists, err = newBlocklists(cfg); err != nil {
+			return "", fmt.Errorf("blocklists: %w", err)
+		}
+	}
+	ruleset, err := rulesetWith(lists, configRules)
+	if err != nil {
+		return "", err
+	}
+
+	scheduleSet, err := schedulesFromConfig(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	var pool *upstream.Pool
+	if upstreamsChanged(activeConfig, cfg) {
+		if pool, err = newUpstreamPool(cfg); err != nil {
+			return "", fmt.Errorf("upstreams: %w", err)
+		}
+	}
+
+	// Swap in the new config in one go
+	next := &snapshot{
+		rules:          ruleset,
+		groups:         groupsFromConfig(cfg),
+		schedules:      scheduleSet,
+		pause:          pauseLimitsFromConfig(cfg),
+		blockResponse:  withBlockPage(policy),
+		quotaResetHour: quotaResetHourFromConfig(cfg),
+		blocklists:     lists,
+	}
+	if lists != old.blocklists {
+		go old.blocklists.Stop() // May be waiting for a download
+		startBlocklists(cfg, lists)
+	}
+	state.Store(next)
+	if pool != nil {
+		oldPool := upstreams.Load()
+		startUpstreamPool(cfg, pool)
+		oldPool.Stop()
+		if responseCache != nil {
+			responseCache.Flush() // Answers from the old upstreams
+		}
+	}
+
+	activeConfig = cfg
+	restart := restartRequired(startupConfig, cfg)
+
+	summary := "Reloaded config: " + rulesSummary(ruleset, next.groups)
+	if lists != old.blocklists {
+		summary += ", blocklists replaced"
+	}
+	if pool != nil {
+		summary += ", upstreams replaced"
+	}
+	if len(restart) > 0 {
+		summary += "; restart the daemon to apply " + strings.Join(restart, ", ")
+	}
+	return summary, nil
+}
+
+func upstreamsChanged(old, cfg *config.Config) bool {
+	return !reflect.DeepEqual(old.Upstreams, cfg.Upstreams) ||
+		old.UpstreamStrategy != cfg.UpstreamStrategy ||
+		old.HealthCheckInterval != cfg.HealthCheckInterval
+}
+
+// restartRequired lists the changed settings that only take effect on restart
+func restartRequired(old, cfg *config.Config) []string {
+	var changed []string
+	check := func(name string, a, b any) {
+		if !reflect.DeepEqual(a, b) {
+			changed = append(changed, name)
+		}
+	}
+	check("listen_addresses", old.ListenAddresses, cfg.ListenAddresses)
+	check("socket_path", old.SocketPath, cfg.SocketPath)
+	check("log_file_path", old.LogFilePath, cfg.LogFilePath)
+	check("dns_backend", old.DNSBackend, cfg.DNSBackend)
+	check("dns_check_interval", old.DNSCheckInterval, cfg.DNSCheckInterval)
+	check("block_page", old.BlockPage, cfg.BlockPage)
+	check("cache", old.Cache, cfg.Cache)
+	return changed
+}
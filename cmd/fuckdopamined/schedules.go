@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lucastomic/fuckdopamine/pkg/config"
+	"github.com/lucastomic/fuckdopamine/pkg/schedule"
+)
+
+// clock returns the time schedules are evaluated at, a variable so the
+// blocking decision can be checked at any time of day
+var clock = time.Now
+
+// scheduleSet is the configured schedules
+type scheduleSet struct {
+	list   []*schedule.Schedule // In config order
+	byName map[string]*schedule.Schedule
+}
+
+// schedulesFromConfig builds the schedules of cfg, returning the valid ones
+// and an error describing each invalid one
+func schedulesFromConfig(cfg *config.Config) (*scheduleSet, error) {
+	set := &scheduleSet{byName: make(map[string]*schedule.Schedule, len(cfg.Schedules))}
+	var errs []error
+	for _, sc := range cfg.Schedules {
+		s, err := scheduleFromConfig(sc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("schedule %q: %w", sc.Name, err))
+			continue
+		}
+		if _, ok := set.byName[s.Name]; ok {
+			errs = append(errs, fmt.Errorf("duplicate schedule name %q", s.Name))
+			continue
+		}
+		set.list = append(set.list, s)
+		set.byName[s.Name] = s
+	}
+	return set, errors.Join(errs...)
+}
+
+// scheduleFromConfig converts a schedule from the configuration
+func scheduleFromConfig(sc config.ScheduleConfig) (*schedule.Schedule, error) {
+	windows := make([]schedule.Window, 0, len(sc.Windows))
+	for i, wc := range sc.Windows {
+		w, err := schedule.ParseWindow(wc.Days, wc.Start, wc.End)
+		if err != nil {
+			return nil, fmt.Errorf("window %d: %w", i+1, err)
+		}
+		windows = append(windows, w)
+	}
+	return schedule.New(sc.Name, sc.Timezone, windows)
+}
+
+// active reports whether the named schedule is on at now. Unknown
+// schedules, which the config check reports, are always on so their rules
+// keep blocking.
+func (set *scheduleSet) active(name string, now time.Time) bool {
+	s, ok := set.byName[name]
+	return !ok || s.Active(now)
+}
+
+// scheduleStatus returns whether each schedule is on and when it next changes
+func scheduleStatus() []schedule.Status {
+	now := clock()
+	set := current().schedules
+	statuses := make([]schedule.Status, 0, len(set.list))
+	for _, s := range set.list {
+		statuses = append(statuses, s.StatusAt(now))
+	}
+	return statuses
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const scheduledConfig = `{
+	"version": 1,
+	"schedules": [
+		{"name": "work", "timezone": "UTC", "windows": [{"days": ["weekdays"], "start": "09:00", "end": "17:00"}]},
+		{"name": "nights", "timezone": "UTC", "windows": [{"start": "22:00", "end": "06:00"}]}
+	],
+	"blocked_sites": [
+		"always.com",
+		{"rule": "news.com", "schedule": "work"}
+	],
+	"groups": [
+		{"name": "games", "schedule": "nights", "domains": ["games.com"]}
+	]
+}`
+
+func TestScheduledBlocking(t *testing.T) {
+	useConfig(t, scheduledConfig)
+
+	// 2024-01-01 is a Monday
+	tests := []struct {
+		name    string
+		domain  string
+		at      time.Time
+		blocked bool
+	}{
+		{"unscheduled rule", "always.com", time.Date(2024, time.January, 6, 12, 0, 0, 0, time.UTC), true},
+		{"inside the window", "news.com", time.Date(2024, time.January, 1, 10, 0, 0, 0, time.UTC), true},
+		{"subdomain inside the window", "www.news.com", time.Date(2024, time.January, 1, 16, 59, 0, 0, time.UTC), true},
+		{"after the window", "news.com", time.Date(2024, time.January, 1, 17, 0, 0, 0, time.UTC), false},
+		{"weekend", "news.com", time.Date(2024, time.January, 6, 10, 0, 0, 0, time.UTC), false},
+		{"scheduled group at night", "games.com", time.Date(2024, time.January, 2, 2, 0, 0, 0, time.UTC), true},
+		{"scheduled group by day", "games.com", time.Date(2024, time.January, 2, 12, 0, 0, 0, time.UTC), false},
+		{"no rule", "example.com", time.Date(2024, time.January, 1, 10, 0, 0, 0, time.UTC), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock = func() time.Time { return tt.at }
+
+			resp := query(t, tt.domain)
+			if tt.blocked {
+				if resp.Rcode != dns.RcodeRefused {
+					t.Errorf("%s at %s answered with %s, want it blocked", tt.domain, tt.at.Format("Mon 15:04"), dns.RcodeToString[resp.Rcode])
+				}
+			} else if !forwarded(resp) {
+				t.Errorf("%s at %s wasn't forwarded: %v", tt.domain, tt.at.Format("Mon 15:04"), resp)
+			}
+
+			if _, _, blocked := lookupBlock(tt.domain); blocked != tt.blocked {
+				t.Errorf("lookupBlock(%s) at %s = %v, want %v", tt.domain, tt.at.Format("Mon 15:04"), blocked, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestScheduleStatus(t *testing.T) {
+	useConfig(t, scheduledConfig)
+	clock = func() time.Time { return time.Date(2024, time.January, 1, 23, 0, 0, 0, time.UTC) }
+
+	statuses := scheduleStatus()
+	if len(statuses) != 2 {
+		t.Fatalf("got %d schedules, want 2", len(statuses))
+	}
+	if s := statuses[0]; s.Name != "work" || s.Active || s.NextChange != "2024-01-02T09:00:00Z" {
+		t.Errorf("work = %+v", s)
+	}
+	if s := statuses[1]; s.Name != "nights" || !s.Active || s.NextChange != "2024-01-02T06:00:00Z" {
+		t.Errorf("nights = %+v", s)
+	}
+}
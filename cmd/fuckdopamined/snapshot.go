@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/lucastomic/fuckdopamine/pkg/blocklist"
+	"github.com/lucastomic/fuckdopamine/pkg/blockresponse"
+	"github.com/lucastomic/fuckdopamine/pkg/matcher"
+)
+
+// snapshot is everything queries are checked against. It isn't modified
+// once published, changes build a new snapshot and swap it in with a single
+// store, so a query sees either all of a reload or none of it.
+type snapshot struct {
+	rules          *matcher.Ruleset      // Block rules and allowlist exceptions
+	groups         *groupSet             // Enabled flag and schedule of every group
+	schedules      *scheduleSet          // Configured schedules
+	pause          *pauseLimits          // How long and how often blocking can be paused
+	blockResponse  *blockresponse.Policy // Global block response
+	quotaResetHour int                   // Local hour daily quotas and pause limits start over
+	blocklists     *blocklist.Manager    // Keeps the external blocklists up to date
+}
+
+// state is the active snapshot, changes are serialized by rulesMutex
+var state atomic.Pointer[snapshot]
+
+// current returns the active snapshot
+func current() *snapshot {
+	return state.Load()
+}
+
+// update swaps in a copy of the active snapshot changed by fn, the caller
+// must hold rulesMutex
+func update(fn func(s *snapshot)) {
+	next := *state.Load()
+	fn(&next)
+	state.Store(&next)
+}
+
+// activeAt returns the predicate for the rules in effect at now: rules of
+// disabled groups and rules outside their schedule's windows are skipped
+func (s *snapshot) activeAt(now time.Time) func(*matcher.Rule) bool {
+	gs, ss := s.groups, s.schedules
+	return func(rule *matcher.Rule) bool {
+		if rule.Schedule != "" && !ss.active(rule.Schedule, now) {
+			return false
+		}
+		if rule.Group == "" {
+			return true
+		}
+		if !gs.enabled[rule.Group] {
+			return false
+		}
+		if name := gs.schedules[rule.Group]; name != "" && !ss.active(name, now) {
+			return false
+		}
+		return true
+	}
+}
+
+// match returns the most specific rule in effect at now covering domain
+func (s *snapshot) match(domain string, now time.Time) *matcher.Rule {
+	return s.rules.Match(domain, s.activeAt(now))
+}
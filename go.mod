@@ -2,15 +2,20 @@ module github.com/lucastomic/fuckdopamine
 
 go 1.22.2
 
+require (
+	github.com/miekg/dns v1.1.63
+	golang.org/x/net v0.31.0
+)
+
 require (
 	github.com/gizak/termui/v3 v3.1.0 // indirect
 	github.com/mattn/go-runewidth v0.0.2 // indirect
-	github.com/miekg/dns v1.1.63 // indirect
 	github.com/mitchellh/go-wordwrap v0.0.0-20150314170334-ad45545899c7 // indirect
 	github.com/nsf/termbox-go v0.0.0-20190121233118-02980233997d // indirect
 	golang.org/x/mod v0.18.0 // indirect
-	golang.org/x/net v0.31.0 // indirect
-	golang.org/x/sync v0.7.0 // indirect
+	golang.org/x/sync v0.9.0 // indirect
 	golang.org/x/sys v0.27.0 // indirect
+	golang.org/x/text v0.20.0 // indirect
+	golang.org/x/text v0.20.0 // indirect
 	golang.org/x/tools v0.22.0 // indirect
 )
@@ -0,0 +1,87 @@
+package atomicfile
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// BackupSuffix is appended to a file name to get its backup, e.g. "config.json.bak"
+const BackupSuffix = ".bak"
+
+// WriteFile atomically replaces path with data: the data is written to a
+// temporary file in the same directory, synced to disk and renamed over
+// path, so readers see either the old or the new contents even after a
+// crash or power loss. If path is a symlink, the link itself is replaced.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// WriteWithBackup is WriteFile, but first keeps the current contents of
+// path in path.bak. Current contents that valid rejects aren't kept, so a
+// corrupt file never replaces a good backup.
+func WriteWithBackup(path string, data []byte, perm os.FileMode, valid func([]byte) error) error {
+	current, err := os.ReadFile(path)
+	switch {
+	case err == nil && valid(current) == nil:
+		if err := WriteFile(path+BackupSuffix, current, perm); err != nil {
+			return fmt.Errorf("failed to write backup: %w", err)
+		}
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+
+	return WriteFile(path, data, perm)
+}
+
+// ReadWithBackup reads path, falling back to path.bak when path is missing
+// or valid rejects it. It returns the path that was read. The error is
+// about path when neither file could be used.
+func ReadWithBackup(path string, valid func([]byte) error) ([]byte, string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err = valid(data); err == nil {
+			return data, path, nil
+		}
+		err = fmt.Errorf("%s: %w", path, err)
+	}
+
+	backup := path + BackupSuffix
+	if bakData, bakErr := os.ReadFile(backup); bakErr == nil && valid(bakData) == nil {
+		return bakData, backup, nil
+	}
+	return nil, "", err
+}
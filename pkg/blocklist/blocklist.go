@@ -0,0 +1,234 @@
+package blocklist
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/lucastomic/fuckdopamine/pkg/matcher"
+)
+
+// Format is the syntax of a blocklist
+type Format string
+
+const (
+	// FormatAuto detects the format from the first rule in the list
+	FormatAuto Format = "auto"
+	// FormatHosts is a hosts file, "0.0.0.0 reddit.com"
+	FormatHosts Format = "hosts"
+	// FormatDomains is one domain per line, "reddit.com"
+	FormatDomains Format = "domains"
+	// FormatAdblock is Adblock Plus syntax, of which only "||reddit.com^" rules apply to DNS
+	FormatAdblock Format = "adblock"
+)
+
+// ParseFormat validates a format from the config, empty means FormatAuto
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(strings.TrimSpace(s))); f {
+	case "":
+		return FormatAuto, nil
+	case FormatAuto, FormatHosts, FormatDomains, FormatAdblock:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown blocklist format %q (expected auto, hosts, domains or adblock)", s)
+}
+
+// maxLineErrors is how many line errors a parse result keeps, the rest are only counted
+const maxLineErrors = 10
+
+// LineError is a line of a list that couldn't be parsed
+type LineError struct {
+	Line    int    `json:"line"`
+	Text    string `json:"text"`
+	Message string `json:"message"`
+}
+
+func (e LineError) String() string {
+	return fmt.Sprintf("line %d: %s: %q", e.Line, e.Message, e.Text)
+}
+
+// Result is a parsed list
+type Result struct {
+	Format     Format      // Format the list was parsed as
+	Domains    []string    // Normalized domains in list order, without duplicates
+	Errors     []LineError // The first lines that couldn't be parsed
+	ErrorCount int         // Number of lines that couldn't be parsed
+}
+
+func (r *Result) addError(line int, text, format string, args ...any) {
+	r.ErrorCount++
+	if len(r.Errors) < maxLineErrors {
+		r.Errors = append(r.Errors, LineError{Line: line, Text: text, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// hostsLocalNames are entries every hosts file has that must not be blocked
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// Parse reads a list in the given format. Lines that can't be parsed are
+// reported in the result and skipped; the error is only set when r fails.
+func Parse(r io.Reader, format Format) (*Result, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if format == FormatAuto || format == "" {
+		format = detect(string(data))
+	}
+
+	result := &Result{Format: format}
+	seen := make(map[string]bool)
+	add := func(lineNo int, line, domain string) {
+		rule, err := matcher.NewRule(matcher.KindSubtree, domain)
+		if err != nil {
+			result.addError(lineNo, line, "%v", err)
+			return
+		}
+		if !seen[rule.Pattern] {
+			seen[rule.Pattern] = true
+			result.Domains = append(result.Domains, rule.Pattern)
+		}
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch format {
+		case FormatHosts:
+			parseHostsLine(result, lineNo, line, add)
+		case FormatDomains:
+			parseDomainsLine(result, lineNo, line, add)
+		case FormatAdblock:
+			parseAdblockLine(result, lineNo, line, add)
+		default:
+			return nil, fmt.Errorf("unknown blocklist format %q", format)
+		}
+	}
+	return result, scanner.Err()
+}
+
+// detect guesses the format of a list from its first rule
+func detect(data string) Format {
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[Adblock") || strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@"):
+			return FormatAdblock
+		}
+		if fields := strings.Fields(line); len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			return FormatHosts
+		}
+		return FormatDomains
+	}
+	return FormatDomains
+}
+
+// stripComment removes a "#" comment and surrounding whitespace from a line
+func stripComment(line string) string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+// parseHostsLine parses "0.0.0.0 reddit.com www.reddit.com # comment"
+func parseHostsLine(result *Result, lineNo int, line string, add func(int, string, string)) {
+	fields := strings.Fields(stripComment(line))
+	if len(fields) == 0 {
+		return
+	}
+	if net.ParseIP(fields[0]) == nil || len(fields) < 2 {
+		result.addError(lineNo, line, "expected an IP address followed by host names")
+		return
+	}
+	for _, host := range fields[1:] {
+		if !hostsLocalNames[strings.ToLower(host)] {
+			add(lineNo, line, host)
+		}
+	}
+}
+
+// parseDomainsLine parses "reddit.com # comment", a leading "*." is accepted
+// since every domain also blocks its subdomains
+func parseDomainsLine(result *Result, lineNo int, line string, add func(int, string, string)) {
+	fields := strings.Fields(stripComment(line))
+	switch len(fields) {
+	case 0:
+		return
+	case 1:
+		add(lineNo, line, strings.TrimPrefix(fields[0], "*."))
+	default:
+		result.addError(lineNo, line, "expected a single domain")
+	}
+}
+
+// parseAdblockLine parses "||reddit.com^", optionally followed by the
+// $important modifier. Other Adblock rules don't apply to DNS and are
+// reported, except comments and cosmetic filters which are common in
+// browser lists and skipped silently.
+func parseAdblockLine(result *Result, lineNo int, line string, add func(int, string, string)) {
+	switch {
+	case line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "["):
+		return
+	case strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#?#"):
+		return
+	case strings.HasPrefix(line, "@@"):
+		result.addError(lineNo, line, "exception rules aren't supported, use allowed_sites")
+		return
+	case !strings.HasPrefix(line, "||"):
+		result.addError(lineNo, line, "only ||domain^ rules are supported")
+		return
+	}
+
+	domain, rest, found := strings.Cut(line[2:], "^")
+	if !found {
+		result.addError(lineNo, line, "only ||domain^ rules are supported")
+		return
+	}
+	if err := checkModifiers(strings.TrimPrefix(rest, "|")); err != nil {
+		result.addError(lineNo, line, "%v", err)
+		return
+	}
+	if strings.ContainsAny(domain, "*/") {
+		result.addError(lineNo, line, "wildcards and paths aren't supported")
+		return
+	}
+	add(lineNo, line, domain)
+}
+
+// checkModifiers accepts the modifiers that don't change what a DNS block means
+func checkModifiers(rest string) error {
+	if rest == "" {
+		return nil
+	}
+	if !strings.HasPrefix(rest, "$") {
+		return errors.New("only ||domain^ rules are supported")
+	}
+	for _, mod := range strings.Split(rest[1:], ",") {
+		switch strings.TrimSpace(mod) {
+		case "important", "all", "document", "doc":
+		default:
+			return fmt.Errorf("modifier $%s isn't supported", mod)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package blocklist
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  Format
+		list    string
+		want    Format
+		domains []string
+	}{
+		{
+			name:   "hosts",
+			format: FormatHosts,
+			list: `# Social media
+127.0.0.1 localhost
+::1 localhost ip6-localhost
+0.0.0.0 0.0.0.0
+0.0.0.0 reddit.com www.reddit.com # inline comment
+0.0.0.0	Facebook.com.
+`,
+			want:    FormatHosts,
+			domains: []string{"reddit.com", "www.reddit.com", "facebook.com"},
+		},
+		{
+			name:   "domains",
+			format: FormatDomains,
+			list: `# Gambling
+bet365.com
+*.pokerstars.com  # leading wildcard is accepted
+
+ Casino.example.
+`,
+			want:    FormatDomains,
+			domains: []string{"bet365.com", "pokerstars.com", "casino.example"},
+		},
+		{
+			name:   "adblock",
+			format: FormatAdblock,
+			list: `[Adblock Plus 2.0]
+! Title: News
+||cnn.com^
+||foxnews.com^$important
+||bbc.co.uk^|
+example.org##.banner
+example.org#@#.banner
+`,
+			want:    FormatAdblock,
+			domains: []string{"cnn.com", "foxnews.com", "bbc.co.uk"},
+		},
+		{
+			name:    "detect hosts",
+			list:    "# comment\n\n0.0.0.0 reddit.com\n",
+			want:    FormatHosts,
+			domains: []string{"reddit.com"},
+		},
+		{
+			name:    "detect domains",
+			list:    "reddit.com\n",
+			want:    FormatDomains,
+			domains: []string{"reddit.com"},
+		},
+		{
+			name:    "detect adblock",
+			list:    "! comment\n||reddit.com^\n",
+			want:    FormatAdblock,
+			domains: []string{"reddit.com"},
+		},
+		{
+			name:    "unicode domains",
+			format:  FormatDomains,
+			list:    "bücher.de\n",
+			want:    FormatDomains,
+			domains: []string{"xn--bcher-kva.de"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format := tt.format
+			if format == "" {
+				format = FormatAuto
+			}
+			result, err := Parse(strings.NewReader(tt.list), format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Format != tt.want {
+				t.Errorf("format = %q, want %q", result.Format, tt.want)
+			}
+			if !reflect.DeepEqual(result.Domains, tt.domains) {
+				t.Errorf("domains = %q, want %q", result.Domains, tt.domains)
+			}
+			if result.ErrorCount != 0 {
+				t.Errorf("unexpected line errors: %v", result.Errors)
+			}
+		})
+	}
+}
+
+func TestParseLineErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		list   string
+		lines  []int
+		errors []string
+	}{
+		{
+			name:   "hosts",
+			format: FormatHosts,
+			list:   "0.0.0.0 reddit.com\nreddit.com\n0.0.0.0\n0.0.0.0 https://reddit.com/r/all\n",
+			lines:  []int{2, 3, 4},
+			errors: []string{"expected an IP address", "expected an IP address", "is a URL"},
+		},
+		{
+			name:   "domains",
+			format: FormatDomains,
+			list:   "reddit.com\nreddit.com facebook.com\nbad..domain\n",
+			lines:  []int{2, 3},
+			errors: []string{"expected a single domain", "empty label"},
+		},
+		{
+			name:   "adblock",
+			format: FormatAdblock,
+			list:   "||reddit.com^\n@@||reddit.com^\n/ads/\n||*.reddit.com^\n||reddit.com^$third-party\n||reddit.com\n",
+			lines:  []int{2, 3, 4, 5, 6},
+			errors: []string{"exception rules", "only ||domain^", "wildcards", "$third-party", "only ||domain^"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Parse(strings.NewReader(tt.list), tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Domains) != 1 || result.Domains[0] != "reddit.com" {
+				t.Errorf("domains = %q, want only reddit.com", result.Domains)
+			}
+			if result.ErrorCount != len(tt.lines) {
+				t.Fatalf("error count = %d, want %d: %v", result.ErrorCount, len(tt.lines), result.Errors)
+			}
+			for i, e := range result.Errors {
+				if e.Line != tt.lines[i] {
+					t.Errorf("error %d on line %d, want line %d", i, e.Line, tt.lines[i])
+				}
+				if !strings.Contains(e.Message, tt.errors[i]) {
+					t.Errorf("error %d = %q, want one containing %q", i, e.Message, tt.errors[i])
+				}
+				if e.Text == "" {
+					t.Errorf("error %d doesn't keep the line text", i)
+				}
+			}
+		})
+	}
+}
+
+func TestParseKeepsFirstLineErrors(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("reddit.com\n")
+	for i := 0; i < 3*maxLineErrors; i++ {
+		fmt.Fprintf(&b, "bad domain %d\n", i)
+	}
+
+	result, err := Parse(strings.NewReader(b.String()), FormatDomains)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ErrorCount != 3*maxLineErrors {
+		t.Errorf("error count = %d, want %d", result.ErrorCount, 3*maxLineErrors)
+	}
+	if len(result.Errors) != maxLineErrors {
+		t.Errorf("kept %d errors, want %d", len(result.Errors), maxLineErrors)
+	}
+	if result.Errors[0].Line != 2 {
+		t.Errorf("first error on line %d, want 2", result.Errors[0].Line)
+	}
+}
+
+func TestParseDedup(t *testing.T) {
+	list := `0.0.0.0 reddit.com www.reddit.com
+0.0.0.0 REDDIT.com
+127.0.0.1 reddit.com.
+0.0.0.0 facebook.com www.reddit.com
+`
+	result, err := Parse(strings.NewReader(list), FormatHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"reddit.com", "www.reddit.com", "facebook.com"}
+	if !reflect.DeepEqual(result.Domains, want) {
+		t.Errorf("domains = %q, want %q", result.Domains, want)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for in, want := range map[string]Format{"": FormatAuto, "auto": FormatAuto, " Hosts ": FormatHosts, "domains": FormatDomains, "ADBLOCK": FormatAdblock} {
+		got, err := ParseFormat(in)
+		if err != nil || got != want {
+			t.Errorf("ParseFormat(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseFormat("ublock"); err == nil {
+		t.Error("ParseFormat accepted an unknown format")
+	}
+}
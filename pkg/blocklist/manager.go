@@ -0,0 +1,433 @@
+package blocklist
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/lucastomic/fuckdopamine/pkg/atomicfile"
+	"github.com/lucastomic/fuckdopamine/pkg/matcher"
+)
+
+const (
+	// maxListSize caps how much of a downloaded list is read
+	maxListSize = 64 << 20
+	// retryInterval is how soon a failed download is retried, at most the refresh interval
+	retryInterval = 5 * time.Minute
+	// checkInterval is how often local files are checked for changes and downloads for being due
+	checkInterval = time.Minute
+)
+
+// Options describes a single blocklist
+type Options struct {
+	Name   string // Shown in list_blocked and stored in Rule.Source, defaults to Source
+	Source string // Local file path or http(s) URL
+	Format Format
+}
+
+// IsURL reports whether a blocklist source is downloaded rather than read from disk
+func IsURL(source string) bool {
+	u, err := url.Parse(source)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Status is the state of a blocklist
+type Status struct {
+	Name       string      `json:"name"`
+	Source     string      `json:"source"`
+	Format     string      `json:"format"`
+	Domains    int         `json:"domains"`    // Domains in the list
+	Duplicates int         `json:"duplicates"` // Domains already blocked by the config or an earlier list
+	Errors     int         `json:"errors"`     // Lines that couldn't be parsed
+	LineErrors []LineError `json:"line_errors,omitempty"`
+	UpdatedAt  string      `json:"updated_at,omitempty"` // When the list was last read or downloaded
+	LastError  string      `json:"last_error,omitempty"` // Why the last refresh failed, the previous contents are still used
+}
+
+type list struct {
+	opts       Options
+	domains    []string
+	result     *Result
+	duplicates int
+	updatedAt  time.Time
+	lastError  string
+	lastTry    time.Time
+	fileStamp  string     // Modification time and size of a local file when it was read
+	validators validators // Of the download the contents came from
+}
+
+// validators identify the version of a download, so a refresh only
+// downloads the list again when it changed
+type validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// errNotModified is returned by download when the list didn't change
+var errNotModified = errors.New("not modified")
+
+// Manager keeps a set of blocklists up to date. Local files are re-read when
+// they change, downloads are refreshed once per interval and cached on disk
+// so the lists are available before the network is.
+type Manager struct {
+	lists    []*list
+	cacheDir string
+	client   *http.Client
+	onUpdate func()
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewManager creates a manager for lists, onUpdate is called from the
+// refresh goroutine whenever the contents of a list change
+func NewManager(lists []Options, cacheDir string, onUpdate func()) (*Manager, error) {
+	m := &Manager{
+		cacheDir: cacheDir,
+		client:   &http.Client{Timeout: time.Minute},
+		onUpdate: onUpdate,
+	}
+
+	names := make(map[string]bool)
+	for _, o := range lists {
+		if o.Source == "" {
+			return nil, errors.New("blocklist source cannot be empty")
+		}
+		if o.Name == "" {
+			o.Name = o.Source
+		}
+		if names[o.Name] {
+			return nil, fmt.Errorf("duplicate blocklist name %q", o.Name)
+		}
+		names[o.Name] = true
+		if o.Format == "" {
+			o.Format = FormatAuto
+		}
+		m.lists = append(m.lists, &list{opts: o})
+	}
+	return m, nil
+}
+
+// Load reads every local list and the cached copy of every downloaded one,
+// without touching the network
+func (m *Manager) Load() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, l := range m.lists {
+		if !IsURL(l.opts.Source) {
+			m.readFile(l)
+			continue
+		}
+		path := m.cachePath(l)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue // Downloaded on the first refresh
+		}
+		if err := m.update(l, data); err != nil {
+			log.Printf("[BLOCKLIST] Ignoring cached copy of %s: %v", l.opts.Name, err)
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			l.updatedAt = info.ModTime()
+		}
+		if data, err := os.ReadFile(m.validatorsPath(l)); err == nil {
+			json.Unmarshal(data, &l.validators)
+		}
+	}
+}
+
+// Start refreshes the lists that are due now and then in the background,
+// downloading each one once per interval
+func (m *Manager) Start(interval time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stop != nil || len(m.lists) == 0 {
+		return
+	}
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(min(interval, checkInterval))
+		defer ticker.Stop()
+		for {
+			if m.refreshDue(interval) && m.onUpdate != nil {
+				m.onUpdate()
+			}
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops refreshing
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	stop, done := m.stop, m.done
+	m.stop = nil
+	m.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// refreshDue refreshes the lists that are due, reporting whether any changed
+func (m *Manager) refreshDue(interval time.Duration) bool {
+	m.mu.Lock()
+	lists := append([]*list(nil), m.lists...)
+	m.mu.Unlock()
+
+	changed := false
+	for _, l := range lists {
+		if !IsURL(l.opts.Source) {
+			m.mu.Lock()
+			if m.fileStamp(l) != l.fileStamp {
+				changed = m.readFile(l) || changed
+			}
+			m.mu.Unlock()
+			continue
+		}
+
+		m.mu.Lock()
+		wait := interval
+		if l.lastError != "" {
+			wait = min(interval, retryInterval)
+		}
+		due := time.Since(l.updatedAt) >= interval && time.Since(l.lastTry) >= wait
+		var cond validators
+		if l.result != nil {
+			cond = l.validators // Only revalidate contents we have
+		}
+		m.mu.Unlock()
+		if !due {
+			continue
+		}
+
+		// Downloads happen without the lock so Status stays responsive
+		data, v, err := m.download(l.opts.Source, cond)
+
+		m.mu.Lock()
+		l.lastTry = time.Now()
+		switch {
+		case errors.Is(err, errNotModified):
+			l.updatedAt = l.lastTry
+			l.lastError = ""
+			// Keeps the cached copy from looking stale after a restart
+			if err := os.Chtimes(m.cachePath(l), l.updatedAt, l.updatedAt); err != nil {
+				log.Printf("[BLOCKLIST] Failed to touch the cached copy of %s: %v", l.opts.Name, err)
+			}
+		case err == nil:
+			err = m.update(l, data)
+			if err != nil {
+				break
+			}
+			l.updatedAt = l.lastTry
+			l.validators = v
+			changed = true
+			if err := m.writeCache(l, data); err != nil {
+				log.Printf("[BLOCKLIST] Failed to cache %s: %v", l.opts.Name, err)
+			}
+		}
+		if err != nil && !errors.Is(err, errNotModified) {
+			l.lastError = err.Error()
+			log.Printf("[BLOCKLIST] Failed to refresh %s, keeping the previous contents: %v", l.opts.Name, err)
+		}
+		m.mu.Unlock()
+	}
+	return changed
+}
+
+// readFile reads a local list, reporting whether it was updated
+func (m *Manager) readFile(l *list) bool {
+	l.fileStamp = m.fileStamp(l)
+	data, err := os.ReadFile(l.opts.Source)
+	if err == nil {
+		err = m.update(l, data)
+	}
+	if err != nil {
+		l.lastError = err.Error()
+		log.Printf("[BLOCKLIST] Failed to read %s, keeping the previous contents: %v", l.opts.Name, err)
+		return false
+	}
+	l.updatedAt = time.Now()
+	return true
+}
+
+func (m *Manager) fileStamp(l *list) string {
+	info, err := os.Stat(l.opts.Source)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d %d", info.ModTime().UnixNano(), info.Size())
+}
+
+// update parses data as the new contents of l. A list without a single
+// domain is rejected, it is most likely an error page.
+func (m *Manager) update(l *list, data []byte) error {
+	result, err := Parse(bytes.NewReader(data), l.opts.Format)
+	if err != nil {
+		return err
+	}
+	if len(result.Domains) == 0 {
+		if len(result.Errors) > 0 {
+			return fmt.Errorf("no domains found, %s", result.Errors[0])
+		}
+		return errors.New("no domains found")
+	}
+
+	l.domains = result.Domains
+	l.result = result
+	l.lastError = ""
+	if result.ErrorCount > 0 {
+		log.Printf("[BLOCKLIST] %s: skipped %d lines that couldn't be parsed, first %s",
+			l.opts.Name, result.ErrorCount, result.Errors[0])
+	}
+	log.Printf("[BLOCKLIST] Loaded %d domains from %s (%s format)", len(result.Domains), l.opts.Name, result.Format)
+	return nil
+}
+
+// download fetches source, returning errNotModified when it still matches cond
+func (m *Manager) download(source string, cond validators) ([]byte, validators, error) {
+	req, err := http.NewRequest(http.MethodGet, source, nil)
+	if err != nil {
+		return nil, validators{}, err
+	}
+	req.Header.Set("User-Agent", "fuckdopamine")
+	if cond.ETag != "" {
+		req.Header.Set("If-None-Match", cond.ETag)
+	}
+	if cond.LastModified != "" {
+		req.Header.Set("If-Modified-Since", cond.LastModified)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, validators{}, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cond != validators{}:
+		return nil, cond, errNotModified
+	case resp.StatusCode != http.StatusOK:
+		return nil, validators{}, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxListSize+1))
+	if err != nil {
+		return nil, validators{}, err
+	}
+	if len(data) > maxListSize {
+		return nil, validators{}, fmt.Errorf("list is larger than %d MB", maxListSize>>20)
+	}
+	v := validators{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	return data, v, nil
+}
+
+// writeCache keeps the download of l together with its validators
+func (m *Manager) writeCache(l *list, data []byte) error {
+	if err := os.MkdirAll(m.cacheDir, 0755); err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(m.cachePath(l), data, 0644); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(l.validators)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(m.validatorsPath(l), meta, 0644)
+}
+
+// cachePath is where the last download of l is kept
+func (m *Manager) cachePath(l *list) string {
+	sum := sha256.Sum256([]byte(l.opts.Source))
+	return filepath.Join(m.cacheDir, hex.EncodeToString(sum[:8])+".txt")
+}
+
+// validatorsPath is where the validators of the cached download of l are kept
+func (m *Manager) validatorsPath(l *list) string {
+	sum := sha256.Sum256([]byte(l.opts.Source))
+	return filepath.Join(m.cacheDir, hex.EncodeToString(sum[:8])+".json")
+}
+
+// Rules returns a subtree block rule for every listed domain, skipping the
+// ones existing already has and the ones an earlier list has. The number
+// skipped is reported per list in Status.
+func (m *Manager) Rules(existing []matcher.Rule) []matcher.Rule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seen := make(map[string]bool, len(existing))
+	for _, r := range existing {
+		if r.Action == matcher.ActionBlock && r.Kind == matcher.KindSubtree {
+			seen[r.Pattern] = true
+		}
+	}
+
+	var rules []matcher.Rule
+	for _, l := range m.lists {
+		l.duplicates = 0
+		for _, domain := range l.domains {
+			if seen[domain] {
+				l.duplicates++
+				continue
+			}
+			seen[domain] = true
+			rule, err := matcher.NewRule(matcher.KindSubtree, domain)
+			if err != nil {
+				continue // Already validated by Parse
+			}
+			rule.Action = matcher.ActionBlock
+			rule.Source = l.opts.Name
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// Status returns the state of every list in configuration order
+func (m *Manager) Status() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := make([]Status, 0, len(m.lists))
+	for _, l := range m.lists {
+		st := Status{
+			Name:       l.opts.Name,
+			Source:     l.opts.Source,
+			Format:     string(l.opts.Format),
+			Domains:    len(l.domains),
+			Duplicates: l.duplicates,
+			LastError:  l.lastError,
+		}
+		if l.result != nil {
+			st.Format = string(l.result.Format)
+			st.Errors = l.result.ErrorCount
+			st.LineErrors = l.result.Errors
+		}
+		if !l.updatedAt.IsZero() {
+			st.UpdatedAt = l.updatedAt.Format(time.RFC3339)
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
@@ -0,0 +1,236 @@
+package blocklist
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/lucastomic/fuckdopamine/pkg/matcher"
+)
+
+// listServer serves a single list with an ETag, answering conditional
+// requests for the current version with 304 Not Modified
+type listServer struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	body        string
+	etag        string
+	downloads   int // Requests answered with the list
+	notModified int // Requests answered with 304
+}
+
+func newListServer(t *testing.T, body, etag string) *listServer {
+	t.Helper()
+	s := &listServer{body: body, etag: etag}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r.Header.Get("If-None-Match") == s.etag {
+			s.notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		s.downloads++
+		w.Header().Set("ETag", s.etag)
+		w.Write([]byte(s.body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *listServer) set(body, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.body, s.etag = body, etag
+}
+
+func (s *listServer) counts() (downloads, notModified int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downloads, s.notModified
+}
+
+func newTestManager(t *testing.T, lists []Options, cacheDir string) *Manager {
+	t.Helper()
+	m, err := NewManager(lists, cacheDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestRefreshNotModified(t *testing.T) {
+	srv := newListServer(t, "0.0.0.0 reddit.com\n0.0.0.0 facebook.com\n", `"v1"`)
+	cacheDir := t.TempDir()
+	lists := []Options{{Name: "social", Source: srv.URL + "/hosts"}}
+
+	m := newTestManager(t, lists, cacheDir)
+	if !m.refreshDue(0) {
+		t.Fatal("first refresh reported no change")
+	}
+	if st := m.Status()[0]; st.Domains != 2 || st.Format != string(FormatHosts) || st.UpdatedAt == "" {
+		t.Errorf("after the first refresh status = %+v", st)
+	}
+
+	if m.refreshDue(0) {
+		t.Error("refresh of an unchanged list reported a change")
+	}
+	if downloads, notModified := srv.counts(); downloads != 1 || notModified != 1 {
+		t.Errorf("server sent the list %d times and 304 %d times, want once each", downloads, notModified)
+	}
+	if st := m.Status()[0]; st.Domains != 2 || st.LastError != "" {
+		t.Errorf("after a 304 status = %+v", st)
+	}
+
+	// The validators are cached with the list, a restart revalidates too
+	restarted := newTestManager(t, lists, cacheDir)
+	restarted.Load()
+	if restarted.refreshDue(0) {
+		t.Error("refresh after a restart reported a change")
+	}
+	if downloads, notModified := srv.counts(); downloads != 1 || notModified != 2 {
+		t.Errorf("server sent the list %d times and 304 %d times, want once and twice", downloads, notModified)
+	}
+
+	srv.set("0.0.0.0 reddit.com\n0.0.0.0 facebook.com\n0.0.0.0 tiktok.com\n", `"v2"`)
+	if !restarted.refreshDue(0) {
+		t.Error("refresh of a changed list reported no change")
+	}
+	if st := restarted.Status()[0]; st.Domains != 3 {
+		t.Errorf("after the list changed it has %d domains, want 3", st.Domains)
+	}
+}
+
+func TestRefreshFallsBackToCache(t *testing.T) {
+	srv := newListServer(t, "||reddit.com^\n||facebook.com^\n", `"v1"`)
+	cacheDir := t.TempDir()
+	lists := []Options{{Name: "social", Source: srv.URL + "/list.txt"}}
+
+	m := newTestManager(t, lists, cacheDir)
+	if !m.refreshDue(0) {
+		t.Fatal("first refresh reported no change")
+	}
+	srv.Close()
+
+	// A restart while the source is unreachable uses the cached copy
+	restarted := newTestManager(t, lists, cacheDir)
+	restarted.Load()
+	st := restarted.Status()[0]
+	if st.Domains != 2 || st.UpdatedAt == "" {
+		t.Fatalf("cached copy not loaded, status = %+v", st)
+	}
+
+	if restarted.refreshDue(0) {
+		t.Error("failed refresh reported a change")
+	}
+	st = restarted.Status()[0]
+	if st.Domains != 2 {
+		t.Errorf("failed refresh left %d domains, want the cached 2", st.Domains)
+	}
+	if st.LastError == "" {
+		t.Error("failed refresh didn't record an error")
+	}
+	if rules := restarted.Rules(nil); len(rules) != 2 || rules[0].Source != "social" {
+		t.Errorf("rules from the cached copy = %v", rules)
+	}
+}
+
+func TestRefreshKeepsContentsOnErrorPage(t *testing.T) {
+	srv := newListServer(t, "reddit.com\n", `"v1"`)
+	m := newTestManager(t, []Options{{Source: srv.URL, Format: FormatDomains}}, t.TempDir())
+	m.refreshDue(0)
+
+	srv.set("<html>\n<body>Service unavailable</body>\n</html>\n", `"error"`)
+	if m.refreshDue(0) {
+		t.Error("refresh with an error page reported a change")
+	}
+	st := m.Status()[0]
+	if st.Domains != 1 || st.LastError == "" {
+		t.Errorf("after an error page status = %+v, want the previous domain and an error", st)
+	}
+	if st.Name != srv.URL {
+		t.Errorf("name = %q, want the source", st.Name)
+	}
+}
+
+func TestRules(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.txt")
+	second := filepath.Join(dir, "second.txt")
+	if err := os.WriteFile(first, []byte("reddit.com\nfacebook.com\ntiktok.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(second, []byte("0.0.0.0 tiktok.com\n0.0.0.0 youtube.com\nbad line\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newTestManager(t, []Options{{Name: "first", Source: first}, {Name: "second", Source: second}}, t.TempDir())
+	m.Load()
+
+	existing, err := matcher.ParseRules([]string{"reddit.com", "exact:facebook.com"}, matcher.ActionBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := make(map[string]string)
+	for _, r := range m.Rules(existing) {
+		if r.Action != matcher.ActionBlock || r.Kind != matcher.KindSubtree {
+			t.Errorf("rule %v isn't a subtree block rule", r)
+		}
+		sources[r.Pattern] = r.Source
+	}
+
+	// reddit.com is in the config, exact:facebook.com doesn't cover
+	// subdomains so the list still adds it, tiktok.com is only taken once
+	want := map[string]string{"facebook.com": "first", "tiktok.com": "first", "youtube.com": "second"}
+	if len(sources) != len(want) {
+		t.Errorf("rules = %v, want %v", sources, want)
+	}
+	for pattern, source := range want {
+		if sources[pattern] != source {
+			t.Errorf("%s from %q, want %q", pattern, sources[pattern], source)
+		}
+	}
+
+	statuses := m.Status()
+	if statuses[0].Duplicates != 1 || statuses[1].Duplicates != 1 {
+		t.Errorf("duplicates = %d and %d, want 1 each", statuses[0].Duplicates, statuses[1].Duplicates)
+	}
+	if statuses[1].Errors != 1 || len(statuses[1].LineErrors) != 1 || statuses[1].LineErrors[0].Line != 3 {
+		t.Errorf("second list errors = %d %v, want line 3", statuses[1].Errors, statuses[1].LineErrors)
+	}
+}
+
+func TestRefreshLocalFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(path, []byte("reddit.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m := newTestManager(t, []Options{{Source: path}}, t.TempDir())
+	m.Load()
+
+	if m.refreshDue(0) {
+		t.Error("refresh of an unchanged file reported a change")
+	}
+	if err := os.WriteFile(path, []byte("reddit.com\nfacebook.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !m.refreshDue(0) {
+		t.Error("refresh of a changed file reported no change")
+	}
+	if st := m.Status()[0]; st.Domains != 2 {
+		t.Errorf("changed file has %d domains, want 2", st.Domains)
+	}
+}
+
+func TestNewManagerDuplicateNames(t *testing.T) {
+	if _, err := NewManager([]Options{{Source: "a.txt"}, {Source: "a.txt"}}, "", nil); err == nil {
+		t.Error("NewManager accepted two lists with the same name")
+	}
+	if _, err := NewManager([]Options{{Name: "empty"}}, "", nil); err == nil {
+		t.Error("NewManager accepted a list without a source")
+	}
+}
@@ -0,0 +1,238 @@
+package blockpage
+
+import (
+	"crypto/tls"
+	"errors"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PauseStatus describes the pause state shown on the page
+type PauseStatus struct {
+	Paused bool
+	Until  time.Time
+	Budget string // Human readable description of the remaining pause budget
+}
+
+// Funcs holds the daemon functions the block page relies on
+type Funcs struct {
+	Lookup      func(domain string) (rule string, blocked bool) // Rule blocking a domain
+	PauseStatus func() PauseStatus                              // Current pause state
+	Pause       func() error                                    // Triggers the pause flow
+	RecordHit   func(domain string, https bool)                 // Records a request to a blocked site
+}
+
+// Server serves the "this site is blocked" page on the sinkhole address.
+// HTTPS can't be intercepted without a trusted certificate, so connections
+// on the HTTPS port are only counted (using the SNI from the ClientHello)
+// and closed.
+type Server struct {
+	funcs Funcs
+
+	mu        sync.Mutex
+	servers   []*http.Server
+	listeners []net.Listener
+}
+
+// New creates a block page server
+func New(funcs Funcs) *Server {
+	return &Server{funcs: funcs}
+}
+
+// Listen starts serving the page on ip:httpPort and counting HTTPS hits on
+// ip:httpsPort. A zero httpsPort disables the HTTPS listener.
+func (s *Server) Listen(ip string, httpPort, httpsPort int) error {
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(httpPort)))
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	var tlsLn net.Listener
+	if httpsPort > 0 {
+		tlsLn, err = net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(httpsPort)))
+		if err != nil {
+			ln.Close()
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.servers = append(s.servers, srv)
+	if tlsLn != nil {
+		s.listeners = append(s.listeners, tlsLn)
+	}
+	s.mu.Unlock()
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("[BLOCKPAGE] HTTP server stopped: %v", err)
+		}
+	}()
+	if tlsLn != nil {
+		go s.serveHTTPS(tlsLn)
+	}
+
+	return nil
+}
+
+// Close stops all listeners
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, srv := range s.servers {
+		srv.Close()
+	}
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	s.servers = nil
+	s.listeners = nil
+}
+
+var errAbortHandshake = errors.New("block page does not terminate TLS")
+
+func (s *Server) serveHTTPS(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// Read just enough of the handshake to learn which site was requested
+			var serverName string
+			tlsConn := tls.Server(conn, &tls.Config{
+				GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+					serverName = hello.ServerName
+					return nil, errAbortHandshake
+				},
+			})
+			tlsConn.Handshake()
+
+			s.funcs.RecordHit(serverName, true)
+		}(conn)
+	}
+}
+
+// pageData is rendered by pageTemplate
+type pageData struct {
+	Domain  string
+	Rule    string
+	Blocked bool
+	Pause   PauseStatus
+	Message string
+	Error   string
+	Path    string // Originally requested path
+	Retry   string // URL to retry once blocking is paused
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/favicon.ico" {
+		http.NotFound(w, r)
+		return
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	data := pageData{Domain: host}
+	data.Rule, data.Blocked = s.funcs.Lookup(host)
+
+	if r.URL.Path == "/__fuckdopamine/pause" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Only accept the button on our own page, not cross-site requests
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		if err := s.funcs.Pause(); err != nil {
+			data.Error = err.Error()
+		} else {
+			data.Message = "Blocking is paused. Your browser may keep the blocked address cached for a few seconds, retry shortly."
+		}
+		data.Path = r.FormValue("path")
+		if !strings.HasPrefix(data.Path, "/") {
+			data.Path = "/"
+		}
+	} else {
+		s.funcs.RecordHit(host, false)
+		data.Path = r.URL.RequestURI()
+	}
+	data.Retry = "http://" + r.Host + data.Path
+	data.Pause = s.funcs.PauseStatus()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	pageTemplate.Execute(w, data)
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Domain}} is blocked</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; background: #111; color: #eee; display: flex; justify-content: center; padding-top: 12vh; margin: 0; }
+main { max-width: 560px; padding: 0 24px; }
+h1 { font-size: 28px; margin-bottom: 8px; }
+code { background: #222; padding: 2px 6px; border-radius: 4px; }
+.muted { color: #999; }
+.error { color: #f66; }
+button { font-size: 16px; padding: 10px 18px; border: 0; border-radius: 6px; background: #eee; color: #111; cursor: pointer; }
+</style>
+</head>
+<body>
+<main>
+{{if .Blocked}}
+<h1>{{.Domain}} is blocked by fuckdopamine</h1>
+{{if .Rule}}<p>Matched rule: <code>{{.Rule}}</code></p>{{end}}
+{{else}}
+<h1>{{.Domain}} is not blocked anymore</h1>
+<p>Your browser still remembers the blocked address. <a href="{{.Retry}}">Retry</a></p>
+{{end}}
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if .Error}}<p class="error">Pause denied: {{.Error}}</p>{{end}}
+{{if .Pause.Paused}}
+<p>Blocking is paused until {{.Pause.Until.Format "15:04:05"}}. <a href="{{.Retry}}">Retry</a></p>
+{{else}}
+<form method="post" action="/__fuckdopamine/pause">
+<input type="hidden" name="path" value="{{.Path}}">
+<button type="submit">Pause blocking</button>
+</form>
+{{end}}
+{{if .Pause.Budget}}<p class="muted">Pause budget: {{.Pause.Budget}}</p>{{end}}
+<p class="muted">If you think this is your Wi-Fi: it isn't. This site was blocked on purpose.</p>
+</main>
+</body>
+</html>
+`))
@@ -0,0 +1,172 @@
+package blockresponse
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Mode is the kind of answer given for a blocked query
+type Mode string
+
+const (
+	// ModeRefused answers with the REFUSED rcode
+	ModeRefused Mode = "refused"
+	// ModeNXDomain answers that the domain doesn't exist
+	ModeNXDomain Mode = "nxdomain"
+	// ModeNoData answers that the domain exists but has no records of the queried type
+	ModeNoData Mode = "nodata"
+	// ModeNull answers A queries with 0.0.0.0 and AAAA queries with ::
+	ModeNull Mode = "null"
+	// ModeSinkhole answers A and AAAA queries with the configured sinkhole addresses
+	ModeSinkhole Mode = "sinkhole"
+)
+
+// DefaultTTL is the TTL of synthesized answers when none is configured
+const DefaultTTL = 60
+
+// Policy describes how blocked queries are answered. Zero fields inherit
+// from the global policy, see Merge.
+type Policy struct {
+	Mode Mode   `json:"mode,omitempty"`
+	IPv4 net.IP `json:"ipv4,omitempty"` // Sinkhole address for A queries
+	IPv6 net.IP `json:"ipv6,omitempty"` // Sinkhole address for AAAA queries
+	TTL  uint32 `json:"ttl,omitempty"`  // TTL of synthesized records, in seconds
+}
+
+// New validates and builds a policy, an empty mode is left for Merge to fill in
+func New(mode, ipv4, ipv6 string, ttl uint32) (*Policy, error) {
+	p := &Policy{Mode: Mode(strings.ToLower(strings.TrimSpace(mode))), TTL: ttl}
+
+	switch p.Mode {
+	case "", ModeRefused, ModeNXDomain, ModeNoData, ModeNull, ModeSinkhole:
+	default:
+		return nil, fmt.Errorf("unknown block response mode %q (expected refused, nxdomain, nodata, null or sinkhole)", mode)
+	}
+
+	if ipv4 != "" {
+		ip := net.ParseIP(ipv4)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid sinkhole IPv4 address %q", ipv4)
+		}
+		p.IPv4 = ip.To4()
+	}
+	if ipv6 != "" {
+		ip := net.ParseIP(ipv6)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid sinkhole IPv6 address %q", ipv6)
+		}
+		p.IPv6 = ip
+	}
+
+	return p, nil
+}
+
+// Merge returns p with its unset fields taken from defaults
+func (p *Policy) Merge(defaults *Policy) *Policy {
+	merged := *defaults
+	if p == nil {
+		return &merged
+	}
+	if p.Mode != "" {
+		merged.Mode = p.Mode
+	}
+	if p.IPv4 != nil {
+		merged.IPv4 = p.IPv4
+	}
+	if p.IPv6 != nil {
+		merged.IPv6 = p.IPv6
+	}
+	if p.TTL != 0 {
+		merged.TTL = p.TTL
+	}
+	return &merged
+}
+
+// Validate checks that a fully merged policy can answer queries
+func (p *Policy) Validate() error {
+	if p.Mode == ModeSinkhole && p.IPv4 == nil && p.IPv6 == nil {
+		return fmt.Errorf("sinkhole mode requires an IPv4 or IPv6 address")
+	}
+	return nil
+}
+
+// Reply builds the answer to the blocked query r
+func (p *Policy) Reply(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.RecursionAvailable = true
+
+	ttl := p.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+
+	switch p.Mode {
+	case ModeNXDomain:
+		m.Rcode = dns.RcodeNameError
+		m.Ns = soaFor(r, ttl)
+
+	case ModeNoData:
+		m.Ns = soaFor(r, ttl)
+
+	case ModeNull:
+		m.Answer = addressAnswers(r, net.IPv4zero.To4(), net.IPv6zero, ttl)
+		if len(m.Answer) == 0 {
+			m.Ns = soaFor(r, ttl)
+		}
+
+	case ModeSinkhole:
+		m.Answer = addressAnswers(r, p.IPv4, p.IPv6, ttl)
+		if len(m.Answer) == 0 {
+			m.Ns = soaFor(r, ttl)
+		}
+
+	default:
+		m.Rcode = dns.RcodeRefused
+	}
+
+	return m
+}
+
+// addressAnswers synthesizes A and AAAA records for the questions in r.
+// ANY queries get both, other types (including HTTPS and SVCB) get none so
+// that clients fall back to the synthesized A and AAAA records.
+func addressAnswers(r *dns.Msg, ipv4, ipv6 net.IP, ttl uint32) []dns.RR {
+	var answers []dns.RR
+	for _, q := range r.Question {
+		hdr := func(rrtype uint16) dns.RR_Header {
+			return dns.RR_Header{Name: q.Name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+		}
+		wantA := q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY
+		wantAAAA := q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY
+
+		if wantA && ipv4 != nil {
+			answers = append(answers, &dns.A{Hdr: hdr(dns.TypeA), A: ipv4})
+		}
+		if wantAAAA && ipv6 != nil {
+			answers = append(answers, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: ipv6})
+		}
+	}
+	return answers
+}
+
+// soaFor synthesizes the SOA record clients use to cache a negative answer (RFC 2308)
+func soaFor(r *dns.Msg, ttl uint32) []dns.RR {
+	if len(r.Question) == 0 {
+		return nil
+	}
+	name := r.Question[0].Name
+	return []dns.RR{&dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "fuckdopamine.invalid.",
+		Mbox:    "blocked.fuckdopamine.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}}
+}
@@ -0,0 +1,271 @@
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultSize is the number of responses kept when no size is configured
+	DefaultSize = 4096
+	// DefaultMaxTTL caps how long any response is cached
+	DefaultMaxTTL = time.Hour
+
+	// Entries are prefetched once they have been hit this many times and
+	// less than prefetchThreshold of their original TTL is left
+	prefetchMinHits   = 2
+	prefetchThreshold = 10
+)
+
+// FetchFunc resolves a query that isn't cached
+type FetchFunc func(r *dns.Msg) (*dns.Msg, error)
+
+// Options configures a Cache
+type Options struct {
+	Size     int           // Maximum number of entries, DefaultSize if zero
+	MaxTTL   time.Duration // Upper bound for entry lifetime, DefaultMaxTTL if zero
+	Prefetch bool          // Refresh hot entries in the background before they expire
+}
+
+type key struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type entry struct {
+	key      key
+	msg      *dns.Msg
+	stored   time.Time
+	expires  time.Time
+	ttl      time.Duration
+	hits     uint64
+	fetching bool
+}
+
+// Cache is a bounded LRU cache of DNS responses keyed by question
+type Cache struct {
+	opts  Options
+	fetch FetchFunc
+	now   func() time.Time
+
+	mu    sync.Mutex
+	ll    *list.List // Front is most recently used
+	items map[key]*list.Element
+}
+
+// New creates a cache that resolves misses with fetch
+func New(opts Options, fetch FetchFunc) *Cache {
+	if opts.Size <= 0 {
+		opts.Size = DefaultSize
+	}
+	if opts.MaxTTL <= 0 {
+		opts.MaxTTL = DefaultMaxTTL
+	}
+
+	return &Cache{
+		opts:  opts,
+		fetch: fetch,
+		now:   time.Now,
+		ll:    list.New(),
+		items: make(map[key]*list.Element),
+	}
+}
+
+// Exchange answers r from the cache if possible, otherwise it fetches and
+// caches the response. The returned bool reports whether it was a cache hit.
+func (c *Cache) Exchange(r *dns.Msg) (*dns.Msg, bool, error) {
+	if len(r.Question) != 1 {
+		resp, err := c.fetch(r)
+		return resp, false, err
+	}
+
+	k := keyFor(r.Question[0])
+	if resp, ok := c.get(k, r); ok {
+		return resp, true, nil
+	}
+
+	resp, err := c.fetch(r)
+	if err != nil {
+		return nil, false, err
+	}
+	c.set(k, resp)
+
+	return resp, false, nil
+}
+
+// Flush removes every cached response
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[key]*list.Element)
+}
+
+func keyFor(q dns.Question) key {
+	return key{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}
+}
+
+func (c *Cache) get(k key, r *dns.Msg) (*dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[k]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+
+	now := c.now()
+	if !now.Before(e.expires) {
+		c.ll.Remove(el)
+		delete(c.items, k)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	e.hits++
+
+	remaining := e.expires.Sub(now)
+	if c.opts.Prefetch && !e.fetching && e.hits >= prefetchMinHits && remaining <= e.ttl/prefetchThreshold {
+		e.fetching = true
+		go c.prefetch(k, r.Copy())
+	}
+
+	resp := e.msg.Copy()
+	resp.Id = r.Id
+	resp.Question = append([]dns.Question(nil), r.Question...)
+	age := uint32(now.Sub(e.stored) / time.Second)
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if h.Ttl > age {
+				h.Ttl -= age
+			} else {
+				h.Ttl = 0
+			}
+		}
+	}
+
+	return resp, true
+}
+
+func (c *Cache) prefetch(k key, r *dns.Msg) {
+	resp, err := c.fetch(r)
+	if err == nil && c.set(k, resp) {
+		return
+	}
+
+	// Let the next hit try again
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[k]; ok {
+		el.Value.(*entry).fetching = false
+	}
+}
+
+// set caches resp if it is cacheable and reports whether it was stored
+func (c *Cache) set(k key, resp *dns.Msg) bool {
+	ttl, ok := cacheTTL(resp)
+	if !ok {
+		return false
+	}
+	if ttl > c.opts.MaxTTL {
+		ttl = c.opts.MaxTTL
+	}
+
+	now := c.now()
+	e := &entry{
+		key:     k,
+		msg:     resp.Copy(),
+		stored:  now,
+		expires: now.Add(ttl),
+		ttl:     ttl,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[k]; ok {
+		e.hits = el.Value.(*entry).hits
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return true
+	}
+
+	c.items[k] = c.ll.PushFront(e)
+	for c.ll.Len() > c.opts.Size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*entry).key)
+	}
+
+	return true
+}
+
+// cacheTTL returns how long resp may be cached. Positive answers use the
+// lowest record TTL; NXDOMAIN and NODATA answers are cached per RFC 2308
+// using the SOA record from the authority section.
+func cacheTTL(resp *dns.Msg) (time.Duration, bool) {
+	if resp.Truncated {
+		return 0, false
+	}
+
+	var ttl uint32
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		ttl = minTTL(resp.Answer, resp.Ns, resp.Extra)
+
+	case resp.Rcode == dns.RcodeNameError, resp.Rcode == dns.RcodeSuccess:
+		soa := findSOA(resp.Ns)
+		if soa == nil {
+			return 0, false
+		}
+		ttl = soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+
+	default:
+		return 0, false
+	}
+
+	if ttl == 0 {
+		return 0, false
+	}
+	return time.Duration(ttl) * time.Second, true
+}
+
+func minTTL(sections ...[]dns.RR) uint32 {
+	var ttl uint32
+	found := false
+	for _, rrs := range sections {
+		for _, rr := range rrs {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || h.Ttl < ttl {
+				ttl = h.Ttl
+				found = true
+			}
+		}
+	}
+	return ttl
+}
+
+func findSOA(rrs []dns.RR) *dns.SOA {
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeUpstream answers queries with the records set for their name and
+// counts the queries it gets
+type fakeUpstream struct {
+	mu      sync.Mutex
+	records map[string][]string // Answer records by name, a name without any is NXDOMAIN
+	soa     string              // Authority record of negative answers, none if empty
+	queries map[string]int
+	fetched chan string // Receives every name queried, if not nil
+}
+
+func newFakeUpstream() *fakeUpstream {
+	return &fakeUpstream{
+		records: make(map[string][]string),
+		soa:     "example. 3600 IN SOA ns.example. admin.example. 1 7200 3600 1209600 300",
+		queries: make(map[string]int),
+	}
+}
+
+func (u *fakeUpstream) set(name string, records ...string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.records[name] = records
+}
+
+func (u *fakeUpstream) count(name string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.queries[name]
+}
+
+func (u *fakeUpstream) fetch(r *dns.Msg) (*dns.Msg, error) {
+	u.mu.Lock()
+	name := r.Question[0].Name
+	u.queries[name]++
+	m := new(dns.Msg)
+	m.SetReply(r)
+	for _, s := range u.records[name] {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			u.mu.Unlock()
+			return nil, err
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	if len(m.Answer) == 0 {
+		m.Rcode = dns.RcodeNameError
+		if u.soa != "" {
+			soa, _ := dns.NewRR(u.soa)
+			m.Ns = append(m.Ns, soa)
+		}
+	}
+	fetched := u.fetched
+	u.mu.Unlock()
+
+	if fetched != nil {
+		fetched <- name
+	}
+	return m, nil
+}
+
+// testCache returns a cache in front of u with a clock the test moves
+type testCache struct {
+	*Cache
+	t    *testing.T
+	time time.Time
+}
+
+func newTestCache(t *testing.T, opts Options, u *fakeUpstream) *testCache {
+	tc := &testCache{Cache: New(opts, u.fetch), t: t, time: time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)}
+	tc.now = func() time.Time { return tc.time }
+	return tc
+}
+
+func (tc *testCache) advance(d time.Duration) {
+	tc.time = tc.time.Add(d)
+}
+
+// query looks up an A record for name, reporting whether it was a hit
+func (tc *testCache) query(name string) (*dns.Msg, bool) {
+	tc.t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	resp, hit, err := tc.Exchange(r)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	if resp.Id != r.Id {
+		tc.t.Errorf("response ID %d, want %d", resp.Id, r.Id)
+	}
+	return resp, hit
+}
+
+func TestTTLDecrement(t *testing.T) {
+	u := newFakeUpstream()
+	u.set("a.example.", "a.example. 300 IN A 192.0.2.1", "a.example. 120 IN A 192.0.2.2")
+	c := newTestCache(t, Options{}, u)
+
+	if _, hit := c.query("a.example."); hit {
+		t.Fatal("hit on an empty cache")
+	}
+
+	c.advance(100*time.Second + 500*time.Millisecond)
+	resp, hit := c.query("a.example.")
+	if !hit {
+		t.Fatal("miss on a cached response")
+	}
+	for i, want := range []uint32{200, 20} {
+		if ttl := resp.Answer[i].Header().Ttl; ttl != want {
+			t.Errorf("record %d TTL = %d, want %d", i, ttl, want)
+		}
+	}
+
+	// Expires with the lowest TTL
+	c.advance(19 * time.Second)
+	if _, hit := c.query("a.example."); !hit {
+		t.Error("miss before the lowest TTL ran out")
+	}
+	c.advance(time.Second)
+	if _, hit := c.query("a.example."); hit {
+		t.Error("hit after the lowest TTL ran out")
+	}
+	if n := u.count("a.example."); n != 2 {
+		t.Errorf("upstream queried %d times, want 2", n)
+	}
+}
+
+func TestHitsDontShareRecords(t *testing.T) {
+	u := newFakeUpstream()
+	u.set("a.example.", "a.example. 300 IN A 192.0.2.1")
+	c := newTestCache(t, Options{}, u)
+
+	c.query("a.example.")
+	resp, _ := c.query("a.example.")
+	resp.Answer[0].Header().Ttl = 1
+
+	c.advance(10 * time.Second)
+	resp, _ = c.query("A.Example.")
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 290 {
+		t.Errorf("TTL = %d, want 290", ttl)
+	}
+	if resp.Question[0].Name != "A.Example." {
+		t.Errorf("question = %s, want the one asked", resp.Question[0].Name)
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	tests := []struct {
+		name    string
+		soa     string
+		wantTTL time.Duration // Zero when not cached
+	}{
+		// RFC 2308: the lower of the SOA's TTL and its MINIMUM field
+		{"minimum", "example. 3600 IN SOA ns.example. admin.example. 1 7200 3600 1209600 300", 300 * time.Second},
+		{"SOA TTL", "example. 60 IN SOA ns.example. admin.example. 1 7200 3600 1209600 300", 60 * time.Second},
+		{"zero", "example. 0 IN SOA ns.example. admin.example. 1 7200 3600 1209600 300", 0},
+		{"no SOA", "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newFakeUpstream()
+			u.soa = tt.soa
+			c := newTestCache(t, Options{}, u)
+
+			resp, _ := c.query("missing.example.")
+			if resp.Rcode != dns.RcodeNameError {
+				t.Fatalf("rcode = %s, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+			}
+
+			if tt.wantTTL == 0 {
+				if _, hit := c.query("missing.example."); hit {
+					t.Error("uncacheable negative answer cached")
+				}
+				return
+			}
+			c.advance(tt.wantTTL - time.Second)
+			resp, hit := c.query("missing.example.")
+			if !hit || resp.Rcode != dns.RcodeNameError {
+				t.Errorf("negative answer not cached for %s", tt.wantTTL)
+			}
+			c.advance(time.Second)
+			if _, hit := c.query("missing.example."); hit {
+				t.Errorf("negative answer cached longer than %s", tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	rr := func(s string) dns.RR {
+		r, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	soa := rr("example. 900 IN SOA ns.example. admin.example. 1 7200 3600 1209600 600")
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Ttl: 0}}
+
+	tests := []struct {
+		name   string
+		msg    *dns.Msg
+		want   time.Duration
+		wantOK bool
+	}{
+		{"lowest TTL", &dns.Msg{Answer: []dns.RR{rr("a.example. 300 IN A 192.0.2.1")}, Ns: []dns.RR{rr("example. 100 IN NS ns.example.")}}, 100 * time.Second, true},
+		{"OPT ignored", &dns.Msg{Answer: []dns.RR{rr("a.example. 300 IN A 192.0.2.1")}, Extra: []dns.RR{opt}}, 300 * time.Second, true},
+		{"NODATA", &dns.Msg{Ns: []dns.RR{soa}}, 600 * time.Second, true},
+		{"NXDOMAIN", &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}, Ns: []dns.RR{rr("example. 100 IN NS ns.example."), soa}}, 600 * time.Second, true},
+		{"SERVFAIL", &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}, Ns: []dns.RR{soa}}, 0, false},
+		{"truncated", &dns.Msg{MsgHdr: dns.MsgHdr{Truncated: true}, Answer: []dns.RR{rr("a.example. 300 IN A 192.0.2.1")}}, 0, false},
+		{"zero TTL", &dns.Msg{Answer: []dns.RR{rr("a.example. 0 IN A 192.0.2.1")}}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := cacheTTL(tt.msg)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("cacheTTL = %s, %v, want %s, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestMaxTTL(t *testing.T) {
+	u := newFakeUpstream()
+	u.set("a.example.", "a.example. 86400 IN A 192.0.2.1")
+	c := newTestCache(t, Options{MaxTTL: time.Minute}, u)
+
+	c.query("a.example.")
+	c.advance(59 * time.Second)
+	if _, hit := c.query("a.example."); !hit {
+		t.Error("miss before the max TTL")
+	}
+	c.advance(time.Second)
+	if _, hit := c.query("a.example."); hit {
+		t.Error("hit after the max TTL")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	u := newFakeUpstream()
+	for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+		u.set(name, name+" 300 IN A 192.0.2.1")
+	}
+	c := newTestCache(t, Options{Size: 2}, u)
+
+	c.query("a.example.")
+	c.query("b.example.")
+	c.query("a.example.") // b is now the least recently used
+	c.query("c.example.")
+
+	if _, hit := c.query("a.example."); !hit {
+		t.Error("recently used entry evicted")
+	}
+	if _, hit := c.query("c.example."); !hit {
+		t.Error("newest entry evicted")
+	}
+	if _, hit := c.query("b.example."); hit {
+		t.Error("least recently used entry kept past the size")
+	}
+
+	c.Flush()
+	if _, hit := c.query("a.example."); hit {
+		t.Error("hit after a flush")
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	u := newFakeUpstream()
+	u.set("a.example.", "a.example. 100 IN A 192.0.2.1")
+	u.fetched = make(chan string, 10)
+	c := newTestCache(t, Options{Prefetch: true}, u)
+
+	c.query("a.example.")
+	<-u.fetched
+
+	// Hot but with most of its TTL left
+	c.query("a.example.")
+	c.query("a.example.")
+	select {
+	case <-u.fetched:
+		t.Fatal("prefetched with most of the TTL left")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Refreshed in the background once less than a tenth of the TTL is left
+	u.set("a.example.", "a.example. 100 IN A 192.0.2.2")
+	c.advance(91 * time.Second)
+	resp, hit := c.query("a.example.")
+	if !hit || resp.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatal("prefetching didn't answer from the cache")
+	}
+	select {
+	case <-u.fetched:
+	case <-time.After(time.Second):
+		t.Fatal("not prefetched")
+	}
+
+	// The refreshed entry is served without waiting for the old one to expire
+	waitFor(t, func() bool {
+		resp, hit := c.query("a.example.")
+		return hit && resp.Answer[0].(*dns.A).A.String() == "192.0.2.2"
+	})
+	c.advance(50 * time.Second)
+	if _, hit := c.query("a.example."); !hit {
+		t.Error("prefetched entry expired with the old one")
+	}
+	if n := u.count("a.example."); n != 2 {
+		t.Errorf("upstream queried %d times, want 2", n)
+	}
+}
+
+func TestPrefetchDisabled(t *testing.T) {
+	u := newFakeUpstream()
+	u.set("a.example.", "a.example. 100 IN A 192.0.2.1")
+	c := newTestCache(t, Options{}, u)
+
+	c.query("a.example.")
+	c.query("a.example.")
+	c.advance(95 * time.Second)
+	c.query("a.example.")
+	time.Sleep(50 * time.Millisecond)
+	if n := u.count("a.example."); n != 1 {
+		t.Errorf("upstream queried %d times, want 1", n)
+	}
+}
+
+func TestFetchError(t *testing.T) {
+	c := New(Options{}, func(r *dns.Msg) (*dns.Msg, error) {
+		return nil, errors.New("upstream down")
+	})
+	r := new(dns.Msg)
+	r.SetQuestion("a.example.", dns.TypeA)
+	if _, _, err := c.Exchange(r); err == nil {
+		t.Error("fetch error not returned")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
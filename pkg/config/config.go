@@ -2,49 +2,380 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"time"
+
+	"github.com/lucastomic/fuckdopamine/pkg/atomicfile"
 )
 
 // Config holds the fuckdopamine configuration
 type Config struct {
-	BlockedSites []string `json:"blocked_sites"`
-	LogFilePath  string   `json:"log_file_path"`
+	Version int `json:"version"` // Schema version, see CurrentVersion
+
+	BlockedSites []RuleConfig `json:"blocked_sites"`
+	AllowedSites []string     `json:"allowed_sites,omitempty"` // Exceptions to blocked_sites, the most specific rule wins
+	LogFilePath  string       `json:"log_file_path"`
+
+	// Named sets of blocked sites that can be turned off as a unit
+	Groups []GroupConfig `json:"groups,omitempty"`
+
+	// Weekly time windows that rules and groups can be limited to
+	Schedules []ScheduleConfig `json:"schedules,omitempty"`
+
+	// QuotaResetHour is the local hour, 0 to 23, at which daily quotas and
+	// daily pause limits start over
+	QuotaResetHour int `json:"quota_reset_hour,omitempty"`
+
+	// How long and how often blocking can be paused
+	Pause PauseConfig `json:"pause"`
+
+	// External lists of domains to block, see BlocklistConfig
+	Blocklists               []BlocklistConfig `json:"blocklists,omitempty"`
+	BlocklistRefreshInterval Duration          `json:"blocklist_refresh_interval,omitempty"` // How often downloaded lists are refreshed
+
+	// Where the daemon listens
+	ListenAddresses []string `json:"listen_addresses,omitempty"` // DNS addresses such as "127.0.0.1:53" or "[::1]:53"
+	SocketPath      string   `json:"socket_path,omitempty"`      // IPC Unix socket
+
+	// DNSBackend selects how the system DNS settings are changed: "auto",
+	// "networksetup", "resolvconf", "resolved" or "networkmanager"
+	DNSBackend string `json:"dns_backend,omitempty"`
+	// DNSCheckInterval is how often the system DNS settings are checked for
+	// new network interfaces and for changes made behind the daemon's back
+	DNSCheckInterval Duration `json:"dns_check_interval,omitempty"`
+
+	// How blocked queries are answered, rules can override it
+	BlockResponse BlockResponseConfig `json:"block_response"`
+
+	// Local "this site is blocked" page, answers blocked A/AAAA queries with its address
+	BlockPage BlockPageConfig `json:"block_page"`
+
+	// Upstream resolvers used for queries that are not blocked
+	Upstreams           []UpstreamConfig `json:"upstreams,omitempty"`
+	UpstreamStrategy    string           `json:"upstream_strategy,omitempty"` // "fastest" or "round_robin"
+	HealthCheckInterval Duration         `json:"health_check_interval,omitempty"`
+
+	// Response cache for forwarded queries
+	Cache CacheConfig `json:"cache"`
+}
+
+// CacheConfig configures the in-memory response cache
+type CacheConfig struct {
+	Disabled bool     `json:"disabled,omitempty"`
+	Size     int      `json:"size,omitempty"`    // Maximum number of cached responses
+	MaxTTL   Duration `json:"max_ttl,omitempty"` // Upper bound for how long a response is cached
+	Prefetch bool     `json:"prefetch"`          // Refresh popular entries before they expire
+}
+
+// RuleConfig is a blocking rule. It is written as a plain string such as
+// "reddit.com", or as an object when it has per-rule options.
+type RuleConfig struct {
+	Rule     string               `json:"rule"`
+	Response *BlockResponseConfig `json:"response,omitempty"` // Overrides block_response
+	Schedule string               `json:"schedule,omitempty"` // Only block during this schedule
+	Quota    *QuotaConfig         `json:"quota,omitempty"`    // Allow the domain until the daily quota is used up
+}
+
+// QuotaConfig is a daily budget for a blocked site, it is blocked once
+// either limit is reached
+type QuotaConfig struct {
+	Minutes int `json:"minutes,omitempty"` // Minutes of active use, minutes in which the site was queried
+	Queries int `json:"queries,omitempty"` // Number of DNS queries
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (r *RuleConfig) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*r = RuleConfig{}
+		return json.Unmarshal(data, &r.Rule)
+	}
+
+	type plain RuleConfig
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+// MarshalJSON implements json.Marshaler
+func (r RuleConfig) MarshalJSON() ([]byte, error) {
+	if r.Response == nil && r.Schedule == "" && r.Quota == nil {
+		return json.Marshal(r.Rule)
+	}
+
+	type plain RuleConfig
+	return json.Marshal(plain(r))
+}
+
+// GroupConfig is a named set of blocking rules, such as "news" or
+// "shopping", that can be enabled and disabled without editing its rules
+type GroupConfig struct {
+	Name     string       `json:"name"`
+	Enabled  *bool        `json:"enabled,omitempty"`  // Defaults to true
+	Schedule string       `json:"schedule,omitempty"` // Only block during this schedule
+	Domains  []RuleConfig `json:"domains"`            // Same syntax as blocked_sites
+}
+
+// IsEnabled reports whether the group's rules are in effect
+func (g GroupConfig) IsEnabled() bool {
+	return g.Enabled == nil || *g.Enabled
+}
+
+// ScheduleConfig is a named set of weekly time windows. Rules and groups
+// with a schedule only block during its windows.
+type ScheduleConfig struct {
+	Name     string         `json:"name"`
+	Timezone string         `json:"timezone,omitempty"` // IANA name such as "Europe/Madrid", defaults to the system time zone
+	Windows  []WindowConfig `json:"windows"`
+}
+
+// WindowConfig is a daily time range, e.g. 09:00 to 18:00 on weekdays
+type WindowConfig struct {
+	Days  []string `json:"days,omitempty"` // "mon" to "sun", "weekdays" or "weekends", every day when empty
+	Start string   `json:"start"`          // "HH:MM"
+	End   string   `json:"end"`            // "HH:MM", before start for windows that run overnight
+}
+
+// PauseConfig rations pauses, zero limits are unlimited
+type PauseConfig struct {
+	DefaultDuration  Duration `json:"default_duration,omitempty"`    // Length of a pause that doesn't ask for one, 10m when unset
+	MaxDuration      Duration `json:"max_duration,omitempty"`        // Longest pause that can be asked for, the default duration when unset
+	MaxPerDay        int      `json:"max_per_day,omitempty"`         // Number of pauses per day
+	MaxMinutesPerDay int      `json:"max_minutes_per_day,omitempty"` // Total minutes of pauses per day
+	Cooldown         Duration `json:"cooldown,omitempty"`            // Time after a pause ends before the next one can start
+}
+
+// BlocklistConfig is an external list of domains to block. Every domain in
+// it blocks its subdomains too, like a plain entry in blocked_sites.
+type BlocklistConfig struct {
+	Name   string `json:"name,omitempty"`   // Shown in list_blocked, defaults to the source
+	Source string `json:"source"`           // Local file path or http(s) URL
+	Format string `json:"format,omitempty"` // "hosts", "domains", "adblock" or "auto" (default)
+}
+
+// BlockResponseConfig describes how blocked queries are answered
+type BlockResponseConfig struct {
+	Mode string `json:"mode,omitempty"` // "refused" (default), "nxdomain", "nodata", "null" or "sinkhole"
+	IPv4 string `json:"ipv4,omitempty"` // Sinkhole address for A queries
+	IPv6 string `json:"ipv6,omitempty"` // Sinkhole address for AAAA queries
+	TTL  uint32 `json:"ttl,omitempty"`  // TTL of synthesized answers, in seconds
+}
+
+// BlockPageConfig configures the local block page server
+type BlockPageConfig struct {
+	Enabled   bool   `json:"enabled"`
+	IPv4      string `json:"ipv4,omitempty"`       // Loopback address the page listens on, answered for A queries
+	IPv6      string `json:"ipv6,omitempty"`       // Loopback address the page listens on, answered for AAAA queries
+	HTTPPort  int    `json:"http_port,omitempty"`  // Port serving the page
+	HTTPSPort int    `json:"https_port,omitempty"` // Port counting HTTPS hits, -1 disables it
+}
+
+// UpstreamConfig describes a single upstream DNS resolver
+type UpstreamConfig struct {
+	Address  string   `json:"address"`            // host:port for udp/tls, URL for https
+	Protocol string   `json:"protocol,omitempty"` // "udp" (default), "tls" or "https"
+	Timeout  Duration `json:"timeout,omitempty"`  // Per-query timeout
+
+	// IP addresses of plain DNS servers resolving a host name in address,
+	// 8.8.8.8 and 1.1.1.1 if empty
+	Bootstrap []string `json:"bootstrap,omitempty"`
+
+	// TLS options for "tls" and "https" upstreams
+	ServerName string   `json:"server_name,omitempty"` // SNI and certificate name, defaults to the address host
+	PinSHA256  []string `json:"pin_sha256,omitempty"`  // Base64 SHA-256 hashes of accepted public keys
+	CAFile     string   `json:"ca_file,omitempty"`     // PEM bundle to trust instead of the system roots
+	Method     string   `json:"method,omitempty"`      // "GET" or "POST" (default) for "https"
+}
+
+// Duration is a time.Duration stored in JSON as a string such as "2s" or "1m30s"
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Default locations of the daemon's files
+const (
+	defaultConfigDir = "/etc/fuckdopamine"
+	defaultStateDir  = "/var/lib/fuckdopamine"
+	defaultLogDir    = "/var/log/fuckdopamine"
+)
+
+// configPath overrides the default config file location, see SetConfigPath
+var configPath string
+
+// SetConfigPath makes Load and Save use a different config file. When it is
+// outside the default config directory, the state and log files are kept
+// next to it, so an instance with its own config doesn't share them.
+func SetConfigPath(path string) {
+	configPath = path
 }
 
 // GetConfigDir returns the configuration directory path
 func GetConfigDir() string {
-	return "/etc/fuckdopamine"
+	if configPath != "" {
+		return filepath.Dir(configPath)
+	}
+	return defaultConfigDir
+}
+
+// ownConfigDir reports whether SetConfigPath moved the config file out of
+// the default config directory
+func ownConfigDir() bool {
+	return configPath != "" && filepath.Clean(filepath.Dir(configPath)) != defaultConfigDir
+}
+
+// GetStateDir returns the directory holding the stats, the cached
+// blocklists and the saved DNS settings
+func GetStateDir() string {
+	if ownConfigDir() {
+		return GetConfigDir()
+	}
+	return defaultStateDir
+}
+
+// GetLogDir returns the directory holding the daemon log and, unless the
+// config says otherwise, the DNS request log
+func GetLogDir() string {
+	if ownConfigDir() {
+		return GetConfigDir()
+	}
+	return defaultLogDir
 }
 
 // GetConfigPath returns the full path to the config file
 func GetConfigPath() string {
+	if configPath != "" {
+		return configPath
+	}
 	return filepath.Join(GetConfigDir(), "config.json")
 }
 
 // GetStatsPath returns the full path to the stats file
 func GetStatsPath() string {
-	return "/var/lib/fuckdopamine/stats.json"
+	return filepath.Join(GetStateDir(), "stats.json")
 }
 
-// Load loads the configuration from the config file
+// GetBlocklistCacheDir returns the directory holding the last download of
+// every blocklist
+func GetBlocklistCacheDir() string {
+	return filepath.Join(GetStateDir(), "blocklists")
+}
+
+// GetDNSStatePath returns the path of the file holding the original DNS
+// settings while the daemon has them changed
+func GetDNSStatePath() string {
+	return filepath.Join(GetStateDir(), "dns-backup.json")
+}
+
+// Load loads the configuration from the config file, falling back to the
+// backup kept by Save when the file is missing or corrupt. Files from older
+// versions are upgraded, keeping the original next to them; files from
+// newer versions are refused with a VersionError.
 func Load() (*Config, error) {
 	configPath := GetConfigPath()
 
-	data, err := os.ReadFile(configPath)
+	// A backup from before the newer binary ran would silently lose its settings
+	if err := checkNotNewer(configPath); err != nil {
+		return nil, err
+	}
+
+	data, used, err := atomicfile.ReadWithBackup(configPath, validConfig)
 	if err != nil {
 		return nil, err
 	}
+	if used != configPath {
+		log.Printf("[CONFIG] %s is missing or corrupt, loaded %s", configPath, used)
+	}
 
-	var cfg Config
-	if err := json.Unmarshal(data, &cfg); err != nil {
+	cfg, version, err := parse(data)
+	if err != nil {
 		return nil, err
 	}
+	if version < CurrentVersion && used == configPath {
+		saveMigrated(cfg, data, version)
+	}
+	return cfg, nil
+}
 
-	return &cfg, nil
+// saveMigrated writes a config upgraded from an older version, first saving
+// the original as config.json.v<version>.bak. The upgraded config is still
+// used if that fails.
+func saveMigrated(cfg *Config, original []byte, version int) {
+	configPath := GetConfigPath()
+	backup := fmt.Sprintf("%s.v%d%s", configPath, version, atomicfile.BackupSuffix)
+	if err := atomicfile.WriteFile(backup, original, 0644); err != nil {
+		log.Printf("[CONFIG] Upgraded config from version %d to %d in memory, failed to back up the original: %v",
+			version, CurrentVersion, err)
+		return
+	}
+	if err := Save(cfg); err != nil {
+		log.Printf("[CONFIG] Upgraded config from version %d to %d in memory, failed to save it: %v",
+			version, CurrentVersion, err)
+		return
+	}
+	log.Printf("[CONFIG] Upgraded config from version %d to %d, the original is in %s", version, CurrentVersion, backup)
 }
 
-// Save saves the configuration to the config file
+// LoadChecked loads the config file without falling back to the backup, for
+// reloads where an older backup would silently revert recent changes, and
+// validates it. Files from older versions are upgraded in memory only. The
+// error is only set when the file can't be read or parsed, problems with
+// its settings are in the report.
+func LoadChecked() (*Config, *Report, error) {
+	data, err := os.ReadFile(GetConfigPath())
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, report := Check(data)
+	if cfg == nil {
+		return nil, report, report.Err()
+	}
+	return cfg, report, nil
+}
+
+// parse upgrades and decodes a config file, returning the version it had.
+// Decoding errors point at their line.
+func parse(data []byte) (*Config, int, error) {
+	migrated, version, err := migrate(data)
+	if err != nil {
+		return nil, version, err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(migrated, &cfg); err != nil {
+		p := decodeProblem(migrated, err)
+		if version != CurrentVersion {
+			p.Line = 0 // The line is in the upgraded file, not the one on disk
+		}
+		return nil, version, p
+	}
+	return &cfg, version, nil
+}
+
+func validConfig(data []byte) error {
+	_, _, err := parse(data)
+	return err
+}
+
+// Save atomically saves the configuration to the config file as
+// CurrentVersion, keeping the previous version as a backup. It refuses to
+// overwrite a file from a newer version.
 func Save(cfg *Config) error {
 	configDir := GetConfigDir()
 
@@ -54,19 +385,55 @@ func Save(cfg *Config) error {
 	}
 
 	configPath := GetConfigPath()
+	if err := checkNotNewer(configPath); err != nil {
+		return err
+	}
 
-	data, err := json.MarshalIndent(cfg, "", "  ")
+	current := *cfg
+	current.Version = CurrentVersion
+	data, err := json.MarshalIndent(&current, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(configPath, data, 0644)
+	return atomicfile.WriteWithBackup(configPath, data, 0644, validConfig)
 }
 
 // Default returns a default configuration
 func Default() *Config {
 	return &Config{
-		BlockedSites: []string{"example.com"},
-		LogFilePath:  "/var/log/fuckdopamine/dns_requests.json",
+		Version:                  CurrentVersion,
+		BlockedSites:             []RuleConfig{{Rule: "example.com"}},
+		LogFilePath:              filepath.Join(GetLogDir(), "dns_requests.json"),
+		ListenAddresses:          []string{":53"},
+		SocketPath:               "/tmp/fuckdopamine.sock",
+		DNSBackend:               "auto",
+		DNSCheckInterval:         Duration(10 * time.Second),
+		BlocklistRefreshInterval: Duration(24 * time.Hour),
+		BlockResponse: BlockResponseConfig{
+			Mode: "refused",
+			TTL:  60,
+		},
+		Upstreams: []UpstreamConfig{
+			{Address: "8.8.8.8:53", Timeout: Duration(2 * time.Second)},
+			{Address: "1.1.1.1:53", Timeout: Duration(2 * time.Second)},
+		},
+		BlockPage: BlockPageConfig{
+			IPv4:      "127.0.0.1",
+			IPv6:      "::1",
+			HTTPPort:  80,
+			HTTPSPort: 443,
+		},
+		Pause: PauseConfig{
+			DefaultDuration: Duration(10 * time.Minute),
+			MaxDuration:     Duration(30 * time.Minute),
+		},
+		UpstreamStrategy:    "fastest",
+		HealthCheckInterval: Duration(30 * time.Second),
+		Cache: CacheConfig{
+			Size:     4096,
+			MaxTTL:   Duration(time.Hour),
+			Prefetch: true,
+		},
 	}
 }
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPathsFollowConfigDir(t *testing.T) {
+	defer SetConfigPath("")
+
+	tests := []struct {
+		name       string
+		configPath string
+		stateDir   string
+		logDir     string
+	}{
+		{"default", "", "/var/lib/fuckdopamine", "/var/log/fuckdopamine"},
+		{"default dir", "/etc/fuckdopamine/config.json", "/var/lib/fuckdopamine", "/var/log/fuckdopamine"},
+		{"other file in the default dir", "/etc/fuckdopamine/test.json", "/var/lib/fuckdopamine", "/var/log/fuckdopamine"},
+		{"own dir", "/tmp/instance/config.json", "/tmp/instance", "/tmp/instance"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetConfigPath(tt.configPath)
+			paths := [][2]string{
+				{GetStatsPath(), filepath.Join(tt.stateDir, "stats.json")},
+				{GetBlocklistCacheDir(), filepath.Join(tt.stateDir, "blocklists")},
+				{GetDNSStatePath(), filepath.Join(tt.stateDir, "dns-backup.json")},
+				{GetLogDir(), tt.logDir},
+				{Default().LogFilePath, filepath.Join(tt.logDir, "dns_requests.json")},
+			}
+			for _, p := range paths {
+				if p[0] != p[1] {
+					t.Errorf("got %s, want %s", p[0], p[1])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// CurrentVersion is the config schema version this binary reads and writes.
+// Bump it together with a new entry in migrations whenever fields are
+// renamed, removed or change meaning.
+const CurrentVersion = 1
+
+// migration upgrades a config file by one version. It works on the decoded
+// JSON document rather than on Config, so it can still read fields that
+// Config no longer has.
+type migration struct {
+	description string
+	apply       func(doc map[string]any) error
+}
+
+// migrations[i] upgrades a file from version i to version i+1. Files
+// without a version field are version 0.
+var migrations = []migration{
+	{"clean up blocked and allowed sites written as URLs or with uppercase letters", migrateLegacySites},
+}
+
+// VersionError is returned for config files from a newer fuckdopamine,
+// which can't be read without losing the settings this binary doesn't know
+type VersionError struct {
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("config file is version %d, but this fuckdopamined only understands versions up to %d; "+
+		"upgrade fuckdopamined, or replace the file with a config from this version", e.Version, CurrentVersion)
+}
+
+// migrate upgrades a config file to CurrentVersion step by step, returning
+// the upgraded file and the version it had. Files that are already current
+// are returned unchanged.
+func migrate(data []byte) ([]byte, int, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, 0, decodeProblem(data, err)
+	}
+
+	version, err := docVersion(doc)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version > CurrentVersion {
+		return nil, version, &VersionError{Version: version}
+	}
+	if version == CurrentVersion {
+		return data, version, nil
+	}
+
+	if doc == nil {
+		doc = make(map[string]any)
+	}
+	for v := version; v < CurrentVersion; v++ {
+		if err := migrations[v].apply(doc); err != nil {
+			return nil, version, fmt.Errorf("failed to upgrade config from version %d to %d (%s): %w",
+				v, v+1, migrations[v].description, err)
+		}
+	}
+	doc["version"] = CurrentVersion
+
+	migrated, err := json.Marshal(doc)
+	return migrated, version, err
+}
+
+// docVersion returns the version field of a decoded config file
+func docVersion(doc map[string]any) (int, error) {
+	raw, ok := doc["version"]
+	if !ok {
+		return 0, nil
+	}
+	v, ok := raw.(float64)
+	if !ok || v < 0 || v != float64(int(v)) {
+		return 0, Problem{Field: "version", Message: "must be a whole number"}
+	}
+	return int(v), nil
+}
+
+// fileVersion returns the version of the config file at path, or
+// CurrentVersion if it can't be read or parsed
+func fileVersion(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return CurrentVersion
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return CurrentVersion
+	}
+	version, err := docVersion(doc)
+	if err != nil {
+		return CurrentVersion
+	}
+	return version
+}
+
+// checkNotNewer fails with a VersionError if the file at path is from a
+// newer fuckdopamine, so it is neither replaced by a backup nor overwritten
+func checkNotNewer(path string) error {
+	if v := fileVersion(path); v > CurrentVersion {
+		return &VersionError{Version: v}
+	}
+	return nil
+}
+
+// migrateLegacySites upgrades files from before the version field. Early
+// versions matched blocked_sites literally, so entries such as
+// "https://reddit.com/" or "Reddit.COM." were accepted but never matched.
+// They are turned into the plain domain names rules expect.
+func migrateLegacySites(doc map[string]any) error {
+	for _, key := range []string{"blocked_sites", "allowed_sites"} {
+		raw, ok := doc[key]
+		if !ok || raw == nil {
+			continue
+		}
+		sites, ok := raw.([]any)
+		if !ok {
+			return fmt.Errorf("%s must be a list", key)
+		}
+		for i, site := range sites {
+			switch s := site.(type) {
+			case string:
+				sites[i] = legacySite(s)
+			case map[string]any:
+				if rule, ok := s["rule"].(string); ok {
+					s["rule"] = legacySite(rule)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// legacySite strips the URL parts and case from a domain rule, leaving
+// regexes and rules with an explicit kind alone
+func legacySite(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > 2 && s[0] == '/' && s[len(s)-1] == '/' {
+		return s
+	}
+	if kind, _, ok := strings.Cut(s, ":"); ok && !strings.HasPrefix(s[len(kind):], "://") {
+		return s
+	}
+
+	if strings.Contains(s, "/") {
+		raw := s
+		if !strings.Contains(raw, "://") {
+			raw = "//" + raw
+		}
+		if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+			s = u.Hostname()
+		}
+	}
+	return strings.TrimSuffix(strings.ToLower(s), ".")
+}
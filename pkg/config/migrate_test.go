@@ -0,0 +1,243 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLegacySite(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"reddit.com", "reddit.com"},
+		{"Reddit.COM.", "reddit.com"},
+		{" youtube.com ", "youtube.com"},
+		{"https://www.reddit.com/r/all", "www.reddit.com"},
+		{"HTTP://Instagram.com:8080/", "instagram.com"},
+		{"news.ycombinator.com/news", "news.ycombinator.com"},
+		{"/^ads?\\./", "/^ads?\\./"},
+		{"exact:Twitter.com", "exact:Twitter.com"},
+		{"*.Example.com", "*.example.com"},
+	}
+	for _, tt := range tests {
+		if got := legacySite(tt.in); got != tt.want {
+			t.Errorf("legacySite(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "migrate", "v0.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, version, err := migrate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Errorf("version = %d, want 0", version)
+	}
+
+	var doc map[string]any
+	if err := json.Unmarshal(migrated, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["version"] != float64(CurrentVersion) {
+		t.Errorf("upgraded version = %v, want %d", doc["version"], CurrentVersion)
+	}
+	// Fields Config doesn't know are kept, the config check reports them
+	if doc["some_removed_field"] != true {
+		t.Error("unknown field dropped")
+	}
+
+	cfg, version, err := parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Errorf("parse version = %d, want 0", version)
+	}
+	var rules []string
+	for _, rc := range cfg.BlockedSites {
+		rules = append(rules, rc.Rule)
+	}
+	want := []string{"www.reddit.com", "youtube.com", "news.ycombinator.com", "/^ads?\\./", "exact:Twitter.com", "instagram.com"}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("blocked sites = %q, want %q", rules, want)
+	}
+	if r := cfg.BlockedSites[5].Response; r == nil || r.Mode != "nxdomain" {
+		t.Errorf("response of an object rule = %+v", r)
+	}
+	if !reflect.DeepEqual(cfg.AllowedSites, []string{"docs.reddit.com"}) {
+		t.Errorf("allowed sites = %q", cfg.AllowedSites)
+	}
+
+	// A current file is returned as is
+	again, version, err := migrate(migrated)
+	if err != nil || version != CurrentVersion || string(again) != string(migrated) {
+		t.Errorf("migrating a current file = %s, %d, %v", again, version, err)
+	}
+}
+
+func TestMigrateErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"sites not a list", `{"blocked_sites": "reddit.com"}`},
+		{"fractional version", `{"version": 1.5}`},
+		{"negative version", `{"version": -1}`},
+		{"string version", `{"version": "1"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := migrate([]byte(tt.data)); err == nil {
+				t.Errorf("migrate(%s) succeeded", tt.data)
+			}
+		})
+	}
+
+	_, version, err := migrate([]byte(`{"version": 7}`))
+	var versionErr *VersionError
+	if !errors.As(err, &versionErr) || versionErr.Version != 7 || version != 7 {
+		t.Errorf("newer file: version %d, %v", version, err)
+	}
+}
+
+// useConfigFile makes Load and Save use path for the rest of the test
+func useConfigFile(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if data != "" {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	SetConfigPath(path)
+	t.Cleanup(func() { SetConfigPath("") })
+	return path
+}
+
+func TestLoadMigratesLegacyFile(t *testing.T) {
+	original, err := os.ReadFile(filepath.Join("testdata", "migrate", "v0.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := useConfigFile(t, string(original))
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BlockedSites[0].Rule != "www.reddit.com" {
+		t.Errorf("first blocked site = %q, want www.reddit.com", cfg.BlockedSites[0].Rule)
+	}
+
+	// The original is kept as config.json.v0.bak
+	backup, err := os.ReadFile(path + ".v0.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != string(original) {
+		t.Error("backup differs from the original file")
+	}
+
+	// And the file is saved as the current version
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := fileVersion(path); v != CurrentVersion {
+		t.Errorf("saved file is version %d, want %d", v, CurrentVersion)
+	}
+	saved, _, err := parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.BlockedSites, cfg.BlockedSites) {
+		t.Errorf("saved blocked sites = %+v, want %+v", saved.BlockedSites, cfg.BlockedSites)
+	}
+
+	// Loading it again doesn't upgrade anything
+	if err := os.Remove(path + ".v0.bak"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".v1.bak"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("current file backed up again: %v", err)
+	}
+}
+
+func TestSaveMigratedBackupFails(t *testing.T) {
+	path := useConfigFile(t, `{"blocked_sites": ["Reddit.com"], "log_file_path": "/tmp/fuckdopamine-test/dns.json"}`)
+	// A directory in the way of the backup
+	if err := os.Mkdir(path+".v0.bak", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BlockedSites[0].Rule != "reddit.com" {
+		t.Errorf("blocked site = %q, want it upgraded in memory", cfg.BlockedSites[0].Rule)
+	}
+	// Without a backup the original is left alone
+	if v := fileVersion(path); v != 0 {
+		t.Errorf("file rewritten as version %d without a backup", v)
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	newer := `{"version": 2, "blocked_sites": ["reddit.com"], "log_file_path": "/tmp/fuckdopamine-test/dns.json", "new_setting": 1}`
+	path := useConfigFile(t, newer)
+
+	var versionErr *VersionError
+	if _, err := Load(); !errors.As(err, &versionErr) || versionErr.Version != 2 {
+		t.Errorf("Load of a newer file: %v", err)
+	}
+
+	// Nor is a backup from this version used instead
+	if err := os.WriteFile(path+".bak", []byte(`{"version": 1, "log_file_path": "/tmp/fuckdopamine-test/dns.json"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(); !errors.As(err, &versionErr) {
+		t.Errorf("Load fell back to the backup of a newer file: %v", err)
+	}
+
+	// Save refuses to overwrite it
+	if err := Save(Default()); !errors.As(err, &versionErr) || versionErr.Version != 2 {
+		t.Errorf("Save over a newer file: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != newer {
+		t.Error("newer file overwritten")
+	}
+}
+
+func TestSaveWritesCurrentVersion(t *testing.T) {
+	path := useConfigFile(t, "")
+
+	cfg := Default()
+	cfg.Version = 0
+	if err := Save(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if v := fileVersion(path); v != CurrentVersion {
+		t.Errorf("saved version %d, want %d", v, CurrentVersion)
+	}
+	if cfg.Version != 0 {
+		t.Error("Save changed the config it was given")
+	}
+}
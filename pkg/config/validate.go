@@ -0,0 +1,731 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/lucastomic/fuckdopamine/pkg/blocklist"
+	"github.com/lucastomic/fuckdopamine/pkg/blockresponse"
+	"github.com/lucastomic/fuckdopamine/pkg/dnsconfig"
+	"github.com/lucastomic/fuckdopamine/pkg/matcher"
+	"github.com/lucastomic/fuckdopamine/pkg/schedule"
+	"github.com/lucastomic/fuckdopamine/pkg/upstream"
+)
+
+// Problem is something wrong with a config file
+type Problem struct {
+	Field   string `json:"field,omitempty"` // e.g. "blocked_sites[3]" or "upstreams[0].ca_file"
+	Line    int    `json:"line,omitempty"`  // 0 when unknown
+	Message string `json:"message"`
+	Warning bool   `json:"warning,omitempty"` // The config works, but probably not as intended
+}
+
+// String returns the problem as "line 12, blocked_sites[3]: message"
+func (p Problem) String() string {
+	var where []string
+	if p.Line > 0 {
+		where = append(where, fmt.Sprintf("line %d", p.Line))
+	}
+	if p.Field != "" {
+		where = append(where, p.Field)
+	}
+	if len(where) == 0 {
+		return p.Message
+	}
+	return strings.Join(where, ", ") + ": " + p.Message
+}
+
+// Report collects the problems found in a config file
+type Report struct {
+	Problems []Problem
+	lines    map[string]int // Line of each field in the file
+}
+
+// Errorf records an error in field
+func (r *Report) Errorf(field, format string, args ...any) {
+	r.add(field, false, fmt.Sprintf(format, args...))
+}
+
+// Warnf records a warning about field
+func (r *Report) Warnf(field, format string, args ...any) {
+	r.add(field, true, fmt.Sprintf(format, args...))
+}
+
+func (r *Report) add(field string, warning bool, msg string) {
+	r.Problems = append(r.Problems, Problem{Field: field, Line: r.line(field), Message: msg, Warning: warning})
+}
+
+// line returns the line of field, or of its closest enclosing field
+func (r *Report) line(field string) int {
+	for field != "" {
+		if line, ok := r.lines[field]; ok {
+			return line
+		}
+		i := strings.LastIndexAny(field, ".[")
+		if i < 0 {
+			break
+		}
+		field = field[:i]
+	}
+	return 0
+}
+
+// Has reports whether an error was recorded for field or anything inside it
+func (r *Report) Has(field string) bool {
+	for _, p := range r.Problems {
+		if !p.Warning && (p.Field == field || strings.HasPrefix(p.Field, field+".") || strings.HasPrefix(p.Field, field+"[")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Err returns an error listing every error in the report, or nil if there
+// are only warnings
+func (r *Report) Err() error {
+	var errs []error
+	for _, p := range r.Problems {
+		if !p.Warning {
+			errs = append(errs, errors.New(p.String()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Check parses and validates a config file. The config is nil when the file
+// can't be parsed at all.
+func Check(data []byte) (*Config, *Report) {
+	r := &Report{}
+	w := &fieldWalker{dec: json.NewDecoder(bytes.NewReader(data)), data: data, lines: make(map[string]int)}
+	w.dec.UseNumber()
+	walkErr := w.value("", reflect.TypeOf(Config{}))
+	if walkErr == nil {
+		r.lines = w.lines
+	}
+
+	cfg, version, err := parse(data)
+	if err != nil {
+		var p Problem
+		var versionErr *VersionError
+		switch {
+		case errors.As(err, &p):
+		case errors.As(err, &versionErr):
+			p = Problem{Field: "version", Message: err.Error()}
+		default:
+			p = Problem{Message: err.Error()}
+		}
+		if p.Line == 0 {
+			p.Line = r.line(p.Field)
+		}
+		r.Problems = append(r.Problems, p)
+		return nil, r
+	}
+
+	if walkErr == nil {
+		for _, field := range w.unknown {
+			r.Warnf(field, "unknown field, it is ignored")
+		}
+	}
+	if version < CurrentVersion {
+		r.Warnf("version", "the file is version %d, the daemon upgrades it to version %d when it starts", version, CurrentVersion)
+	}
+	cfg.validate(r)
+	return cfg, r
+}
+
+// Validate checks the settings of an already parsed config
+func (c *Config) Validate() *Report {
+	r := &Report{}
+	c.validate(r)
+	return r
+}
+
+func (c *Config) validate(r *Report) {
+	global, err := blockresponse.New(c.BlockResponse.Mode, c.BlockResponse.IPv4, c.BlockResponse.IPv6, c.BlockResponse.TTL)
+	if err == nil {
+		err = global.Merge(&blockresponse.Policy{Mode: blockresponse.ModeRefused}).Validate()
+	}
+	if err != nil {
+		r.Errorf("block_response", "%v", err)
+		global = nil
+	}
+
+	c.validateRules(r, global)
+	c.validateGroups(r, global)
+	c.validateSchedules(r)
+
+	if c.LogFilePath == "" {
+		r.Errorf("log_file_path", "is required")
+	} else {
+		checkWritablePath(r, "log_file_path", c.LogFilePath, true)
+	}
+	if c.SocketPath != "" {
+		checkWritablePath(r, "socket_path", c.SocketPath, false)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(c.DNSBackend)) {
+	case "", dnsconfig.BackendAuto, dnsconfig.BackendNetworksetup, dnsconfig.BackendResolvConf,
+		dnsconfig.BackendResolved, dnsconfig.BackendNetworkManager:
+	default:
+		r.Errorf("dns_backend", "unknown backend %q (expected auto, networksetup, resolvconf, resolved or networkmanager)", c.DNSBackend)
+	}
+
+	switch upstream.Strategy(c.UpstreamStrategy) {
+	case "", upstream.StrategyFastest, upstream.StrategyRoundRobin:
+	default:
+		r.Errorf("upstream_strategy", "unknown strategy %q (expected fastest or round_robin)", c.UpstreamStrategy)
+	}
+	for i, u := range c.Upstreams {
+		field := fmt.Sprintf("upstreams[%d]", i)
+		if strings.TrimSpace(u.Address) == "" {
+			r.Errorf(field+".address", "is required")
+		}
+		if u.CAFile != "" {
+			checkReadableFile(r, field+".ca_file", u.CAFile)
+		}
+		for j, b := range u.Bootstrap {
+			if _, err := upstream.BootstrapAddress(b); err != nil {
+				r.Errorf(fmt.Sprintf("%s.bootstrap[%d]", field, j), "%v", err)
+			}
+		}
+	}
+
+	blocklistNames := make(map[string]string)
+	for i, b := range c.Blocklists {
+		field := fmt.Sprintf("blocklists[%d]", i)
+		if _, err := blocklist.ParseFormat(b.Format); err != nil {
+			r.Errorf(field+".format", "%v", err)
+		}
+		switch {
+		case strings.TrimSpace(b.Source) == "":
+			r.Errorf(field+".source", "is required")
+			continue
+		case blocklist.IsURL(b.Source):
+		case strings.Contains(b.Source, "://"):
+			r.Errorf(field+".source", "%q: only http and https URLs are supported", b.Source)
+		case !filepath.IsAbs(b.Source):
+			r.Errorf(field+".source", "%q must be an absolute path or an http(s) URL", b.Source)
+		default:
+			checkReadableFile(r, field+".source", b.Source)
+		}
+
+		name := b.Name
+		if name == "" {
+			name = b.Source
+		}
+		if prev, ok := blocklistNames[name]; ok {
+			r.Errorf(field+".name", "%q is also the name of %s", name, prev)
+		}
+		blocklistNames[name] = field
+	}
+
+	for field, d := range map[string]Duration{
+		"blocklist_refresh_interval": c.BlocklistRefreshInterval,
+		"dns_check_interval":         c.DNSCheckInterval,
+		"health_check_interval":      c.HealthCheckInterval,
+		"cache.max_ttl":              c.Cache.MaxTTL,
+		"pause.default_duration":     c.Pause.DefaultDuration,
+		"pause.max_duration":         c.Pause.MaxDuration,
+		"pause.cooldown":             c.Pause.Cooldown,
+	} {
+		if d < 0 {
+			r.Errorf(field, "cannot be negative")
+		}
+	}
+	if c.QuotaResetHour < 0 || c.QuotaResetHour > 23 {
+		r.Errorf("quota_reset_hour", "%d is not an hour, expected 0 to 23", c.QuotaResetHour)
+	}
+	c.validatePause(r)
+	if c.Cache.Size < 0 {
+		r.Errorf("cache.size", "cannot be negative")
+	}
+
+	if c.BlockPage.Enabled {
+		if c.BlockPage.IPv4 != "" && net.ParseIP(c.BlockPage.IPv4).To4() == nil {
+			r.Errorf("block_page.ipv4", "%q is not an IPv4 address", c.BlockPage.IPv4)
+		}
+		if c.BlockPage.IPv6 != "" && (net.ParseIP(c.BlockPage.IPv6) == nil || net.ParseIP(c.BlockPage.IPv6).To4() != nil) {
+			r.Errorf("block_page.ipv6", "%q is not an IPv6 address", c.BlockPage.IPv6)
+		}
+		if c.BlockPage.HTTPPort < 0 || c.BlockPage.HTTPPort > 65535 {
+			r.Errorf("block_page.http_port", "%d is not a valid port", c.BlockPage.HTTPPort)
+		}
+		if c.BlockPage.HTTPSPort < -1 || c.BlockPage.HTTPSPort > 65535 {
+			r.Errorf("block_page.https_port", "%d is not a valid port, use -1 to disable it", c.BlockPage.HTTPSPort)
+		}
+	}
+}
+
+// validatePause checks that the pause limits leave room for a pause
+func (c *Config) validatePause(r *Report) {
+	p := c.Pause
+	if p.MaxPerDay < 0 {
+		r.Errorf("pause.max_per_day", "cannot be negative")
+	}
+	if p.MaxMinutesPerDay < 0 {
+		r.Errorf("pause.max_minutes_per_day", "cannot be negative")
+	}
+	if p.DefaultDuration > 0 && p.MaxDuration > 0 && p.DefaultDuration > p.MaxDuration {
+		r.Errorf("pause.default_duration", "%s is longer than max_duration %s", time.Duration(p.DefaultDuration), time.Duration(p.MaxDuration))
+	}
+	if p.MaxMinutesPerDay > 24*60 {
+		r.Warnf("pause.max_minutes_per_day", "%d minutes is more than a day, the limit never applies", p.MaxMinutesPerDay)
+	}
+}
+
+// ruleEntry is a rule from the config and where it was found
+type ruleEntry struct {
+	field    string
+	spec     string
+	rule     matcher.Rule
+	response *BlockResponseConfig
+	schedule string
+	quota    *QuotaConfig
+}
+
+// validateRules checks that every rule parses and reports rules that are
+// listed twice or can never make a difference
+func (c *Config) validateRules(r *Report, global *blockresponse.Policy) {
+	var entries []ruleEntry
+	for i, rc := range c.BlockedSites {
+		field := fmt.Sprintf("blocked_sites[%d]", i)
+		if rule, ok := checkRuleConfig(r, field, rc, global); ok {
+			entries = append(entries, ruleEntry{field: field, spec: rc.Rule, rule: rule, response: rc.Response, schedule: rc.Schedule, quota: rc.Quota})
+		}
+	}
+	for i, spec := range c.AllowedSites {
+		field := fmt.Sprintf("allowed_sites[%d]", i)
+		rule, err := matcher.ParseRule(spec)
+		if err != nil {
+			r.Errorf(field, "%v", err)
+			continue
+		}
+		rule.Action = matcher.ActionAllow
+		entries = append(entries, ruleEntry{field: field, spec: spec, rule: rule})
+	}
+
+	seen := make(map[string]ruleEntry)
+	var unique []ruleEntry
+	blockSubtrees := make(map[string]ruleEntry)
+	limitedSubtrees := make(map[string]bool) // Subtree rules with a schedule or quota, which don't always block
+	var allowRules []matcher.Rule            // Domain and glob allow rules
+	for _, e := range entries {
+		key := string(e.rule.Action) + " " + e.rule.String()
+		if e.schedule != "" {
+			key += " %" + e.schedule
+		}
+		if prev, ok := seen[key]; ok {
+			r.Warnf(e.field, "%q is a duplicate of %s", e.spec, prev.field)
+			continue
+		}
+		seen[key] = e
+		unique = append(unique, e)
+
+		if e.rule.Action == matcher.ActionAllow {
+			if blocked, ok := seen[string(matcher.ActionBlock)+" "+e.rule.String()]; ok {
+				r.Warnf(e.field, "%q is also blocked by %s, the allowlist exception wins", e.spec, blocked.field)
+			}
+		}
+
+		if e.rule.Action == matcher.ActionAllow && e.rule.Kind == matcher.KindGlob {
+			allowRules = append(allowRules, e.rule)
+		}
+		switch {
+		case e.rule.Kind == matcher.KindGlob && strings.HasPrefix(e.rule.Pattern, "*.") && !strings.ContainsAny(e.rule.Pattern[2:], "*?["):
+			r.Warnf(e.field, "%q doesn't match %s itself, %q covers it and all of its subdomains",
+				e.spec, e.rule.Pattern[2:], e.rule.Pattern[2:])
+		case e.rule.Kind != matcher.KindExact && e.rule.Kind != matcher.KindSubtree:
+		case e.rule.Action == matcher.ActionAllow:
+			allowRules = append(allowRules, e.rule)
+		case e.rule.Kind == matcher.KindSubtree && (e.schedule != "" || e.quota != nil):
+			limitedSubtrees[e.rule.Pattern] = true
+		case e.rule.Kind == matcher.KindSubtree:
+			blockSubtrees[e.rule.Pattern] = e
+		}
+	}
+
+	// A domain rule is redundant when the closest broader subtree rule
+	// already blocks it the same way and no exception sits in between
+	for _, e := range unique {
+		if e.rule.Action != matcher.ActionBlock || e.quota != nil || (e.rule.Kind != matcher.KindExact && e.rule.Kind != matcher.KindSubtree) {
+			continue
+		}
+		name := e.rule.Pattern
+		if e.rule.Kind == matcher.KindSubtree {
+			name = parentDomain(name)
+		}
+		for ; name != ""; name = parentDomain(name) {
+			broader, ok := blockSubtrees[name]
+			if !ok {
+				if limitedSubtrees[name] {
+					break
+				}
+				continue
+			}
+			if reflect.DeepEqual(broader.response, e.response) && !allowedBetween(allowRules, name, e.rule.Pattern) {
+				r.Warnf(e.field, "%q is already blocked by %s (%q)", e.spec, broader.field, broader.spec)
+			}
+			break
+		}
+	}
+}
+
+// checkRuleConfig parses a blocking rule and its response
+func checkRuleConfig(r *Report, field string, rc RuleConfig, global *blockresponse.Policy) (matcher.Rule, bool) {
+	rule, err := matcher.ParseRule(rc.Rule)
+	if err != nil {
+		r.Errorf(field, "%v", err)
+		return rule, false
+	}
+	if q := rc.Quota; q != nil {
+		switch {
+		case q.Minutes < 0 || q.Queries < 0:
+			r.Errorf(field+".quota", "limits cannot be negative")
+			return rule, false
+		case q.Minutes == 0 && q.Queries == 0:
+			r.Errorf(field+".quota", "needs minutes or queries, remove it to block the site outright")
+			return rule, false
+		case q.Minutes > 24*60:
+			r.Warnf(field+".quota.minutes", "%d minutes is more than a day, the site is never blocked", q.Minutes)
+		}
+	}
+	if rc.Response != nil {
+		policy, err := blockresponse.New(rc.Response.Mode, rc.Response.IPv4, rc.Response.IPv6, rc.Response.TTL)
+		if err == nil && global != nil {
+			err = policy.Merge(global).Validate()
+		}
+		if err != nil {
+			r.Errorf(field+".response", "%v", err)
+			return rule, false
+		}
+	}
+	return rule, true
+}
+
+// validateGroups checks the rules of every group and that group names are
+// unique. Rules that are also in blocked_sites are reported, since turning
+// their group off doesn't unblock them.
+func (c *Config) validateGroups(r *Report, global *blockresponse.Policy) {
+	blocked := make(map[string]string)
+	for i, rc := range c.BlockedSites {
+		rule, err := matcher.ParseRule(rc.Rule)
+		if _, ok := blocked[rule.String()]; err == nil && !ok && rc.Schedule == "" {
+			blocked[rule.String()] = fmt.Sprintf("blocked_sites[%d]", i)
+		}
+	}
+
+	names := make(map[string]string)
+	for i, g := range c.Groups {
+		field := fmt.Sprintf("groups[%d]", i)
+		switch prev, ok := names[g.Name]; {
+		case strings.TrimSpace(g.Name) == "":
+			r.Errorf(field+".name", "is required")
+		case ok:
+			r.Errorf(field+".name", "%q is also the name of %s", g.Name, prev)
+		default:
+			names[g.Name] = field
+		}
+		if len(g.Domains) == 0 {
+			r.Warnf(field+".domains", "the group has no domains")
+		}
+
+		seen := make(map[string]string)
+		for j, rc := range g.Domains {
+			domainField := fmt.Sprintf("%s.domains[%d]", field, j)
+			rule, ok := checkRuleConfig(r, domainField, rc, global)
+			if !ok {
+				continue
+			}
+			key := rule.String() + " %" + rc.Schedule
+			if prev, ok := seen[key]; ok {
+				r.Warnf(domainField, "%q is a duplicate of %s", rc.Rule, prev)
+				continue
+			}
+			seen[key] = domainField
+			if prev, ok := blocked[rule.String()]; ok {
+				r.Warnf(domainField, "%q is also in %s, disabling the group doesn't unblock it", rc.Rule, prev)
+			}
+		}
+	}
+}
+
+// validateSchedules checks every schedule and that rules and groups only
+// refer to schedules that exist
+func (c *Config) validateSchedules(r *Report) {
+	names := make(map[string]string)
+	for i, sc := range c.Schedules {
+		field := fmt.Sprintf("schedules[%d]", i)
+		switch prev, ok := names[sc.Name]; {
+		case strings.TrimSpace(sc.Name) == "":
+			r.Errorf(field+".name", "is required")
+		case ok:
+			r.Errorf(field+".name", "%q is also the name of %s", sc.Name, prev)
+		default:
+			names[sc.Name] = field
+		}
+
+		if len(sc.Windows) == 0 {
+			r.Errorf(field+".windows", "a schedule needs at least one window")
+		}
+		for j, wc := range sc.Windows {
+			if _, err := schedule.ParseWindow(wc.Days, wc.Start, wc.End); err != nil {
+				r.Errorf(fmt.Sprintf("%s.windows[%d]", field, j), "%v", err)
+			}
+		}
+		if _, err := schedule.LoadLocation(sc.Timezone); err != nil {
+			r.Errorf(field+".timezone", "%v", err)
+		}
+	}
+
+	used := make(map[string]bool)
+	checkRef := func(field, name string) {
+		if name == "" {
+			return
+		}
+		used[name] = true
+		if _, ok := names[name]; !ok {
+			r.Errorf(field, "unknown schedule %q", name)
+		}
+	}
+	for i, rc := range c.BlockedSites {
+		checkRef(fmt.Sprintf("blocked_sites[%d].schedule", i), rc.Schedule)
+	}
+	for i, g := range c.Groups {
+		checkRef(fmt.Sprintf("groups[%d].schedule", i), g.Schedule)
+		for j, rc := range g.Domains {
+			checkRef(fmt.Sprintf("groups[%d].domains[%d].schedule", i, j), rc.Schedule)
+		}
+	}
+	for i, sc := range c.Schedules {
+		if sc.Name != "" && !used[sc.Name] {
+			r.Warnf(fmt.Sprintf("schedules[%d]", i), "schedule %q isn't used by any rule or group", sc.Name)
+		}
+	}
+}
+
+// parentDomain returns name without its first label, "" for a single label
+func parentDomain(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// inDomain reports whether name is domain or one of its subdomains
+func inDomain(name, domain string) bool {
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// allowedBetween reports whether an allow rule covers name and is at least
+// as specific as the broader domain, so removing a block rule for name
+// would let it through. Globs are more specific when they have more labels.
+func allowedBetween(allow []matcher.Rule, broader, name string) bool {
+	for _, rule := range allow {
+		switch rule.Kind {
+		case matcher.KindGlob:
+			if ok, _ := path.Match(rule.Pattern, name); ok && labels(rule.Pattern) > labels(broader) {
+				return true
+			}
+			continue
+		case matcher.KindExact:
+			if rule.Pattern != name {
+				continue
+			}
+		}
+		if inDomain(name, rule.Pattern) && inDomain(rule.Pattern, broader) {
+			return true
+		}
+	}
+	return false
+}
+
+// labels returns the number of labels in name
+func labels(name string) int {
+	return strings.Count(name, ".") + 1
+}
+
+// checkWritablePath checks that path is absolute, isn't a directory and
+// that its directory exists or, when create is set, can be created
+func checkWritablePath(r *Report, field, path string, create bool) {
+	if !filepath.IsAbs(path) {
+		r.Errorf(field, "%q must be an absolute path", path)
+		return
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		r.Errorf(field, "%q is a directory", path)
+		return
+	}
+
+	dir := filepath.Dir(path)
+	info, err := os.Stat(dir)
+	switch {
+	case err == nil && !info.IsDir():
+		r.Errorf(field, "%s is not a directory", dir)
+	case errors.Is(err, os.ErrNotExist) && !create:
+		r.Errorf(field, "directory %s doesn't exist", dir)
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		r.Errorf(field, "%v", err)
+	}
+}
+
+// checkReadableFile checks that path is a regular file that can be read
+func checkReadableFile(r *Report, field, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		r.Errorf(field, "%v", err)
+		return
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && !info.Mode().IsRegular() {
+		r.Errorf(field, "%s is not a regular file", path)
+	}
+}
+
+// fieldWalker records the line of every field in a JSON document and
+// the fields that don't exist in the target type
+type fieldWalker struct {
+	dec     *json.Decoder
+	data    []byte
+	lines   map[string]int
+	unknown []string
+}
+
+// value walks the next value, which is stored in field of type t. A nil t
+// means the type is unknown and nothing is checked.
+func (w *fieldWalker) value(field string, t reflect.Type) error {
+	tok, err := w.dec.Token()
+	if err != nil {
+		return err
+	}
+	if _, ok := w.lines[field]; !ok {
+		w.lines[field] = lineAt(w.data, w.dec.InputOffset())
+	}
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		for w.dec.More() {
+			tok, err := w.dec.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := tok.(string)
+			child := key
+			if field != "" {
+				child = field + "." + key
+			}
+			w.lines[child] = lineAt(w.data, w.dec.InputOffset())
+
+			childType, known := fieldType(t, key)
+			if !known {
+				w.unknown = append(w.unknown, child)
+			}
+			if err := w.value(child, childType); err != nil {
+				return err
+			}
+		}
+		_, err = w.dec.Token()
+
+	case json.Delim('['):
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		for i := 0; w.dec.More(); i++ {
+			if err := w.value(fmt.Sprintf("%s[%d]", field, i), elem); err != nil {
+				return err
+			}
+		}
+		_, err = w.dec.Token()
+	}
+	return err
+}
+
+// fieldType returns the type of the field of struct t stored under key,
+// matching keys case-insensitively like encoding/json. Keys of other types
+// are always known.
+func fieldType(t reflect.Type, key string) (reflect.Type, bool) {
+	switch {
+	case t == nil:
+		return nil, true
+	case t.Kind() == reflect.Map:
+		return t.Elem(), true
+	case t.Kind() != reflect.Struct:
+		return nil, true
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if strings.EqualFold(name, key) {
+			return f.Type, true
+		}
+	}
+	return nil, false
+}
+
+// lineAt returns the 1-based line of offset in data
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// Error implements error, so decoding errors carry their position
+func (p Problem) Error() string {
+	return p.String()
+}
+
+// decodeProblem turns a JSON decoding error into a problem pointing at its line
+func decodeProblem(data []byte, err error) Problem {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return Problem{Line: lineAt(data, syntaxErr.Offset), Message: syntaxErr.Error()}
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		// Offsets of errors from custom decoders are relative to the value, so only trust named fields
+		return Problem{
+			Field:   typeErr.Field,
+			Line:    lineAt(data, typeErr.Offset),
+			Message: fmt.Sprintf("expected %s, found %s", jsonKind(typeErr.Type), typeErr.Value),
+		}
+	}
+	return Problem{Message: err.Error()}
+}
+
+// jsonKind describes how a value of type t is written in JSON
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number"
+	}
+	return t.String()
+}
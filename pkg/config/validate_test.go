@@ -0,0 +1,166 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the tests")
+
+// formatProblems lists the problems of the config file name the way
+// --check-config prints them, "name:line: error: field: message"
+func formatProblems(name string, r *Report) string {
+	var b strings.Builder
+	for _, p := range r.Problems {
+		where := name
+		if p.Line > 0 {
+			where += fmt.Sprintf(":%d", p.Line)
+		}
+		kind := "error"
+		if p.Warning {
+			kind = "warning"
+		}
+		if p.Field != "" {
+			fmt.Fprintf(&b, "%s: %s: %s: %s\n", where, kind, p.Field, p.Message)
+		} else {
+			fmt.Fprintf(&b, "%s: %s: %s\n", where, kind, p.Message)
+		}
+	}
+	return b.String()
+}
+
+// TestCheckGolden checks every config in testdata/check against the
+// problems listed in its .golden file, run with -update to rewrite them
+func TestCheckGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "check", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no test configs")
+	}
+
+	for _, file := range files {
+		name := filepath.Base(file)
+		t.Run(strings.TrimSuffix(name, ".json"), func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, report := Check(data)
+			got := formatProblems(name, report)
+
+			golden := strings.TrimSuffix(file, ".json") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("problems of %s:\n%s\nwant:\n%s", name, got, want)
+			}
+		})
+	}
+}
+
+func TestCheckResult(t *testing.T) {
+	cfg, report := Check([]byte(`{"version": 1, "log_file_path": "/tmp/fuckdopamine-test/dns.json", "blocked_sites": ["reddit.com"]}`))
+	if cfg == nil || len(cfg.BlockedSites) != 1 || cfg.BlockedSites[0].Rule != "reddit.com" {
+		t.Errorf("config = %+v", cfg)
+	}
+	if err := report.Err(); err != nil {
+		t.Errorf("valid config: %v", err)
+	}
+
+	// Warnings alone aren't errors
+	_, report = Check([]byte(`{"version": 1, "log_file_path": "/tmp/fuckdopamine-test/dns.json", "blocked_sites": ["reddit.com", "reddit.com"]}`))
+	if len(report.Problems) != 1 || report.Err() != nil {
+		t.Errorf("problems = %v, err = %v", report.Problems, report.Err())
+	}
+
+	cfg, report = Check([]byte(`{"version": 1, `))
+	if cfg != nil || report.Err() == nil {
+		t.Errorf("unparseable config: %+v, %v", cfg, report.Err())
+	}
+}
+
+func TestReportHas(t *testing.T) {
+	r := &Report{}
+	r.Errorf("upstreams[1].ca_file", "missing")
+	r.Warnf("blocked_sites[0]", "duplicate")
+
+	tests := []struct {
+		field string
+		want  bool
+	}{
+		{"upstreams[1].ca_file", true},
+		{"upstreams[1]", true},
+		{"upstreams", true},
+		{"upstreams[10]", false},
+		{"upstreams[1].ca", false},
+		{"blocked_sites[0]", false}, // Only a warning
+	}
+	for _, tt := range tests {
+		if got := r.Has(tt.field); got != tt.want {
+			t.Errorf("Has(%s) = %v, want %v", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestFieldLines(t *testing.T) {
+	data := []byte(`{
+  "version": 1,
+  "blocked_sites": [
+    "reddit.com",
+    {
+      "rule": "youtube.com",
+      "quota": {"minutes": 10}
+    }
+  ],
+  "Upstreams": [{"address": "1.1.1.1:53", "bootstrapp": []}]
+}`)
+	w := &fieldWalker{dec: json.NewDecoder(bytes.NewReader(data)), data: data, lines: make(map[string]int)}
+	w.dec.UseNumber()
+	if err := w.value("", reflect.TypeOf(Config{})); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Report{lines: w.lines}
+	tests := []struct {
+		field string
+		want  int
+	}{
+		{"version", 2},
+		{"blocked_sites", 3},
+		{"blocked_sites[0]", 4},
+		{"blocked_sites[1]", 5},
+		{"blocked_sites[1].rule", 6},
+		{"blocked_sites[1].quota.minutes", 7},
+		{"blocked_sites[1].response", 5}, // Closest enclosing field
+		{"blocked_sites[1].quota.queries", 7},
+		{"Upstreams[0].address", 10},
+		{"log_file_path", 0},
+	}
+	for _, tt := range tests {
+		if got := r.line(tt.field); got != tt.want {
+			t.Errorf("line(%s) = %d, want %d", tt.field, got, tt.want)
+		}
+	}
+
+	// Keys match fields case-insensitively like encoding/json
+	if want := []string{"Upstreams[0].bootstrapp"}; fmt.Sprint(w.unknown) != fmt.Sprint(want) {
+		t.Errorf("unknown fields = %v, want %v", w.unknown, want)
+	}
+}
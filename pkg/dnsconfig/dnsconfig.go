@@ -0,0 +1,136 @@
+package dnsconfig
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Backends that can be selected in the config
+const (
+	BackendAuto           = "auto"
+	BackendNetworksetup   = "networksetup"
+	BackendResolvConf     = "resolvconf"
+	BackendResolved       = "resolved"
+	BackendNetworkManager = "networkmanager"
+)
+
+// Configurator points the system's DNS settings at the daemon and puts the
+// original settings back when it stops
+type Configurator interface {
+	// Name returns the backend name, e.g. "resolved"
+	Name() string
+	// Interfaces lists the network services, interfaces or files that
+	// currently need to point at the daemon
+	Interfaces() ([]string, error)
+	// Backup reads the current DNS settings of the named interfaces
+	Backup(names []string) (*Backup, error)
+	// Apply makes every entry in b use servers
+	Apply(b *Backup, servers []string) error
+	// Restore puts back the settings saved in b
+	Restore(b *Backup) error
+}
+
+// Backup holds the DNS settings a configurator replaced
+type Backup struct {
+	Backend string           `json:"backend"`
+	Entries map[string]Entry `json:"entries"` // Keyed by network service, interface or file
+}
+
+// Entry is the saved DNS configuration of a network service, interface or file
+type Entry struct {
+	Servers []string `json:"servers,omitempty"` // Empty means the servers are assigned automatically
+	Domains []string `json:"domains,omitempty"` // systemd-resolved search and routing domains
+
+	Content string      `json:"content,omitempty"` // resolv.conf contents
+	Mode    os.FileMode `json:"mode,omitempty"`    // resolv.conf permissions
+	Symlink string      `json:"symlink,omitempty"` // resolv.conf symlink target
+}
+
+// String describes the backup for logging
+func (b *Backup) String() string {
+	names := make([]string, 0, len(b.Entries))
+	for name := range b.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+": "+describeServers(b.Entries[name].Servers))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// describeServers formats a server list for logging
+func describeServers(servers []string) string {
+	if len(servers) == 0 {
+		return "automatic"
+	}
+	return strings.Join(servers, " ")
+}
+
+// New returns the configurator for backend, an empty backend or "auto"
+// picks the one matching the running system
+func New(backend string) (Configurator, error) {
+	switch strings.ToLower(strings.TrimSpace(backend)) {
+	case "", BackendAuto:
+		return Detect(), nil
+	case BackendNetworksetup:
+		return NewNetworksetup(), nil
+	case BackendResolvConf:
+		return NewResolvConf("/"), nil
+	case BackendResolved:
+		return NewResolved(), nil
+	case BackendNetworkManager:
+		return NewNetworkManager(), nil
+	default:
+		return nil, fmt.Errorf("unknown DNS backend %q (expected auto, networksetup, resolvconf, resolved or networkmanager)", backend)
+	}
+}
+
+// Detect picks the backend managing DNS on this system. On Linux
+// NetworkManager is preferred, then systemd-resolved, then rewriting
+// /etc/resolv.conf directly.
+func Detect() Configurator {
+	if runtime.GOOS == "darwin" {
+		return NewNetworksetup()
+	}
+	if out, err := runCommand("nmcli", "-t", "-f", "RUNNING", "general"); err == nil && strings.TrimSpace(string(out)) == "running" {
+		return NewNetworkManager()
+	}
+	if _, err := runCommand("resolvectl", "status"); err == nil {
+		return NewResolved()
+	}
+	return NewResolvConf("/")
+}
+
+// runCommand runs an external tool and returns its output, stderr is
+// included in the error. It is a variable so the tools can be stubbed.
+var runCommand = func(name string, args ...string) ([]byte, error) {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return out, fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return out, fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return out, nil
+}
+
+// splitFamilies separates IPv4 and IPv6 addresses
+func splitFamilies(servers []string) (ipv4, ipv6 []string) {
+	for _, s := range servers {
+		if strings.Contains(s, ":") {
+			ipv6 = append(ipv6, s)
+		} else {
+			ipv4 = append(ipv4, s)
+		}
+	}
+	return ipv4, ipv6
+}
@@ -0,0 +1,23 @@
+package dnsconfig
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// stubCommands makes runCommand print the captured output of each command
+// line in outputs instead of running it, other commands fail
+func stubCommands(t *testing.T, outputs map[string]string) {
+	t.Helper()
+	run := runCommand
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		line := strings.Join(append([]string{name}, args...), " ")
+		out, ok := outputs[line]
+		if !ok {
+			return nil, fmt.Errorf("%s: unexpected command", line)
+		}
+		return []byte(out), nil
+	}
+	t.Cleanup(func() { runCommand = run })
+}
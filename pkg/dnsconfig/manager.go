@@ -0,0 +1,313 @@
+package dnsconfig
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InterfaceStatus is the state of a managed network service, interface or file
+type InterfaceStatus struct {
+	Name     string   `json:"name"`
+	Backend  string   `json:"backend"`
+	Original []string `json:"original,omitempty"` // Servers before the daemon changed them, empty means automatic
+	Applied  bool     `json:"applied"`            // Whether it currently points at the daemon
+	Since    string   `json:"since"`              // When it was last configured
+	Error    string   `json:"error,omitempty"`
+}
+
+// TamperFunc is called when the DNS settings of an interface were changed
+// away from the daemon, found holds the servers it was changed to
+type TamperFunc func(name string, expected, found []string)
+
+// Manager keeps every network service or interface pointed at the daemon,
+// including ones that appear while it runs, and restores them on Stop. The
+// original settings are kept in a state file until they are restored.
+// Settings changed behind its back, by the user or a VPN client, are put
+// back on the next check.
+type Manager struct {
+	configurator Configurator
+	servers      []string
+	statePath    string
+	onTamper     TamperFunc
+
+	mu     sync.Mutex
+	backup *Backup
+	status map[string]*InterfaceStatus
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewManager creates a manager pointing the interfaces of c at servers,
+// onTamper may be nil
+func NewManager(c Configurator, servers []string, statePath string, onTamper TamperFunc) *Manager {
+	return &Manager{
+		configurator: c,
+		servers:      servers,
+		statePath:    statePath,
+		onTamper:     onTamper,
+		backup:       &Backup{Backend: c.Name(), Entries: make(map[string]Entry)},
+		status:       make(map[string]*InterfaceStatus),
+	}
+}
+
+// Name returns the name of the backend in use
+func (m *Manager) Name() string {
+	return m.configurator.Name()
+}
+
+// Start configures every current interface. It fails, leaving the settings
+// untouched, if none of them could be configured.
+func (m *Manager) Start() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.sync(); err != nil {
+		m.restore()
+		return err
+	}
+
+	var errs []error
+	for _, st := range m.status {
+		if st.Applied {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %s", st.Name, st.Error))
+	}
+	if err := m.restore(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return errors.New("no network interfaces found")
+	}
+	return errors.Join(errs...)
+}
+
+// Watch starts checking for new and tampered interfaces every interval
+func (m *Manager) Watch(interval time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stop != nil {
+		return
+	}
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.mu.Lock()
+				if err := m.sync(); err != nil {
+					log.Printf("[DNS] Failed to check network interfaces: %v", err)
+				}
+				m.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// Stop stops watching and restores the original settings. The state file is
+// kept if that fails, so they can still be restored with RestoreSaved.
+func (m *Manager) Stop() error {
+	m.mu.Lock()
+	stop, done := m.stop, m.done
+	m.stop = nil
+	m.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.restore()
+}
+
+// Status returns the state of every managed interface sorted by name
+func (m *Manager) Status() []InterfaceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]InterfaceStatus, 0, len(m.status))
+	for _, st := range m.status {
+		result = append(result, *st)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// sync backs up and configures interfaces that appeared since the last call,
+// retries the ones that failed, re-applies the ones that were changed and
+// forgets the ones that are gone
+func (m *Manager) sync() error {
+	names, err := m.configurator.Interfaces()
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]bool, len(names))
+	for _, name := range names {
+		current[name] = true
+	}
+
+	changed := false
+	for name, entry := range m.backup.Entries {
+		if !current[name] {
+			// Disabled services still exist, try to put them back as they were
+			log.Printf("[DNS] %s is gone", name)
+			m.configurator.Restore(&Backup{Backend: m.backup.Backend, Entries: map[string]Entry{name: entry}})
+			delete(m.backup.Entries, name)
+			delete(m.status, name)
+			changed = true
+		}
+	}
+
+	var added []string
+	for _, name := range names {
+		if _, ok := m.backup.Entries[name]; ok {
+			continue
+		}
+		b, err := m.configurator.Backup([]string{name})
+		if err != nil {
+			m.setStatus(name, Entry{}, err)
+			continue
+		}
+		m.backup.Entries[name] = b.Entries[name]
+		added = append(added, name)
+		changed = true
+	}
+
+	// The originals must be on disk before anything is changed
+	if changed {
+		if err := SaveBackup(m.statePath, m.backup); err != nil {
+			for _, name := range added {
+				delete(m.backup.Entries, name)
+			}
+			return fmt.Errorf("failed to save DNS state file: %w", err)
+		}
+	}
+
+	for name, entry := range m.backup.Entries {
+		if st := m.status[name]; st != nil && st.Applied && !m.tampered(name) {
+			continue
+		}
+		single := &Backup{Backend: m.backup.Backend, Entries: map[string]Entry{name: entry}}
+		m.setStatus(name, entry, m.configurator.Apply(single, m.servers))
+	}
+
+	return nil
+}
+
+// tampered reports whether an applied interface no longer uses the daemon
+func (m *Manager) tampered(name string) bool {
+	current, err := m.configurator.Backup([]string{name})
+	if err != nil {
+		return false // It may be going away, the next sync will tell
+	}
+
+	found := current.Entries[name].Servers
+	if sameServers(found, m.servers) {
+		return false
+	}
+
+	log.Printf("[DNS] DNS settings of %s were changed to %s, re-applying", name, describeServers(found))
+	if m.onTamper != nil {
+		m.onTamper(name, m.servers, found)
+	}
+	return true
+}
+
+// sameServers reports whether a and b hold the same servers in any order
+func sameServers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int, len(a))
+	for _, s := range a {
+		seen[s]++
+	}
+	for _, s := range b {
+		if seen[s] == 0 {
+			return false
+		}
+		seen[s]--
+	}
+	return true
+}
+
+// setStatus records the outcome of configuring name, logging changes only so
+// an interface that keeps failing doesn't flood the log
+func (m *Manager) setStatus(name string, entry Entry, err error) {
+	prev := m.status[name]
+	st := &InterfaceStatus{
+		Name:     name,
+		Backend:  m.configurator.Name(),
+		Original: entry.Servers,
+		Applied:  err == nil,
+		Since:    time.Now().Format(time.RFC3339),
+	}
+	if err != nil {
+		st.Error = err.Error()
+	}
+
+	switch {
+	case err == nil:
+		log.Printf("[DNS] Pointed %s at the daemon (was %s)", name, describeServers(entry.Servers))
+	case prev == nil || prev.Error != st.Error:
+		log.Printf("[DNS] Failed to configure %s: %v", name, err)
+	default:
+		st.Since = prev.Since
+	}
+	m.status[name] = st
+}
+
+// restore puts back every saved entry and removes the state file
+func (m *Manager) restore() error {
+	if err := m.configurator.Restore(m.backup); err != nil {
+		return err
+	}
+	for _, st := range m.status {
+		st.Applied = false
+		st.Since = time.Now().Format(time.RFC3339)
+	}
+	if err := os.Remove(m.statePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("[DNS] Failed to remove DNS state file: %v", err)
+	}
+	return nil
+}
+
+// RestoreSaved restores the settings left in the state file by a daemon that
+// didn't shut down cleanly and removes the file. It returns the restored
+// backup, or nil if there was nothing to restore.
+func RestoreSaved(statePath string) (*Backup, error) {
+	backup, err := LoadBackup(statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	configurator, err := New(backup.Backend)
+	if err != nil {
+		return nil, err
+	}
+	if err := configurator.Restore(backup); err != nil {
+		return nil, err
+	}
+	return backup, os.Remove(statePath)
+}
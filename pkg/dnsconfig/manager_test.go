@@ -0,0 +1,150 @@
+package dnsconfig
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManagerStateFile(t *testing.T) {
+	root, path := newTestRoot(t, originalResolvConf, 0o644)
+	statePath := filepath.Join(t.TempDir(), "state", "dns.json")
+
+	m := NewManager(NewResolvConf(root), []string{"127.0.0.1"}, statePath, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	checkApplied(t, path, "127.0.0.1")
+
+	// The original is on disk while the settings are changed
+	saved, err := LoadBackup(statePath)
+	if err != nil {
+		t.Fatalf("state file not written: %v", err)
+	}
+	if saved.Backend != BackendResolvConf || saved.Entries[path].Content != originalResolvConf {
+		t.Errorf("state file = %+v", saved)
+	}
+	if info, err := os.Stat(statePath); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("state file mode = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+
+	st := m.Status()
+	if len(st) != 1 || !st[0].Applied || st[0].Name != path || len(st[0].Original) != 2 {
+		t.Errorf("status = %+v", st)
+	}
+
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path); got != originalResolvConf {
+		t.Errorf("restored file =\n%s", got)
+	}
+	if _, err := os.Stat(statePath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("state file left after a clean stop: %v", err)
+	}
+	if st := m.Status(); st[0].Applied {
+		t.Error("status still applied after stop")
+	}
+}
+
+func TestManagerCrashRecovery(t *testing.T) {
+	root, path := newTestRoot(t, originalResolvConf, 0o644)
+	statePath := filepath.Join(t.TempDir(), "dns.json")
+
+	// The daemon dies without calling Stop
+	crashed := NewManager(NewResolvConf(root), []string{"127.0.0.1"}, statePath, nil)
+	if err := crashed.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next start backs up the daemon's settings, not the original, so
+	// the original has to come from the state file
+	saved, err := LoadBackup(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewResolvConf(root).Restore(saved); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path); got != originalResolvConf {
+		t.Errorf("file restored from the state file =\n%s", got)
+	}
+
+	m := NewManager(NewResolvConf(root), []string{"127.0.0.1"}, statePath, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path); got != originalResolvConf {
+		t.Errorf("file after the restart =\n%s", got)
+	}
+}
+
+func TestManagerReappliesTampered(t *testing.T) {
+	root, path := newTestRoot(t, originalResolvConf, 0o644)
+	statePath := filepath.Join(t.TempDir(), "dns.json")
+
+	var tampered []string
+	m := NewManager(NewResolvConf(root), []string{"127.0.0.1"}, statePath, func(name string, expected, found []string) {
+		tampered = append(tampered, name)
+		if len(found) != 1 || found[0] != "1.1.1.1" {
+			t.Errorf("tampered servers = %v, want [1.1.1.1]", found)
+		}
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	if err := os.WriteFile(path, []byte("nameserver 1.1.1.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	err := m.sync()
+	m.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tampered) != 1 || tampered[0] != path {
+		t.Errorf("tamper callback got %v, want [%s]", tampered, path)
+	}
+	checkApplied(t, path, "127.0.0.1")
+
+	// The original is still the one from before the tampering
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path); got != originalResolvConf {
+		t.Errorf("restored file =\n%s", got)
+	}
+}
+
+func TestRestoreSaved(t *testing.T) {
+	dir := t.TempDir()
+
+	if b, err := RestoreSaved(filepath.Join(dir, "missing.json")); b != nil || err != nil {
+		t.Errorf("RestoreSaved without a state file = %v, %v, want nothing to do", b, err)
+	}
+
+	for name, content := range map[string]string{
+		"invalid.json":    "{",
+		"no-backend.json": `{"entries": {}}`,
+		"unknown.json":    `{"backend": "winreg", "entries": {}}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := RestoreSaved(path); err == nil {
+			t.Errorf("RestoreSaved accepted %s", name)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("RestoreSaved removed the unusable %s: %v", name, err)
+		}
+	}
+}
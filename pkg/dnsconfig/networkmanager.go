@@ -0,0 +1,95 @@
+package dnsconfig
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// NetworkManager configures every connected device with nmcli(1). Only
+// the applied connection of the device is modified, the saved connection
+// profile is left alone so "nmcli device reapply" restores the original
+// settings even after a crash.
+type NetworkManager struct{}
+
+// NewNetworkManager creates the NetworkManager backend
+func NewNetworkManager() *NetworkManager {
+	return &NetworkManager{}
+}
+
+// Name implements Configurator
+func (n *NetworkManager) Name() string {
+	return BackendNetworkManager
+}
+
+// Interfaces implements Configurator, returning the connected devices
+func (n *NetworkManager) Interfaces() ([]string, error) {
+	out, err := runCommand("nmcli", "-t", "-f", "DEVICE,STATE", "device")
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []string
+	for _, line := range strings.Split(string(out), "\n") {
+		// "connected (externally)" devices, like lo, aren't managed by NetworkManager
+		device, state, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if ok && state == "connected" {
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+// Backup implements Configurator
+func (n *NetworkManager) Backup(devices []string) (*Backup, error) {
+	b := &Backup{Backend: n.Name(), Entries: make(map[string]Entry)}
+	for _, device := range devices {
+		out, err := runCommand("nmcli", "-g", "IP4.DNS,IP6.DNS", "device", "show", device)
+		if err != nil {
+			return nil, err
+		}
+		b.Entries[device] = Entry{Servers: parseNmcliList(string(out))}
+	}
+	return b, nil
+}
+
+// Apply implements Configurator
+func (n *NetworkManager) Apply(b *Backup, servers []string) error {
+	ipv4, ipv6 := splitFamilies(servers)
+
+	var errs []error
+	for device := range b.Entries {
+		_, err := runCommand("nmcli", "device", "modify", device,
+			"ipv4.dns", strings.Join(ipv4, ","), "ipv4.ignore-auto-dns", "yes",
+			"ipv6.dns", strings.Join(ipv6, ","), "ipv6.ignore-auto-dns", "yes")
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Restore implements Configurator
+func (n *NetworkManager) Restore(b *Backup) error {
+	var errs []error
+	for device := range b.Entries {
+		if _, err := runCommand("nmcli", "device", "reapply", device); err != nil {
+			errs = append(errs, fmt.Errorf("restoring %s: %w", device, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parseNmcliList parses multi-value fields printed by "nmcli -g", one field
+// per line with values separated by " | " and colons escaped
+func parseNmcliList(out string) []string {
+	var values []string
+	for _, line := range strings.Split(out, "\n") {
+		for _, v := range strings.Split(line, " | ") {
+			if v = strings.TrimSpace(strings.ReplaceAll(v, `\:`, ":")); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,56 @@
+package dnsconfig
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNmcliList(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []string
+	}{
+		{"one per family", "192.168.1.1\nfe80\\:\\:1\n", []string{"192.168.1.1", "fe80::1"}},
+		{"several", "192.168.1.1 | 8.8.8.8\n2001\\:4860\\:4860\\:\\:8888 | fe80\\:\\:1\n", []string{"192.168.1.1", "8.8.8.8", "2001:4860:4860::8888", "fe80::1"}},
+		{"only IPv6", "\nfe80\\:\\:1\n", []string{"fe80::1"}},
+		{"none", "\n\n", nil},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseNmcliList(tt.out); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseNmcliList(%q) = %q, want %q", tt.out, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetworkManagerBackup(t *testing.T) {
+	stubCommands(t, map[string]string{
+		"nmcli -t -f DEVICE,STATE device":            "eth0:connected\nwlan0:connected\nlo:connected (externally)\np2p-dev-wlan0:disconnected\n",
+		"nmcli -g IP4.DNS,IP6.DNS device show eth0":  "192.168.1.1 | 1.1.1.1\nfe80\\:\\:1\n",
+		"nmcli -g IP4.DNS,IP6.DNS device show wlan0": "\n\n",
+	})
+
+	n := NewNetworkManager()
+	devices, err := n.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"eth0", "wlan0"}; !reflect.DeepEqual(devices, want) {
+		t.Fatalf("devices = %q, want %q", devices, want)
+	}
+
+	b, err := n.Backup(devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Entry{
+		"eth0":  {Servers: []string{"192.168.1.1", "1.1.1.1", "fe80::1"}},
+		"wlan0": {},
+	}
+	if b.Backend != BackendNetworkManager || !reflect.DeepEqual(b.Entries, want) {
+		t.Errorf("backup = %+v, want %+v", b, want)
+	}
+}
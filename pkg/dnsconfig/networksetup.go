@@ -0,0 +1,95 @@
+package dnsconfig
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Networksetup configures every enabled macOS network service (Wi-Fi,
+// Ethernet, USB and Thunderbolt adapters, ...) with networksetup(8)
+type Networksetup struct{}
+
+// NewNetworksetup creates the macOS backend
+func NewNetworksetup() *Networksetup {
+	return &Networksetup{}
+}
+
+// Name implements Configurator
+func (n *Networksetup) Name() string {
+	return BackendNetworksetup
+}
+
+// Interfaces implements Configurator
+func (n *Networksetup) Interfaces() ([]string, error) {
+	out, err := runCommand("networksetup", "-listallnetworkservices")
+	if err != nil {
+		return nil, err
+	}
+
+	var services []string
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		// Skip the "An asterisk (*) denotes..." header and disabled services
+		if line == "" || strings.HasPrefix(line, "*") || strings.HasPrefix(line, "An asterisk") {
+			continue
+		}
+		services = append(services, line)
+	}
+	return services, nil
+}
+
+// Backup implements Configurator
+func (n *Networksetup) Backup(services []string) (*Backup, error) {
+	b := &Backup{Backend: n.Name(), Entries: make(map[string]Entry)}
+	for _, service := range services {
+		out, err := runCommand("networksetup", "-getdnsservers", service)
+		if err != nil {
+			return nil, err
+		}
+		b.Entries[service] = Entry{Servers: parseNetworksetupServers(string(out))}
+	}
+	return b, nil
+}
+
+// Apply implements Configurator
+func (n *Networksetup) Apply(b *Backup, servers []string) error {
+	var errs []error
+	for service := range b.Entries {
+		args := append([]string{"-setdnsservers", service}, servers...)
+		if _, err := runCommand("networksetup", args...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Restore implements Configurator
+func (n *Networksetup) Restore(b *Backup) error {
+	var errs []error
+	for service, entry := range b.Entries {
+		servers := entry.Servers
+		if len(servers) == 0 {
+			servers = []string{"Empty"} // Back to the servers from DHCP
+		}
+		args := append([]string{"-setdnsservers", service}, servers...)
+		if _, err := runCommand("networksetup", args...); err != nil {
+			errs = append(errs, fmt.Errorf("restoring %s: %w", service, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parseNetworksetupServers parses the output of -getdnsservers, which is
+// one server per line or a sentence when none are set
+func parseNetworksetupServers(out string) []string {
+	var servers []string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.Contains(line, " ") {
+			continue // "There aren't any DNS Servers set on Wi-Fi."
+		}
+		servers = append(servers, line)
+	}
+	return servers
+}
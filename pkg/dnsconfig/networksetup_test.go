@@ -0,0 +1,54 @@
+package dnsconfig
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNetworksetupServers(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []string
+	}{
+		{"servers", "1.1.1.1\n8.8.8.8\n2606:4700:4700::1111\n", []string{"1.1.1.1", "8.8.8.8", "2606:4700:4700::1111"}},
+		{"none", "There aren't any DNS Servers set on Wi-Fi.\n", nil},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseNetworksetupServers(tt.out); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseNetworksetupServers(%q) = %q, want %q", tt.out, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetworksetupBackup(t *testing.T) {
+	stubCommands(t, map[string]string{
+		"networksetup -listallnetworkservices":           "An asterisk (*) denotes that a network service is disabled.\nWi-Fi\nThunderbolt Bridge\n*USB 10/100/1000 LAN\n",
+		"networksetup -getdnsservers Wi-Fi":              "1.1.1.1\n8.8.8.8\n",
+		"networksetup -getdnsservers Thunderbolt Bridge": "There aren't any DNS Servers set on Thunderbolt Bridge.\n",
+	})
+
+	n := NewNetworksetup()
+	services, err := n.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Wi-Fi", "Thunderbolt Bridge"}; !reflect.DeepEqual(services, want) {
+		t.Fatalf("services = %q, want %q", services, want)
+	}
+
+	b, err := n.Backup(services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Entry{
+		"Wi-Fi":              {Servers: []string{"1.1.1.1", "8.8.8.8"}},
+		"Thunderbolt Bridge": {},
+	}
+	if b.Backend != BackendNetworksetup || !reflect.DeepEqual(b.Entries, want) {
+		t.Errorf("backup = %+v, want %+v", b, want)
+	}
+}
@@ -0,0 +1,121 @@
+package dnsconfig
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lucastomic/fuckdopamine/pkg/atomicfile"
+)
+
+const resolvConfHeader = "# Generated by fuckdopamine, the original is restored when the daemon stops\n"
+
+// ResolvConf rewrites /etc/resolv.conf directly, for systems without a
+// network manager
+type ResolvConf struct {
+	path string
+}
+
+// NewResolvConf creates the resolv.conf backend for the system rooted at
+// root, normally "/"
+func NewResolvConf(root string) *ResolvConf {
+	return &ResolvConf{path: filepath.Join(root, "etc", "resolv.conf")}
+}
+
+// Name implements Configurator
+func (r *ResolvConf) Name() string {
+	return BackendResolvConf
+}
+
+// Interfaces implements Configurator, the only entry is the resolv.conf path
+func (r *ResolvConf) Interfaces() ([]string, error) {
+	return []string{r.path}, nil
+}
+
+// Backup implements Configurator
+func (r *ResolvConf) Backup(names []string) (*Backup, error) {
+	b := &Backup{Backend: r.Name(), Entries: make(map[string]Entry)}
+	for _, name := range names {
+		if name != r.path {
+			return nil, fmt.Errorf("unknown file %s, expected %s", name, r.path)
+		}
+	}
+	if len(names) == 0 {
+		return b, nil
+	}
+
+	entry := Entry{Mode: 0644}
+
+	// Distributions often link resolv.conf to a generated file, keep the link
+	if target, err := os.Readlink(r.path); err == nil {
+		entry.Symlink = target
+	}
+
+	data, err := os.ReadFile(r.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if info, err := os.Stat(r.path); err == nil {
+		entry.Mode = info.Mode().Perm()
+	}
+	entry.Content = string(data)
+	entry.Servers = parseNameservers(entry.Content)
+	b.Entries[r.path] = entry
+
+	return b, nil
+}
+
+// Apply implements Configurator. Search domains and options of the
+// original file are kept, only the nameservers are replaced.
+func (r *ResolvConf) Apply(b *Backup, servers []string) error {
+	entry, ok := b.Entries[r.path]
+	if !ok {
+		return fmt.Errorf("backup has no entry for %s", r.path)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(resolvConfHeader)
+	for _, s := range servers {
+		sb.WriteString("nameserver " + s + "\n")
+	}
+	for _, line := range strings.Split(entry.Content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == "nameserver" || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		sb.WriteString(strings.TrimSpace(line) + "\n")
+	}
+
+	return atomicfile.WriteFile(r.path, []byte(sb.String()), entry.Mode)
+}
+
+// Restore implements Configurator
+func (r *ResolvConf) Restore(b *Backup) error {
+	entry, ok := b.Entries[r.path]
+	if !ok {
+		return nil
+	}
+
+	if entry.Symlink != "" {
+		if err := os.Remove(r.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return os.Symlink(entry.Symlink, r.path)
+	}
+	return atomicfile.WriteFile(r.path, []byte(entry.Content), entry.Mode)
+}
+
+// parseNameservers returns the nameserver addresses in a resolv.conf file
+func parseNameservers(content string) []string {
+	var servers []string
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
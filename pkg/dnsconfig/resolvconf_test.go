@@ -0,0 +1,196 @@
+package dnsconfig
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const originalResolvConf = `# Written by the DHCP client
+nameserver 192.168.1.1
+nameserver 2001:db8::1
+search lan example.com
+options edns0 trust-ad
+; old style comment
+`
+
+// newTestRoot creates a system root with etc/resolv.conf holding content
+func newTestRoot(t *testing.T, content string, mode os.FileMode) (root, path string) {
+	t.Helper()
+	root = t.TempDir()
+	path = filepath.Join(root, "etc", "resolv.conf")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+	return root, path
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// checkApplied checks that path points at servers and kept the search domains and options
+func checkApplied(t *testing.T, path string, servers ...string) {
+	t.Helper()
+	content := readFile(t, path)
+	if !strings.HasPrefix(content, resolvConfHeader) {
+		t.Errorf("applied file doesn't start with the header:\n%s", content)
+	}
+	if got := parseNameservers(content); !reflect.DeepEqual(got, servers) {
+		t.Errorf("applied nameservers = %v, want %v", got, servers)
+	}
+	for _, line := range []string{"search lan example.com\n", "options edns0 trust-ad\n"} {
+		if !strings.Contains(content, line) {
+			t.Errorf("applied file lost %q:\n%s", line, content)
+		}
+	}
+	if strings.Contains(content, "DHCP") || strings.Contains(content, "old style") {
+		t.Errorf("applied file kept the original comments:\n%s", content)
+	}
+}
+
+func TestResolvConfRoundTrip(t *testing.T) {
+	root, path := newTestRoot(t, originalResolvConf, 0o640)
+	r := NewResolvConf(root)
+
+	names, err := r.Interfaces()
+	if err != nil || len(names) != 1 || names[0] != path {
+		t.Fatalf("Interfaces() = %v, %v, want [%s]", names, err, path)
+	}
+
+	b, err := r.Backup(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := b.Entries[path]
+	if b.Backend != BackendResolvConf || entry.Content != originalResolvConf || entry.Mode != 0o640 || entry.Symlink != "" {
+		t.Errorf("backup = %+v", b)
+	}
+	if want := []string{"192.168.1.1", "2001:db8::1"}; !reflect.DeepEqual(entry.Servers, want) {
+		t.Errorf("backed up servers = %v, want %v", entry.Servers, want)
+	}
+
+	if err := r.Apply(b, []string{"127.0.0.1", "::1"}); err != nil {
+		t.Fatal(err)
+	}
+	checkApplied(t, path, "127.0.0.1", "::1")
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("applied file mode = %v, %v, want 0640", info.Mode().Perm(), err)
+	}
+
+	// A second backup sees the daemon, which is how tampering is detected
+	current, err := r.Backup(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := current.Entries[path].Servers; !sameServers(got, []string{"::1", "127.0.0.1"}) {
+		t.Errorf("servers after apply = %v", got)
+	}
+
+	if err := r.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path); got != originalResolvConf {
+		t.Errorf("restored file =\n%s\nwant\n%s", got, originalResolvConf)
+	}
+}
+
+func TestResolvConfSymlink(t *testing.T) {
+	const stub = "nameserver 127.0.0.53\noptions edns0 trust-ad\nsearch lan example.com\n"
+	root := t.TempDir()
+	target := filepath.Join(root, "run", "systemd", "resolve", "stub-resolv.conf")
+	path := filepath.Join(root, "etc", "resolv.conf")
+	for _, dir := range []string{filepath.Dir(target), filepath.Dir(path)} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(target, []byte(stub), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	const link = "../run/systemd/resolve/stub-resolv.conf"
+	if err := os.Symlink(link, path); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewResolvConf(root)
+	b, err := r.Backup([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := b.Entries[path]; entry.Symlink != link || entry.Content != stub {
+		t.Errorf("backup of the link = %+v", entry)
+	}
+
+	if err := r.Apply(b, []string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	checkApplied(t, path, "127.0.0.1")
+	if info, err := os.Lstat(path); err != nil || info.Mode()&os.ModeSymlink != 0 {
+		t.Error("applied resolv.conf is still a link, the generated file would be overwritten")
+	}
+	if got := readFile(t, target); got != stub {
+		t.Errorf("link target changed to:\n%s", got)
+	}
+
+	if err := r.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.Readlink(path); err != nil || got != link {
+		t.Errorf("restored link = %q, %v, want %q", got, err, link)
+	}
+	if got := readFile(t, path); got != stub {
+		t.Errorf("restored file =\n%s\nwant\n%s", got, stub)
+	}
+}
+
+func TestResolvConfMissing(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	r := NewResolvConf(root)
+	names, _ := r.Interfaces()
+
+	b, err := r.Backup(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := b.Entries[names[0]]; entry.Content != "" || len(entry.Servers) != 0 || entry.Mode != 0o644 {
+		t.Errorf("backup of a missing file = %+v", entry)
+	}
+	if err := r.Apply(b, []string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := parseNameservers(readFile(t, names[0])); !reflect.DeepEqual(got, []string{"127.0.0.1"}) {
+		t.Errorf("nameservers = %v, want [127.0.0.1]", got)
+	}
+}
+
+func TestResolvConfErrors(t *testing.T) {
+	root, _ := newTestRoot(t, originalResolvConf, 0o644)
+	r := NewResolvConf(root)
+
+	if _, err := r.Backup([]string{"/etc/hosts"}); err == nil {
+		t.Error("Backup accepted a file other than resolv.conf")
+	}
+	if err := r.Apply(&Backup{Backend: BackendResolvConf}, []string{"127.0.0.1"}); err == nil {
+		t.Error("Apply accepted a backup without resolv.conf")
+	}
+	if err := r.Restore(&Backup{Backend: BackendResolvConf}); err != nil {
+		t.Errorf("Restore of an empty backup: %v", err)
+	}
+}
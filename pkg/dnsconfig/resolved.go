@@ -0,0 +1,117 @@
+package dnsconfig
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// netInterfaces lists the network interfaces, a variable so it can be stubbed
+var netInterfaces = net.Interfaces
+
+// Resolved configures systemd-resolved per link with resolvectl(1). Every
+// running link gets the daemon as its DNS server and the "~." routing
+// domain, so resolved sends every query to it.
+type Resolved struct{}
+
+// NewResolved creates the systemd-resolved backend
+func NewResolved() *Resolved {
+	return &Resolved{}
+}
+
+// Name implements Configurator
+func (r *Resolved) Name() string {
+	return BackendResolved
+}
+
+// Interfaces implements Configurator, returning the running non-loopback links
+func (r *Resolved) Interfaces() ([]string, error) {
+	ifaces, err := netInterfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var links []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagRunning == 0 {
+			continue
+		}
+		links = append(links, iface.Name)
+	}
+	return links, nil
+}
+
+// Backup implements Configurator
+func (r *Resolved) Backup(links []string) (*Backup, error) {
+	b := &Backup{Backend: r.Name(), Entries: make(map[string]Entry)}
+	for _, link := range links {
+		servers, err := resolvectlValues("dns", link)
+		if err != nil {
+			return nil, err
+		}
+		domains, err := resolvectlValues("domain", link)
+		if err != nil {
+			return nil, err
+		}
+		b.Entries[link] = Entry{Servers: servers, Domains: domains}
+	}
+	return b, nil
+}
+
+// Apply implements Configurator
+func (r *Resolved) Apply(b *Backup, servers []string) error {
+	var errs []error
+	for link := range b.Entries {
+		if _, err := runCommand("resolvectl", append([]string{"dns", link}, servers...)...); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := runCommand("resolvectl", "domain", link, "~."); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Restore implements Configurator
+func (r *Resolved) Restore(b *Backup) error {
+	var errs []error
+	for link, entry := range b.Entries {
+		if len(entry.Servers) == 0 && len(entry.Domains) == 0 {
+			if _, err := runCommand("resolvectl", "revert", link); err != nil {
+				errs = append(errs, fmt.Errorf("restoring %s: %w", link, err))
+			}
+			continue
+		}
+
+		// An empty argument clears the setting
+		servers, domains := entry.Servers, entry.Domains
+		if len(servers) == 0 {
+			servers = []string{""}
+		}
+		if len(domains) == 0 {
+			domains = []string{""}
+		}
+		if _, err := runCommand("resolvectl", append([]string{"dns", link}, servers...)...); err != nil {
+			errs = append(errs, fmt.Errorf("restoring %s: %w", link, err))
+		}
+		if _, err := runCommand("resolvectl", append([]string{"domain", link}, domains...)...); err != nil {
+			errs = append(errs, fmt.Errorf("restoring %s: %w", link, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resolvectlValues reads a per-link setting, printed as "Link 2 (eth0): value value"
+func resolvectlValues(setting, link string) ([]string, error) {
+	out, err := runCommand("resolvectl", setting, link)
+	if err != nil {
+		return nil, err
+	}
+	line := strings.TrimSpace(string(out))
+	if i := strings.Index(line, "):"); i >= 0 {
+		line = line[i+2:]
+	}
+	return strings.Fields(line), nil
+}
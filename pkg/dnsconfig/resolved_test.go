@@ -0,0 +1,60 @@
+package dnsconfig
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolvectlValues(t *testing.T) {
+	stubCommands(t, map[string]string{
+		"resolvectl dns eth0":     "Link 2 (eth0): 192.168.1.1 fe80::1%eth0\n",
+		"resolvectl dns wlan0":    "Link 3 (wlan0):\n",
+		"resolvectl domain eth0":  "Link 2 (eth0): ~. home.lan\n",
+		"resolvectl domain wlan0": "Link 3 (wlan0):\n",
+	})
+
+	tests := []struct {
+		setting, link string
+		want          []string
+	}{
+		{"dns", "eth0", []string{"192.168.1.1", "fe80::1%eth0"}},
+		{"dns", "wlan0", []string{}},
+		{"domain", "eth0", []string{"~.", "home.lan"}},
+		{"domain", "wlan0", []string{}},
+	}
+	for _, tt := range tests {
+		got, err := resolvectlValues(tt.setting, tt.link)
+		if err != nil {
+			t.Errorf("resolvectl %s %s: %v", tt.setting, tt.link, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("resolvectl %s %s = %q, want %q", tt.setting, tt.link, got, tt.want)
+		}
+	}
+
+	if _, err := resolvectlValues("dns", "eth1"); err == nil {
+		t.Error("no error from a failed resolvectl")
+	}
+}
+
+func TestResolvedBackup(t *testing.T) {
+	stubCommands(t, map[string]string{
+		"resolvectl dns eth0":     "Link 2 (eth0): 192.168.1.1\n",
+		"resolvectl dns wlan0":    "Link 3 (wlan0):\n",
+		"resolvectl domain eth0":  "Link 2 (eth0): home.lan\n",
+		"resolvectl domain wlan0": "Link 3 (wlan0):\n",
+	})
+
+	b, err := NewResolved().Backup([]string{"eth0", "wlan0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Entry{
+		"eth0":  {Servers: []string{"192.168.1.1"}, Domains: []string{"home.lan"}},
+		"wlan0": {Servers: []string{}, Domains: []string{}},
+	}
+	if b.Backend != BackendResolved || !reflect.DeepEqual(b.Entries, want) {
+		t.Errorf("backup = %+v, want %+v", b, want)
+	}
+}
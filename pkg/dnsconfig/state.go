@@ -0,0 +1,41 @@
+package dnsconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/lucastomic/fuckdopamine/pkg/atomicfile"
+)
+
+// SaveBackup writes b to path and syncs it to disk, so the original
+// settings survive a crash right after they are changed
+func SaveBackup(path string, b *Backup) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data, 0600)
+}
+
+// LoadBackup reads a backup written by SaveBackup
+func LoadBackup(path string) (*Backup, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var b Backup
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("invalid DNS state file %s: %w", path, err)
+	}
+	if b.Backend == "" {
+		return nil, fmt.Errorf("invalid DNS state file %s: no backend", path)
+	}
+	return &b, nil
+}
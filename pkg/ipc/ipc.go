@@ -2,27 +2,47 @@ package ipc
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
+	"strconv"
 	"time"
 
+	"github.com/lucastomic/fuckdopamine/pkg/blocklist"
+	"github.com/lucastomic/fuckdopamine/pkg/dnsconfig"
+	"github.com/lucastomic/fuckdopamine/pkg/matcher"
+	"github.com/lucastomic/fuckdopamine/pkg/schedule"
 	"github.com/lucastomic/fuckdopamine/pkg/stats"
+	"github.com/lucastomic/fuckdopamine/pkg/upstream"
 )
 
-const SocketPath = "/tmp/fuckdopamine.sock"
+// DefaultSocketPath is where the daemon listens unless configured otherwise
+const DefaultSocketPath = "/tmp/fuckdopamine.sock"
+
+// SocketPath is the socket SendRequest connects to
+var SocketPath = DefaultSocketPath
 
 // Request represents a client request
 type Request struct {
-	Type   string `json:"type"`             // "get_stats", "ping", "pause", "block", "unblock", "list_blocked"
-	Domain string `json:"domain,omitempty"` // Domain for block/unblock operations
+	Type   string `json:"type"`             // "get_stats", "ping", "pause", "resume", "extend", "block", "unblock", "list_blocked", "allow", "disallow", "list_groups", "enable_group", "disable_group", "quotas", "upstreams", "dns_status", "reload"
+	Domain string `json:"domain,omitempty"` // Domain for block/unblock/allow/disallow operations, optional for quotas, pause, resume and extend
+	Kind   string `json:"kind,omitempty"`   // Rule kind: "exact", "subtree", "glob" or "regex"
+	Group  string `json:"group,omitempty"`  // Group for enable_group/disable_group operations, optional for pause, resume and extend
+	Rule   string `json:"rule,omitempty"`   // Blocking rule to pause, resume or extend, as shown by list_blocked
+
+	Duration string `json:"duration,omitempty"` // Pause length or extension such as "15m", or a number of minutes, defaults to the configured length
+
+	Response string `json:"response,omitempty"` // Block response mode for block operations
 }
 
 // Response represents a server response
 type Response struct {
-	Type            string             `json:"type"` // "stats", "pong", "paused", "error"
+	Type            string             `json:"type"` // "stats", "pong", "paused", "resumed", "error"
 	TotalRequests   uint64             `json:"total_requests,omitempty"`
 	BlockedRequests uint64             `json:"blocked_requests,omitempty"`
 	AllowedRequests uint64             `json:"allowed_requests,omitempty"`
 	TopDomains      []stats.DomainInfo `json:"top_domains,omitempty"`
+	TopRules        []stats.RuleInfo   `json:"top_rules,omitempty"`
 	Uptime          string             `json:"uptime,omitempty"`
 	Error           string             `json:"error,omitempty"`
 
@@ -32,13 +52,50 @@ type Response struct {
 	PauseCount        uint64 `json:"pause_count,omitempty"`
 	TotalPauseTime    string `json:"total_pause_time,omitempty"`
 	TotalBlockingTime string `json:"total_blocking_time,omitempty"`
+	PauseBudget       string `json:"pause_budget,omitempty"` // What is left of the daily pause limits
+
+	// Pauses of a single domain, rule or group
+	ScopedPauses         []stats.ScopedPause `json:"scoped_pauses,omitempty"` // Running ones
+	ScopedPauseCount     uint64              `json:"scoped_pause_count,omitempty"`
+	TotalScopedPauseTime string              `json:"total_scoped_pause_time,omitempty"`
+
+	// Response cache
+	CacheHits   uint64 `json:"cache_hits,omitempty"`
+	CacheMisses uint64 `json:"cache_misses,omitempty"`
+
+	// Block page
+	BlockPageViews     uint64 `json:"block_page_views,omitempty"`
+	BlockPageHTTPSHits uint64 `json:"block_page_https_hits,omitempty"`
+
+	// Schedules, and when the next one turns on or off
+	Schedules          []schedule.Status `json:"schedules,omitempty"`
+	NextScheduleChange string            `json:"next_schedule_change,omitempty"`
+
+	// System DNS settings changed behind the daemon's back
+	TamperCount uint64             `json:"tamper_count,omitempty"`
+	LastTamper  *stats.TamperEvent `json:"last_tamper,omitempty"`
 
 	// Activity data for sparkline (last 60 seconds)
 	RecentActivity []float64 `json:"recent_activity,omitempty"`
 
 	// Blocked sites management
-	BlockedSites []string `json:"blocked_sites,omitempty"` // For list_blocked response
-	Message      string   `json:"message,omitempty"`       // Success/info message
+	BlockedSites []string           `json:"blocked_sites,omitempty"` // For list_blocked response
+	AllowedSites []string           `json:"allowed_sites,omitempty"` // For list_blocked response
+	Rules        []matcher.Rule     `json:"rules,omitempty"`         // For list_blocked response, with rule kinds and actions
+	Blocklists   []blocklist.Status `json:"blocklists,omitempty"`    // For list_blocked response, domain counts per external blocklist
+	Message      string             `json:"message,omitempty"`       // Success/info message
+
+	// Named groups of blocked sites
+	Groups []GroupInfo `json:"groups,omitempty"` // For list_groups response
+
+	// Daily quotas and how much of them is left
+	Quotas []stats.QuotaStatus `json:"quotas,omitempty"` // For quotas response
+
+	// Upstream resolver health
+	Upstreams []upstream.Status `json:"upstreams,omitempty"` // For upstreams response
+
+	// System DNS settings per network interface
+	Interfaces []dnsconfig.InterfaceStatus `json:"interfaces,omitempty"` // For dns_status response
 }
 
 // SendRequest sends a request to the daemon and returns the response
@@ -68,15 +125,54 @@ func SendRequest(req Request) (*Response, error) {
 	return &resp, nil
 }
 
+// GroupInfo describes a named group of blocking rules
+type GroupInfo struct {
+	Name    string   `json:"name"`
+	Enabled bool     `json:"enabled"`
+	Rules   []string `json:"rules"`
+}
+
 // BlockFuncs holds the functions for managing blocked sites
 type BlockFuncs struct {
-	Block       func(domain string) error    // Add a domain to block list
-	Unblock     func(domain string) error    // Remove a domain from block list
-	ListBlocked func() []string              // Get all blocked domains
+	Block       func(domain, kind, response string) error // Add a rule to block list
+	Unblock     func(domain, kind string) error           // Remove a rule from block list
+	ListBlocked func() []matcher.Rule                     // Get all blocking rules
+	Allow       func(domain, kind string) error           // Add an allowlist exception
+	Disallow    func(domain, kind string) error           // Remove an allowlist exception
+	ListAllowed func() []matcher.Rule                     // Get all allowlist exceptions
+
+	ListBlocklists func() []blocklist.Status // Get the state of the external blocklists
+
+	SetGroupEnabled func(name string, enabled bool) error // Turn a group of rules on or off
+	ListGroups      func() []GroupInfo                    // Get all groups
+
+	Quotas func(domain string) ([]stats.QuotaStatus, error) // Get the quota of a domain, or of every rule with one
+}
+
+// PauseFuncs holds the functions for pausing blocking
+type PauseFuncs struct {
+	IsPaused   func() bool
+	PauseUntil func() time.Time
+	Pause      func(d time.Duration) error // Pause for d, zero means the configured default
+	Budget     func() string               // Describe what is left of the daily pause limits
+
+	PauseScoped  func(scope, target string, d time.Duration) (time.Time, error) // Pause a "domain", "rule" or "group" for d, returns when it ends
+	ScopedPauses func() []stats.ScopedPause                                     // Get the running scoped pauses
+
+	Resume func(scope, target string) error                               // End a pause early, an empty scope is the pause of all blocking
+	Extend func(scope, target string, d time.Duration) (time.Time, error) // Make a pause last d longer, returns when it now ends
+}
+
+// DaemonFuncs holds the functions for inspecting and reloading the daemon
+type DaemonFuncs struct {
+	UpstreamStatus func() []upstream.Status           // Get the health of the upstream resolvers
+	DNSStatus      func() []dnsconfig.InterfaceStatus // Get the system DNS settings the daemon manages
+	ScheduleStatus func() []schedule.Status           // Get the state of the configured schedules
+	Reload         func() (string, error)             // Reload the config file, returns a summary of the changes
 }
 
 // HandleConnection handles a single IPC connection
-func HandleConnection(conn net.Conn, s *stats.Stats, blockedSites map[string]bool, isPausedFn func() bool, pauseUntilFn func() time.Time, pauseFn func(), getActivityFn func() []float64, blockFuncs BlockFuncs) {
+func HandleConnection(conn net.Conn, s *stats.Stats, blockLookup stats.BlockLookup, pauseFuncs PauseFuncs, getActivityFn func() []float64, blockFuncs BlockFuncs, daemonFuncs DaemonFuncs) {
 	defer conn.Close()
 
 	// Set deadline for operations
@@ -95,35 +191,125 @@ func HandleConnection(conn net.Conn, s *stats.Stats, blockedSites map[string]boo
 	switch req.Type {
 	case "get_stats":
 		total, blocked, allowed := s.GetCounts()
-		topDomains := s.GetTopDomains(10, blockedSites)
+		topDomains := s.GetTopDomains(10, blockLookup)
 		uptime := s.GetUptime()
 		pauseCount, totalPauseTime, totalBlockingTime := s.GetPauseStats()
+		cacheHits, cacheMisses := s.GetCacheStats()
+		blockPageViews, blockPageHTTPSHits := s.GetBlockPageStats()
+		tamperCount, lastTamper := s.GetTamperStats()
 
 		resp = Response{
-			Type:              "stats",
-			TotalRequests:     total,
-			BlockedRequests:   blocked,
-			AllowedRequests:   allowed,
-			TopDomains:        topDomains,
-			Uptime:            formatUptime(uptime),
-			IsPaused:          isPausedFn(),
-			PauseCount:        pauseCount,
-			TotalPauseTime:    formatDuration(totalPauseTime),
-			TotalBlockingTime: formatDuration(totalBlockingTime),
-			RecentActivity:    getActivityFn(),
+			Type:               "stats",
+			TotalRequests:      total,
+			BlockedRequests:    blocked,
+			AllowedRequests:    allowed,
+			TopDomains:         topDomains,
+			TopRules:           s.GetTopRules(10),
+			Uptime:             formatUptime(uptime),
+			IsPaused:           pauseFuncs.IsPaused(),
+			PauseCount:         pauseCount,
+			TotalPauseTime:     formatDuration(totalPauseTime),
+			TotalBlockingTime:  formatDuration(totalBlockingTime),
+			PauseBudget:        pauseFuncs.Budget(),
+			CacheHits:          cacheHits,
+			CacheMisses:        cacheMisses,
+			BlockPageViews:     blockPageViews,
+			BlockPageHTTPSHits: blockPageHTTPSHits,
+			TamperCount:        tamperCount,
+			LastTamper:         lastTamper,
+			RecentActivity:     getActivityFn(),
 		}
 
-		if isPausedFn() {
-			pauseUntil := pauseUntilFn()
-			resp.PauseEndsAt = pauseUntil.Format(time.RFC3339)
+		if resp.IsPaused {
+			resp.PauseEndsAt = pauseFuncs.PauseUntil().Format(time.RFC3339)
 		}
 
+		scopedCount, scopedTime := s.GetScopedPauseStats()
+		resp.ScopedPauses = pauseFuncs.ScopedPauses()
+		resp.ScopedPauseCount = scopedCount
+		resp.TotalScopedPauseTime = formatDuration(scopedTime)
+
+		resp.Schedules = daemonFuncs.ScheduleStatus()
+		resp.NextScheduleChange = nextChange(resp.Schedules)
+
 	case "pause":
-		pauseFn()
-		pauseUntil := pauseUntilFn()
+		d, err := parsePauseDuration(req.Duration)
+		if err != nil {
+			sendError(conn, err.Error())
+			return
+		}
+		scope, target, err := pauseTarget(req)
+		if err != nil {
+			sendError(conn, err.Error())
+			return
+		}
+		if scope == "" {
+			if err := pauseFuncs.Pause(d); err != nil {
+				sendError(conn, "pause denied: "+err.Error())
+				return
+			}
+			resp = Response{
+				Type:        "paused",
+				PauseEndsAt: pauseFuncs.PauseUntil().Format(time.RFC3339),
+				PauseBudget: pauseFuncs.Budget(),
+			}
+			break
+		}
+		until, err := pauseFuncs.PauseScoped(scope, target, d)
+		if err != nil {
+			sendError(conn, "pause denied: "+err.Error())
+			return
+		}
+		resp = Response{
+			Type:         "paused",
+			PauseEndsAt:  until.Format(time.RFC3339),
+			PauseBudget:  pauseFuncs.Budget(),
+			ScopedPauses: pauseFuncs.ScopedPauses(),
+			Message:      scope + " " + target + " is paused until " + until.Format("15:04"),
+		}
+
+	case "resume":
+		scope, target, err := pauseTarget(req)
+		if err != nil {
+			sendError(conn, err.Error())
+			return
+		}
+		if err := pauseFuncs.Resume(scope, target); err != nil {
+			sendError(conn, err.Error())
+			return
+		}
+		resp = Response{
+			Type:         "resumed",
+			Message:      "blocking has resumed",
+			PauseBudget:  pauseFuncs.Budget(),
+			ScopedPauses: pauseFuncs.ScopedPauses(),
+		}
+		if scope != "" {
+			resp.Message = scope + " " + target + " is blocked again"
+		}
+
+	case "extend":
+		d, err := parsePauseDuration(req.Duration)
+		if err != nil {
+			sendError(conn, err.Error())
+			return
+		}
+		scope, target, err := pauseTarget(req)
+		if err != nil {
+			sendError(conn, err.Error())
+			return
+		}
+		until, err := pauseFuncs.Extend(scope, target, d)
+		if err != nil {
+			sendError(conn, "extension denied: "+err.Error())
+			return
+		}
 		resp = Response{
-			Type:        "paused",
-			PauseEndsAt: pauseUntil.Format(time.RFC3339),
+			Type:         "paused",
+			PauseEndsAt:  until.Format(time.RFC3339),
+			PauseBudget:  pauseFuncs.Budget(),
+			ScopedPauses: pauseFuncs.ScopedPauses(),
+			Message:      "pause extended until " + until.Format("15:04"),
 		}
 
 	case "ping":
@@ -134,7 +320,7 @@ func HandleConnection(conn net.Conn, s *stats.Stats, blockedSites map[string]boo
 			sendError(conn, "domain is required")
 			return
 		}
-		if err := blockFuncs.Block(req.Domain); err != nil {
+		if err := blockFuncs.Block(req.Domain, req.Kind, req.Response); err != nil {
 			sendError(conn, err.Error())
 			return
 		}
@@ -148,7 +334,7 @@ func HandleConnection(conn net.Conn, s *stats.Stats, blockedSites map[string]boo
 			sendError(conn, "domain is required")
 			return
 		}
-		if err := blockFuncs.Unblock(req.Domain); err != nil {
+		if err := blockFuncs.Unblock(req.Domain, req.Kind); err != nil {
 			sendError(conn, err.Error())
 			return
 		}
@@ -157,10 +343,101 @@ func HandleConnection(conn net.Conn, s *stats.Stats, blockedSites map[string]boo
 			Message: req.Domain + " has been unblocked",
 		}
 
+	case "allow":
+		if req.Domain == "" {
+			sendError(conn, "domain is required")
+			return
+		}
+		if err := blockFuncs.Allow(req.Domain, req.Kind); err != nil {
+			sendError(conn, err.Error())
+			return
+		}
+		resp = Response{
+			Type:    "success",
+			Message: req.Domain + " has been allowed",
+		}
+
+	case "disallow":
+		if req.Domain == "" {
+			sendError(conn, "domain is required")
+			return
+		}
+		if err := blockFuncs.Disallow(req.Domain, req.Kind); err != nil {
+			sendError(conn, err.Error())
+			return
+		}
+		resp = Response{
+			Type:    "success",
+			Message: req.Domain + " is no longer allowed",
+		}
+
 	case "list_blocked":
+		blocked := blockFuncs.ListBlocked()
+		allowed := blockFuncs.ListAllowed()
 		resp = Response{
 			Type:         "blocked_list",
-			BlockedSites: blockFuncs.ListBlocked(),
+			BlockedSites: ruleStrings(blocked),
+			AllowedSites: ruleStrings(allowed),
+			Rules:        append(blocked, allowed...),
+			Blocklists:   blockFuncs.ListBlocklists(),
+		}
+
+	case "list_groups":
+		resp = Response{
+			Type:   "group_list",
+			Groups: blockFuncs.ListGroups(),
+		}
+
+	case "enable_group", "disable_group":
+		if req.Group == "" {
+			sendError(conn, "group is required")
+			return
+		}
+		enabled := req.Type == "enable_group"
+		if err := blockFuncs.SetGroupEnabled(req.Group, enabled); err != nil {
+			sendError(conn, err.Error())
+			return
+		}
+		resp = Response{
+			Type:    "success",
+			Message: "group " + req.Group + " has been disabled",
+		}
+		if enabled {
+			resp.Message = "group " + req.Group + " has been enabled"
+		}
+
+	case "quotas":
+		quotas, err := blockFuncs.Quotas(req.Domain)
+		if err != nil {
+			sendError(conn, err.Error())
+			return
+		}
+		resp = Response{
+			Type:   "quota_status",
+			Quotas: quotas,
+		}
+
+	case "upstreams":
+		resp = Response{
+			Type:      "upstream_status",
+			Upstreams: daemonFuncs.UpstreamStatus(),
+		}
+
+	case "reload":
+		summary, err := daemonFuncs.Reload()
+		if err != nil {
+			sendError(conn, "reload failed, keeping the current config: "+err.Error())
+			return
+		}
+		resp = Response{
+			Type:    "reloaded",
+			Message: summary,
+		}
+
+	case "dns_status":
+		resp = Response{
+			Type:       "dns_status",
+			Interfaces: daemonFuncs.DNSStatus(),
 		}
 
 	default:
@@ -173,6 +450,72 @@ func HandleConnection(conn net.Conn, s *stats.Stats, blockedSites map[string]boo
 	encoder.Encode(resp)
 }
 
+// pauseTarget returns what a pause, resume or extend request is about, an
+// empty scope for all blocking
+func pauseTarget(req Request) (scope, target string, err error) {
+	set := 0
+	for _, v := range []string{req.Domain, req.Rule, req.Group} {
+		if v != "" {
+			set++
+		}
+	}
+	switch {
+	case set > 1:
+		return "", "", errors.New("pause one of domain, rule or group at a time")
+	case req.Domain != "":
+		return "domain", req.Domain, nil
+	case req.Rule != "" && req.Kind != "":
+		return "rule", req.Kind + ":" + req.Rule, nil
+	case req.Rule != "":
+		return "rule", req.Rule, nil
+	case req.Group != "":
+		return "group", req.Group, nil
+	}
+	return "", "", nil
+}
+
+// parsePauseDuration parses the duration of a pause request, a plain
+// number is minutes and an empty string is zero
+func parsePauseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if n, errN := strconv.Atoi(s); errN == nil {
+		d, err = time.Duration(n)*time.Minute, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid pause duration %q, expected minutes or a duration such as 15m", s)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid pause duration %q, it must be positive", s)
+	}
+	return d, nil
+}
+
+// nextChange returns the earliest time any of the schedules turns on or off
+func nextChange(statuses []schedule.Status) string {
+	var next time.Time
+	for _, st := range statuses {
+		t, err := time.Parse(time.RFC3339, st.NextChange)
+		if err == nil && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	if next.IsZero() {
+		return ""
+	}
+	return next.Format(time.RFC3339)
+}
+
+func ruleStrings(rules []matcher.Rule) []string {
+	specs := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		specs = append(specs, rule.String())
+	}
+	return specs
+}
+
 func sendError(conn net.Conn, message string) {
 	resp := Response{Type: "error", Error: message}
 	encoder := json.NewEncoder(conn)
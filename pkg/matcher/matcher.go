@@ -0,0 +1,206 @@
+package matcher
+
+import (
+	"sort"
+	"strings"
+)
+
+// node is a trie node for a single domain label
+type node struct {
+	children map[string]*node
+	rules    []*Rule // Exact and subtree rules for this name
+}
+
+// Ruleset is an immutable set of rules. Exact and subtree rules are indexed
+// by a trie of reversed domain labels, so lookups cost O(labels) regardless
+// of the number of rules; glob and regex rules are checked one by one, most
+// specific first, until none of the rest can beat the best match.
+type Ruleset struct {
+	root     *node
+	patterns []*Rule // Glob and regex rules, most specific first
+	byKey    map[string]*Rule
+}
+
+// Scores of the rules covering a name, see Match. Domain rules score
+// scoreStep per label, so a rule with more labels always wins.
+const (
+	scoreStep    = 8
+	scoreExact   = 4  // Added for exact rules, which beat subtree rules at the same depth
+	scoreGlob    = -2 // Added for globs, which lose to domain rules with as many labels
+	scoreRegex   = 0  // Regexes lose to every other rule
+	scoreAllowed = 1  // Added for allow rules, which win ties
+)
+
+// score returns how specific rule is, depth being the labels of the name
+// it was found under for domain rules
+func (r *Rule) score(depth int) int {
+	switch r.Kind {
+	case KindExact:
+		return depth*scoreStep + scoreExact
+	case KindGlob:
+		return (strings.Count(r.Pattern, ".")+1)*scoreStep + scoreGlob
+	case KindRegex:
+		return scoreRegex
+	}
+	return depth * scoreStep
+}
+
+// NewRuleset builds a ruleset, rules that are duplicates of an earlier one are ignored
+func NewRuleset(rules []Rule) (*Ruleset, error) {
+	rs := &Ruleset{
+		root:  &node{},
+		byKey: make(map[string]*Rule, len(rules)),
+	}
+	for _, r := range rules {
+		rule := r
+		if err := rule.init(); err != nil {
+			return nil, err
+		}
+		key := rule.key()
+		if _, ok := rs.byKey[key]; ok {
+			continue
+		}
+		rs.byKey[key] = &rule
+		rs.insert(&rule)
+	}
+
+	sort.Slice(rs.patterns, func(i, j int) bool {
+		a, b := rs.patterns[i], rs.patterns[j]
+		if sa, sb := a.score(0), b.score(0); sa != sb {
+			return sa > sb
+		}
+		return a.key() < b.key()
+	})
+
+	return rs, nil
+}
+
+func (rs *Ruleset) insert(rule *Rule) {
+	if rule.Kind == KindGlob || rule.Kind == KindRegex {
+		rs.patterns = append(rs.patterns, rule)
+		return
+	}
+
+	n := rs.root
+	name := rule.Pattern
+	for name != "" {
+		i := strings.LastIndexByte(name, '.')
+		label := name[i+1:]
+		if n.children == nil {
+			n.children = make(map[string]*node)
+		}
+		child, ok := n.children[label]
+		if !ok {
+			child = &node{}
+			n.children[label] = child
+		}
+		n = child
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	n.rules = append(n.rules, rule)
+}
+
+// Match returns the most specific rule covering domain, or nil if none
+// does. Only rules for which active returns true are considered, a nil
+// active considers every rule.
+//
+// The most specific rule is the one with the most labels: deeper domain
+// rules beat shallower ones, and a glob such as "*.mail.google.com" beats
+// "google.com" but loses to "mail.google.com". At the same depth exact rules
+// beat subtree rules, which beat globs. Regexes are only used when nothing
+// else matches. On a tie allow rules win over block rules.
+func (rs *Ruleset) Match(domain string, active func(*Rule) bool) *Rule {
+	name := Normalize(domain)
+
+	var best *Rule
+	bestScore := -1
+	consider := func(rule *Rule, score int) {
+		if rule.Action == ActionAllow {
+			score += scoreAllowed
+		}
+		if score > bestScore && (active == nil || active(rule)) {
+			best, bestScore = rule, score
+		}
+	}
+
+	n := rs.root
+	rest := name
+	for depth := 1; rest != ""; depth++ {
+		i := strings.LastIndexByte(rest, '.')
+		child := n.children[rest[i+1:]]
+		if child == nil {
+			break
+		}
+		n = child
+		for _, rule := range n.rules {
+			// Exact rules only match the full name
+			if rule.Kind == KindSubtree || i < 0 {
+				consider(rule, rule.score(depth))
+			}
+		}
+		if i < 0 {
+			break
+		}
+		rest = rest[:i]
+	}
+
+	for _, rule := range rs.patterns {
+		score := rule.score(0)
+		if score+scoreAllowed <= bestScore {
+			break // Neither this rule nor any after it can win
+		}
+		if rule.matches(name) {
+			consider(rule, score)
+		}
+	}
+	return best
+}
+
+// Get returns the rule equal to rule, or nil
+func (rs *Ruleset) Get(rule Rule) *Rule {
+	return rs.byKey[rule.key()]
+}
+
+// Len returns the number of rules
+func (rs *Ruleset) Len() int {
+	return len(rs.byKey)
+}
+
+// Rules returns a copy of the rules with the given action sorted by
+// pattern, an empty action returns every rule
+func (rs *Ruleset) Rules(action Action) []Rule {
+	rules := make([]Rule, 0, len(rs.byKey))
+	for _, r := range rs.byKey {
+		if action == "" || r.Action == action {
+			rules = append(rules, *r)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Pattern != rules[j].Pattern {
+			return rules[i].Pattern < rules[j].Pattern
+		}
+		return rules[i].key() < rules[j].key()
+	})
+	return rules
+}
+
+// Without returns a new ruleset without rule
+func (rs *Ruleset) Without(rule Rule) (*Ruleset, error) {
+	key := rule.key()
+	rules := rs.Rules("")
+	kept := rules[:0]
+	for _, r := range rules {
+		if r.key() != key {
+			kept = append(kept, r)
+		}
+	}
+	return NewRuleset(kept)
+}
+
+// Normalize lowercases a domain and strips surrounding whitespace and the trailing dot
+func Normalize(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
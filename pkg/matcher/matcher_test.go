@@ -0,0 +1,296 @@
+package matcher
+
+import (
+	"fmt"
+	"testing"
+)
+
+func mustRuleset(t testing.TB, specs ...string) *Ruleset {
+	t.Helper()
+	var rules []Rule
+	for _, spec := range specs {
+		action := ActionBlock
+		if spec[0] == '!' {
+			action, spec = ActionAllow, spec[1:]
+		}
+		rule, err := ParseRule(spec)
+		if err != nil {
+			t.Fatalf("ParseRule(%q): %v", spec, err)
+		}
+		rule.Action = action
+		rules = append(rules, rule)
+	}
+	rs, err := NewRuleset(rules)
+	if err != nil {
+		t.Fatalf("NewRuleset: %v", err)
+	}
+	return rs
+}
+
+// describeMatch returns the matched rule as "action spec", or "" for no match
+func describeMatch(rule *Rule) string {
+	if rule == nil {
+		return ""
+	}
+	return string(rule.Action) + " " + rule.String()
+}
+
+func TestMatchPrecedence(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []string // A leading "!" makes an allow rule
+		domain string
+		want   string
+	}{
+		{
+			name:   "subtree covers subdomains",
+			rules:  []string{"youtube.com"},
+			domain: "m.youtube.com",
+			want:   "block youtube.com",
+		},
+		{
+			name:   "exact only covers the name itself",
+			rules:  []string{"exact:youtube.com"},
+			domain: "m.youtube.com",
+			want:   "",
+		},
+		{
+			name:   "exact beats subtree at the same depth",
+			rules:  []string{"!youtube.com", "exact:youtube.com"},
+			domain: "youtube.com",
+			want:   "block exact:youtube.com",
+		},
+		{
+			name:   "deeper subtree beats shallower exact",
+			rules:  []string{"exact:youtube.com", "!music.youtube.com"},
+			domain: "music.youtube.com",
+			want:   "allow music.youtube.com",
+		},
+		{
+			name:   "deeper subtree beats shallower subtree",
+			rules:  []string{"youtube.com", "!music.youtube.com"},
+			domain: "www.music.youtube.com",
+			want:   "allow music.youtube.com",
+		},
+		{
+			name:   "glob beats shallower subtree",
+			rules:  []string{"google.com", "!*.google.com"},
+			domain: "mail.google.com",
+			want:   "allow *.google.com",
+		},
+		{
+			name:   "glob beats shallower subtree in blocklists too",
+			rules:  []string{"!youtube.com", "*.youtube.com"},
+			domain: "www.youtube.com",
+			want:   "block *.youtube.com",
+		},
+		{
+			name:   "subtree beats glob at the same depth",
+			rules:  []string{"!*.google.com", "mail.google.com"},
+			domain: "mail.google.com",
+			want:   "block mail.google.com",
+		},
+		{
+			name:   "deeper subtree beats glob",
+			rules:  []string{"!*.google.com", "mail.google.com"},
+			domain: "inbox.mail.google.com",
+			want:   "block mail.google.com",
+		},
+		{
+			name:   "more specific glob wins",
+			rules:  []string{"*.google.com", "!*.mail.google.com"},
+			domain: "a.mail.google.com",
+			want:   "allow *.mail.google.com",
+		},
+		{
+			name:   "domain rule beats regex",
+			rules:  []string{`/youtube/`, "!youtube.com"},
+			domain: "www.youtube.com",
+			want:   "allow youtube.com",
+		},
+		{
+			name:   "glob beats regex",
+			rules:  []string{"!*.ytimg.com", `/ytimg/`},
+			domain: "i.ytimg.com",
+			want:   "allow *.ytimg.com",
+		},
+		{
+			name:   "regex used when nothing else matches",
+			rules:  []string{"youtube.com", `/^ads?\d*\./`},
+			domain: "ads2.example.com",
+			want:   `block /^ads?\d*\./`,
+		},
+		{
+			name:   "glob does not match the bare domain",
+			rules:  []string{"*.youtube.com"},
+			domain: "youtube.com",
+			want:   "",
+		},
+		{
+			name:   "unrelated domain",
+			rules:  []string{"youtube.com", "*.ytimg.com", `/tube/`},
+			domain: "example.org",
+			want:   "",
+		},
+		{
+			name:   "suffix without a label boundary",
+			rules:  []string{"tube.com"},
+			domain: "youtube.com",
+			want:   "",
+		},
+		{
+			name:   "query is normalized",
+			rules:  []string{"youtube.com"},
+			domain: " WWW.YouTube.COM. ",
+			want:   "block youtube.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := mustRuleset(t, tt.rules...)
+			if got := describeMatch(rs.Match(tt.domain, nil)); got != tt.want {
+				t.Errorf("Match(%q) = %q, want %q", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchAllowWinsTies(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []string
+		domain string
+	}{
+		{"subtree", []string{"youtube.com", "!youtube.com"}, "www.youtube.com"},
+		{"exact", []string{"exact:youtube.com", "!exact:youtube.com"}, "youtube.com"},
+		{"glob", []string{"*.youtube.com", "!*.youtube.com"}, "www.youtube.com"},
+		{"regex", []string{`/youtube/`, `!/youtube/`}, "www.youtube.com"},
+		{"glob and glob", []string{"*.youtube.com", "!www.*.com"}, "www.youtube.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Try both orders, the winner must not depend on insertion order
+			for _, rules := range [][]string{tt.rules, {tt.rules[1], tt.rules[0]}} {
+				rs := mustRuleset(t, rules...)
+				got := rs.Match(tt.domain, nil)
+				if got == nil || got.Action != ActionAllow {
+					t.Errorf("rules %q: Match(%q) = %q, want an allow rule", rules, tt.domain, describeMatch(got))
+				}
+			}
+		})
+	}
+}
+
+func TestMatchActive(t *testing.T) {
+	rs := mustRuleset(t, "youtube.com", "!music.youtube.com")
+	inactive := func(rule *Rule) bool { return rule.Action != ActionAllow }
+
+	if got := describeMatch(rs.Match("music.youtube.com", inactive)); got != "block youtube.com" {
+		t.Errorf("Match with the allow rule inactive = %q, want %q", got, "block youtube.com")
+	}
+	if got := rs.Match("youtube.com", func(*Rule) bool { return false }); got != nil {
+		t.Errorf("Match with no active rules = %q, want no match", describeMatch(got))
+	}
+}
+
+func TestIDNANormalization(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		pattern string
+		query   string
+	}{
+		{"unicode subtree", "bücher.de", "xn--bcher-kva.de", "www.xn--bcher-kva.de"},
+		{"unicode exact", "exact:Bücher.DE", "xn--bcher-kva.de", "XN--BCHER-KVA.DE."},
+		{"punycode kept", "xn--bcher-kva.de", "xn--bcher-kva.de", "xn--bcher-kva.de"},
+		{"unicode glob", "*.bücher.de", "*.xn--bcher-kva.de", "shop.xn--bcher-kva.de"},
+		{"unicode subdomain", "münchen.example.com", "xn--mnchen-3ya.example.com", "xn--mnchen-3ya.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := ParseRule(tt.spec)
+			if err != nil {
+				t.Fatalf("ParseRule(%q): %v", tt.spec, err)
+			}
+			if rule.Pattern != tt.pattern {
+				t.Errorf("pattern = %q, want %q", rule.Pattern, tt.pattern)
+			}
+			rs := mustRuleset(t, tt.spec)
+			if rs.Match(tt.query, nil) == nil {
+				t.Errorf("Match(%q) found no rule for %q", tt.query, tt.spec)
+			}
+		})
+	}
+
+	for _, spec := range []string{"xn--zz.de", "exact:xn--.com"} {
+		if _, err := ParseRule(spec); err == nil {
+			t.Errorf("ParseRule(%q) accepted invalid punycode", spec)
+		}
+	}
+}
+
+func TestNewRulesetDedup(t *testing.T) {
+	rs := mustRuleset(t, "youtube.com", "YouTube.com.", "subtree:youtube.com", "!youtube.com", "exact:youtube.com")
+	if got, want := rs.Len(), 3; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+}
+
+// benchmarkRuleset generates n rules, mostly subtree rules with a few
+// exact, glob and regex rules mixed in like in real blocklists
+func benchmarkRuleset(b *testing.B, n int) *Ruleset {
+	b.Helper()
+	rules := make([]Rule, 0, n)
+	for i := 0; i < n; i++ {
+		var rule Rule
+		var err error
+		switch {
+		case i%100_000 == 0:
+			rule, err = NewRule(KindGlob, fmt.Sprintf("*.cdn%d.example", i))
+		case i%250_000 == 1:
+			rule, err = NewRule(KindRegex, fmt.Sprintf(`^ads%d\.`, i))
+		case i%10 == 0:
+			rule, err = NewRule(KindExact, fmt.Sprintf("www.site%d.com", i))
+		default:
+			rule, err = NewRule(KindSubtree, fmt.Sprintf("site%d.tld%d", i, i%50))
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		if i%7 == 0 {
+			rule.Action = ActionAllow
+		}
+		rules = append(rules, rule)
+	}
+	rs, err := NewRuleset(rules)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return rs
+}
+
+func BenchmarkMatch(b *testing.B) {
+	rs := benchmarkRuleset(b, 1_000_000)
+
+	queries := []struct {
+		name   string
+		domain string
+	}{
+		{"subtree hit", "a.b.site123457.tld7"},
+		{"exact hit", "www.site500010.com"},
+		{"domain miss", "www.unlisted.example.org"},
+		{"glob fallback", "img.cdn400000.example"},
+	}
+
+	for _, q := range queries {
+		b.Run(q.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				rs.Match(q.domain, nil)
+			}
+		})
+	}
+}
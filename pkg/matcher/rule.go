@@ -0,0 +1,302 @@
+package matcher
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lucastomic/fuckdopamine/pkg/blockresponse"
+	"golang.org/x/net/idna"
+)
+
+// Kind is the way a rule's pattern is matched against a domain
+type Kind string
+
+const (
+	// KindExact matches only the domain itself
+	KindExact Kind = "exact"
+	// KindSubtree matches the domain and all of its subdomains
+	KindSubtree Kind = "subtree"
+	// KindGlob matches shell-style wildcards, e.g. "*.cdninstagram.com"
+	KindGlob Kind = "glob"
+	// KindRegex matches a regular expression, e.g. "^ads?\d*\."
+	KindRegex Kind = "regex"
+)
+
+func (k Kind) valid() bool {
+	switch k {
+	case KindExact, KindSubtree, KindGlob, KindRegex:
+		return true
+	}
+	return false
+}
+
+// Action is what happens to a domain matched by a rule
+type Action string
+
+const (
+	// ActionBlock blocks matching domains
+	ActionBlock Action = "block"
+	// ActionAllow exempts matching domains from less specific block rules
+	ActionAllow Action = "allow"
+)
+
+// Rule is a single blocking rule or allowlist exception
+type Rule struct {
+	Pattern string `json:"pattern"` // Domain without trailing dot, glob or regex
+	Kind    Kind   `json:"kind"`
+	Action  Action `json:"action"`
+
+	// Response overrides the global block response for this rule
+	Response *blockresponse.Policy `json:"response,omitempty"`
+
+	// Source is the name of the blocklist the rule was imported from, empty
+	// for rules from the config file. It isn't part of the rule's identity.
+	Source string `json:"source,omitempty"`
+
+	// Group is the name of the config group the rule belongs to, empty for
+	// rules outside any group. The same pattern can be in several groups.
+	Group string `json:"group,omitempty"`
+
+	// Schedule is the name of the schedule the rule is limited to, empty
+	// for rules that always apply
+	Schedule string `json:"schedule,omitempty"`
+
+	// Quota lets matching domains through until a daily budget is used up,
+	// nil blocks them outright. It isn't part of the rule's identity.
+	Quota *Quota `json:"quota,omitempty"`
+
+	re     *regexp.Regexp
+	suffix string // Literal end of a glob, names without it can't match
+	valid  bool   // Set once init succeeded, so rebuilding a ruleset doesn't revalidate
+}
+
+// Quota is a daily budget for a block rule, whichever limit runs out first
+// applies. Zero limits are unlimited.
+type Quota struct {
+	Minutes int    `json:"minutes,omitempty"` // Minutes with at least one query
+	Queries uint64 `json:"queries,omitempty"`
+}
+
+// ParseRule parses a rule as written in the config file or sent over IPC.
+// The kind can be given explicitly as a prefix ("exact:www.youtube.com",
+// "subtree:", "glob:", "regex:"), otherwise it is inferred: "/.../" is a
+// regex, patterns containing wildcards are globs and anything else is a
+// subtree rule.
+func ParseRule(spec string) (Rule, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return Rule{}, errors.New("rule cannot be empty")
+	}
+
+	if i := strings.IndexByte(spec, ':'); i > 0 {
+		if kind := Kind(strings.ToLower(spec[:i])); kind.valid() {
+			return NewRule(kind, spec[i+1:])
+		}
+	}
+
+	switch {
+	case len(spec) > 2 && spec[0] == '/' && spec[len(spec)-1] == '/':
+		return NewRule(KindRegex, spec[1:len(spec)-1])
+	case strings.ContainsAny(spec, "*?["):
+		return NewRule(KindGlob, spec)
+	default:
+		return NewRule(KindSubtree, spec)
+	}
+}
+
+// ParseRules parses every spec as a rule with the given action, returning
+// the valid rules and an error describing each invalid one
+func ParseRules(specs []string, action Action) ([]Rule, error) {
+	rules := make([]Rule, 0, len(specs))
+	var errs []error
+	for _, spec := range specs {
+		rule, err := ParseRule(spec)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%q: %w", spec, err))
+			continue
+		}
+		rule.Action = action
+		rules = append(rules, rule)
+	}
+	return rules, errors.Join(errs...)
+}
+
+// NewRule validates pattern for the given kind, an empty kind means KindSubtree
+func NewRule(kind Kind, pattern string) (Rule, error) {
+	r := Rule{Kind: Kind(strings.ToLower(string(kind))), Pattern: pattern}
+	if err := r.init(); err != nil {
+		return Rule{}, err
+	}
+	return r, nil
+}
+
+// init normalizes and validates the rule and compiles its pattern
+func (r *Rule) init() error {
+	if r.valid {
+		return nil
+	}
+	if r.Kind == "" {
+		r.Kind = KindSubtree
+	}
+	switch r.Action {
+	case "":
+		r.Action = ActionBlock
+	case ActionBlock, ActionAllow:
+	default:
+		return fmt.Errorf("unknown rule action %q (expected block or allow)", r.Action)
+	}
+
+	switch r.Kind {
+	case KindExact, KindSubtree:
+		pattern, err := toASCII(Normalize(r.Pattern))
+		if err != nil {
+			return err
+		}
+		if err := validateDomain(pattern); err != nil {
+			return err
+		}
+		r.Pattern = pattern
+
+	case KindGlob:
+		pattern, err := toASCII(Normalize(r.Pattern))
+		if err != nil {
+			return err
+		}
+		r.Pattern = pattern
+		if r.Pattern == "" {
+			return errors.New("glob cannot be empty")
+		}
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", r.Pattern, err)
+		}
+		r.suffix = r.Pattern[strings.LastIndexAny(r.Pattern, `*?]\`)+1:]
+
+	case KindRegex:
+		r.Pattern = strings.TrimSpace(r.Pattern)
+		if r.Pattern == "" {
+			return errors.New("regex cannot be empty")
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid regex %q: %w", r.Pattern, err)
+		}
+		r.re = re
+
+	default:
+		return fmt.Errorf("unknown rule kind %q (expected exact, subtree, glob or regex)", r.Kind)
+	}
+
+	r.valid = true
+	return nil
+}
+
+// matches reports whether a pattern rule matches the normalized name
+func (r *Rule) matches(name string) bool {
+	switch r.Kind {
+	case KindGlob:
+		if !strings.HasSuffix(name, r.suffix) {
+			return false
+		}
+		ok, _ := path.Match(r.Pattern, name)
+		return ok
+	case KindRegex:
+		return r.re.MatchString(name)
+	}
+	return false
+}
+
+// String returns the shortest form of the rule that ParseRule reads back as the same rule
+func (r Rule) String() string {
+	switch r.Kind {
+	case KindExact:
+		return "exact:" + r.Pattern
+	case KindGlob:
+		if strings.ContainsAny(r.Pattern, "*?[") {
+			return r.Pattern
+		}
+		return "glob:" + r.Pattern
+	case KindRegex:
+		return "/" + r.Pattern + "/"
+	default:
+		return r.Pattern
+	}
+}
+
+// key identifies the rule within a ruleset
+func (r Rule) key() string {
+	key := string(r.Action) + " " + r.String()
+	if r.Group != "" {
+		key += " @" + r.Group
+	}
+	if r.Schedule != "" {
+		key += " %" + r.Schedule
+	}
+	return key
+}
+
+// validateDomain checks that name is a plausible domain name
+func validateDomain(name string) error {
+	switch {
+	case name == "":
+		return errors.New("domain cannot be empty")
+	case strings.Contains(name, "://") || strings.Contains(name, "/"):
+		if host := urlHost(name); host != "" {
+			return fmt.Errorf("%q is a URL, use just the domain name %q", name, host)
+		}
+		return fmt.Errorf("%q is a URL, use just the domain name", name)
+	case len(name) > 253:
+		return fmt.Errorf("%q is longer than 253 characters", name)
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return fmt.Errorf("%q contains an empty label", name)
+		}
+		if len(label) > 63 {
+			return fmt.Errorf("label %q in %q is longer than 63 characters", label, name)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("%q contains invalid character %q", name, c)
+			}
+		}
+	}
+
+	return nil
+}
+
+// urlHost returns the host of a URL such as "https://reddit.com/r/all", or ""
+func urlHost(s string) string {
+	if !strings.Contains(s, "://") {
+		s = "//" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	return Normalize(u.Hostname())
+}
+
+// toASCII converts internationalized labels to the punycode form queries
+// use ("bücher.de" becomes "xn--bcher-kva.de") and checks that punycode
+// labels are valid. Other labels are left alone, so globs and names with
+// underscores keep working.
+func toASCII(name string) (string, error) {
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if !strings.HasPrefix(label, "xn--") && utf8.ValidString(label) && len(label) == utf8.RuneCountInString(label) {
+			continue
+		}
+		ascii, err := idna.Lookup.ToASCII(label)
+		if err != nil {
+			return "", fmt.Errorf("invalid internationalized label %q in %q: %w", label, name, err)
+		}
+		labels[i] = ascii
+	}
+	return strings.Join(labels, "."), nil
+}
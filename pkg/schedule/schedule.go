@@ -0,0 +1,204 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minutesPerDay is the end of a window lasting until midnight, "24:00"
+const minutesPerDay = 24 * 60
+
+// Window is a daily time range on some days of the week. Windows whose
+// end is before their start run overnight and belong to the day they start.
+type Window struct {
+	Days  [7]bool // Indexed by time.Weekday
+	Start int     // Minutes since midnight
+	End   int     // Minutes since midnight, up to 24:00
+}
+
+// ParseWindow parses a window such as ["mon", "tue"] "09:00" "18:00". Days
+// are weekday names, full or abbreviated, "weekdays" or "weekends"; no days
+// means every day.
+func ParseWindow(days []string, start, end string) (Window, error) {
+	var w Window
+	var err error
+	if w.Start, err = parseClock(start); err != nil {
+		return Window{}, fmt.Errorf("start: %w", err)
+	}
+	if w.Start == minutesPerDay {
+		return Window{}, errors.New("start: must be before 24:00")
+	}
+	if w.End, err = parseClock(end); err != nil {
+		return Window{}, fmt.Errorf("end: %w", err)
+	}
+	if w.Start == w.End {
+		return Window{}, errors.New("start and end are the same, use 00:00 to 24:00 for a whole day")
+	}
+
+	if len(days) == 0 {
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+	}
+	for _, day := range days {
+		if err := w.addDay(day); err != nil {
+			return Window{}, err
+		}
+	}
+	return w, nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight
+func parseClock(s string) (int, error) {
+	hh, mm, ok := strings.Cut(strings.TrimSpace(s), ":")
+	h, errH := strconv.Atoi(hh)
+	m, errM := strconv.Atoi(mm)
+	if !ok || errH != nil || errM != nil || len(mm) != 2 || h < 0 || m < 0 || m > 59 || h*60+m > minutesPerDay {
+		return 0, fmt.Errorf("%q is not a time of day, expected HH:MM such as 09:00", s)
+	}
+	return h*60 + m, nil
+}
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+func (w *Window) addDay(day string) error {
+	switch name := strings.ToLower(strings.TrimSpace(day)); name {
+	case "weekdays":
+		for d := time.Monday; d <= time.Friday; d++ {
+			w.Days[d] = true
+		}
+	case "weekends":
+		w.Days[time.Saturday], w.Days[time.Sunday] = true, true
+	default:
+		d, ok := dayNames[name]
+		if !ok {
+			return fmt.Errorf("unknown day %q (expected mon, tue, wed, thu, fri, sat, sun, weekdays or weekends)", day)
+		}
+		w.Days[d] = true
+	}
+	return nil
+}
+
+// overnight reports whether the window ends on the day after it starts
+func (w Window) overnight() bool {
+	return w.End < w.Start
+}
+
+// Schedule is a named set of weekly windows in a time zone
+type Schedule struct {
+	Name     string
+	Location *time.Location
+	Windows  []Window
+}
+
+// LoadLocation returns the time zone with the given IANA name, an empty
+// name means the system time zone
+func LoadLocation(timezone string) (*time.Location, error) {
+	if timezone == "" || timezone == "Local" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", timezone)
+	}
+	return loc, nil
+}
+
+// New creates a schedule, an empty timezone means the system time zone
+func New(name, timezone string, windows []Window) (*Schedule, error) {
+	loc, err := LoadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+	if len(windows) == 0 {
+		return nil, errors.New("a schedule needs at least one window")
+	}
+	return &Schedule{Name: name, Location: loc, Windows: windows}, nil
+}
+
+// Active reports whether t falls in one of the schedule's windows
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.Location)
+	day := t.Weekday()
+	yesterday := (day + 6) % 7
+	minute := t.Hour()*60 + t.Minute()
+
+	for _, w := range s.Windows {
+		switch {
+		case !w.overnight():
+			if w.Days[day] && minute >= w.Start && minute < w.End {
+				return true
+			}
+		case w.Days[day] && minute >= w.Start:
+			return true
+		case w.Days[yesterday] && minute < w.End:
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns when the schedule next turns on or off after t, or the zero
+// time if it never changes
+func (s *Schedule) Next(t time.Time) time.Time {
+	local := t.In(s.Location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, s.Location)
+
+	// Every window starts and ends within the week after yesterday
+	var boundaries []time.Time
+	for offset := -1; offset <= 8; offset++ {
+		day := midnight.AddDate(0, 0, offset)
+		for _, w := range s.Windows {
+			if !w.Days[day.Weekday()] {
+				continue
+			}
+			end := w.End
+			if w.overnight() {
+				end += minutesPerDay
+			}
+			for _, m := range []int{w.Start, end} {
+				at := time.Date(day.Year(), day.Month(), day.Day(), 0, m, 0, 0, s.Location)
+				if at.After(t) {
+					boundaries = append(boundaries, at)
+				}
+			}
+		}
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i].Before(boundaries[j]) })
+
+	active := s.Active(t)
+	for _, at := range boundaries {
+		if s.Active(at) != active {
+			return at
+		}
+	}
+	return time.Time{}
+}
+
+// Status is the state of a schedule at some point in time
+type Status struct {
+	Name       string `json:"name"`
+	Active     bool   `json:"active"`
+	NextChange string `json:"next_change,omitempty"` // When it next turns on or off, RFC 3339
+}
+
+// StatusAt returns the state of s at t
+func (s *Schedule) StatusAt(t time.Time) Status {
+	st := Status{Name: s.Name, Active: s.Active(t)}
+	if next := s.Next(t); !next.IsZero() {
+		st.NextChange = next.Format(time.RFC3339)
+	}
+	return st
+}
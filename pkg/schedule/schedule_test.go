@@ -0,0 +1,214 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+// 2024-01-01 is a Monday
+func at(t *testing.T, loc *time.Location, day, hour, minute int) time.Time {
+	t.Helper()
+	return time.Date(2024, time.January, day, hour, minute, 0, 0, loc)
+}
+
+func mustWindow(t *testing.T, days []string, start, end string) Window {
+	t.Helper()
+	w, err := ParseWindow(days, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func mustSchedule(t *testing.T, timezone string, windows ...Window) *Schedule {
+	t.Helper()
+	s, err := New("test", timezone, windows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestParseWindow(t *testing.T) {
+	weekdays := [7]bool{time.Monday: true, time.Tuesday: true, time.Wednesday: true, time.Thursday: true, time.Friday: true}
+	everyDay := [7]bool{true, true, true, true, true, true, true}
+
+	tests := []struct {
+		name       string
+		days       []string
+		start, end string
+		want       Window
+		wantErr    bool
+	}{
+		{"weekdays", []string{"weekdays"}, "09:00", "17:30", Window{Days: weekdays, Start: 9 * 60, End: 17*60 + 30}, false},
+		{"no days is every day", nil, "00:00", "24:00", Window{Days: everyDay, Start: 0, End: 24 * 60}, false},
+		{"names and case", []string{"Monday", " sat ", "SUN"}, "22:00", "06:00",
+			Window{Days: [7]bool{time.Sunday: true, time.Monday: true, time.Saturday: true}, Start: 22 * 60, End: 6 * 60}, false},
+		{"weekends", []string{"weekends"}, "10:00", "12:00", Window{Days: [7]bool{time.Sunday: true, time.Saturday: true}, Start: 10 * 60, End: 12 * 60}, false},
+		{"unknown day", []string{"someday"}, "09:00", "17:00", Window{}, true},
+		{"same start and end", nil, "09:00", "09:00", Window{}, true},
+		{"start at 24:00", nil, "24:00", "06:00", Window{}, true},
+		{"past 24:00", nil, "09:00", "24:01", Window{}, true},
+		{"bad minutes", nil, "09:60", "10:00", Window{}, true},
+		{"single digit minutes", nil, "9:0", "10:00", Window{}, true},
+		{"no colon", nil, "0900", "10:00", Window{}, true},
+		{"negative", nil, "-1:00", "10:00", Window{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseWindow(tt.days, tt.start, tt.end)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseWindow accepted %v %s-%s", tt.days, tt.start, tt.end)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseWindow = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestActive(t *testing.T) {
+	utc := time.UTC
+	office := mustWindow(t, []string{"weekdays"}, "09:00", "17:00")
+	// Friday and Saturday nights, ending the next morning
+	lateNights := mustWindow(t, []string{"fri", "sat"}, "22:00", "06:00")
+	untilMidnight := mustWindow(t, []string{"sun"}, "20:00", "24:00")
+
+	tests := []struct {
+		name    string
+		windows []Window
+		at      time.Time
+		want    bool
+	}{
+		{"inside", []Window{office}, at(t, utc, 1, 12, 0), true},
+		{"at the start", []Window{office}, at(t, utc, 1, 9, 0), true},
+		{"at the end", []Window{office}, at(t, utc, 1, 17, 0), false},
+		{"before", []Window{office}, at(t, utc, 1, 8, 59), false},
+		{"other day", []Window{office}, at(t, utc, 6, 12, 0), false},
+
+		{"overnight evening", []Window{lateNights}, at(t, utc, 5, 23, 0), true},
+		{"overnight morning after", []Window{lateNights}, at(t, utc, 6, 5, 59), true},
+		{"overnight end", []Window{lateNights}, at(t, utc, 6, 6, 0), false},
+		{"overnight second night", []Window{lateNights}, at(t, utc, 7, 3, 0), true},
+		{"overnight doesn't run into sunday night", []Window{lateNights}, at(t, utc, 7, 23, 0), false},
+		{"overnight morning without the night before", []Window{lateNights}, at(t, utc, 5, 3, 0), false},
+		{"overnight from saturday into monday isn't", []Window{lateNights}, at(t, utc, 8, 3, 0), false},
+
+		// Sunday is day 0, the window of Saturday night wraps around the week
+		{"week rollover", []Window{mustWindow(t, []string{"sat"}, "23:00", "01:00")}, at(t, utc, 7, 0, 30), true},
+		{"until midnight", []Window{untilMidnight}, at(t, utc, 7, 23, 59), true},
+		{"after midnight", []Window{untilMidnight}, at(t, utc, 8, 0, 0), false},
+		{"any window", []Window{office, lateNights}, at(t, utc, 6, 2, 0), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := mustSchedule(t, "UTC", tt.windows...)
+			if got := s.Active(tt.at); got != tt.want {
+				t.Errorf("Active(%s) = %v, want %v", tt.at.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	utc := time.UTC
+	office := mustWindow(t, []string{"weekdays"}, "09:00", "17:00")
+	lateNights := mustWindow(t, []string{"fri", "sat"}, "22:00", "06:00")
+
+	tests := []struct {
+		name    string
+		windows []Window
+		at      time.Time
+		want    time.Time
+	}{
+		{"turns off at the end", []Window{office}, at(t, utc, 1, 12, 0), at(t, utc, 1, 17, 0)},
+		{"turns on the next morning", []Window{office}, at(t, utc, 1, 17, 0), at(t, utc, 2, 9, 0)},
+		{"skips the weekend", []Window{office}, at(t, utc, 5, 18, 0), at(t, utc, 8, 9, 0)},
+		{"strictly after", []Window{office}, at(t, utc, 2, 9, 0), at(t, utc, 2, 17, 0)},
+		{"overnight ends the next morning", []Window{lateNights}, at(t, utc, 5, 23, 0), at(t, utc, 6, 6, 0)},
+		{"back to back nights", []Window{lateNights}, at(t, utc, 6, 6, 0), at(t, utc, 6, 22, 0)},
+		{"next week", []Window{lateNights}, at(t, utc, 7, 6, 0), at(t, utc, 12, 22, 0)},
+		// Adjacent windows don't change anything where they meet
+		{"adjacent windows", []Window{
+			mustWindow(t, nil, "09:00", "12:00"),
+			mustWindow(t, nil, "12:00", "17:00"),
+		}, at(t, utc, 1, 10, 0), at(t, utc, 1, 17, 0)},
+		{"always on", []Window{mustWindow(t, nil, "00:00", "24:00")}, at(t, utc, 1, 10, 0), time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := mustSchedule(t, "UTC", tt.windows...)
+			if got := s.Next(tt.at); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.at.Format("Mon Jan 2 15:04"), got.Format("Mon Jan 2 15:04"), tt.want.Format("Mon Jan 2 15:04"))
+			}
+		})
+	}
+}
+
+func TestTimezone(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone database not available: %v", err)
+	}
+	s := mustSchedule(t, "America/New_York", mustWindow(t, []string{"weekdays"}, "09:00", "17:00"))
+
+	// 14:30 UTC is 09:30 in New York in winter
+	if !s.Active(time.Date(2024, time.January, 2, 14, 30, 0, 0, time.UTC)) {
+		t.Error("schedule not active at 09:30 New York time")
+	}
+	if s.Active(time.Date(2024, time.January, 2, 9, 30, 0, 0, time.UTC)) {
+		t.Error("schedule active at 09:30 UTC, which is 04:30 in New York")
+	}
+
+	// Clocks go forward on Sunday 2024-03-10, the window still starts at
+	// 09:00 local time on Monday, one hour earlier in UTC than the week before
+	friday := time.Date(2024, time.March, 8, 18, 0, 0, 0, ny)
+	want := time.Date(2024, time.March, 11, 13, 0, 0, 0, time.UTC)
+	if got := s.Next(friday); !got.Equal(want) {
+		t.Errorf("Next over the DST change = %s, want %s", got.UTC(), want)
+	}
+	if !s.Active(want) || s.Active(want.Add(-time.Minute)) {
+		t.Error("schedule doesn't turn on at 09:00 EDT")
+	}
+
+	// And back on Sunday 2024-11-03
+	friday = time.Date(2024, time.November, 1, 18, 0, 0, 0, ny)
+	want = time.Date(2024, time.November, 4, 14, 0, 0, 0, time.UTC)
+	if got := s.Next(friday); !got.Equal(want) {
+		t.Errorf("Next over the DST change = %s, want %s", got.UTC(), want)
+	}
+
+	if _, err := New("bad", "Mars/Olympus_Mons", []Window{mustWindow(t, nil, "09:00", "17:00")}); err == nil {
+		t.Error("New accepted an unknown time zone")
+	}
+	if _, err := New("empty", "UTC", nil); err == nil {
+		t.Error("New accepted a schedule without windows")
+	}
+}
+
+func TestStatusAt(t *testing.T) {
+	s := mustSchedule(t, "UTC", mustWindow(t, []string{"weekdays"}, "09:00", "17:00"))
+
+	st := s.StatusAt(at(t, time.UTC, 1, 12, 0))
+	if st.Name != "test" || !st.Active || st.NextChange != "2024-01-01T17:00:00Z" {
+		t.Errorf("StatusAt(Mon 12:00) = %+v", st)
+	}
+	st = s.StatusAt(at(t, time.UTC, 6, 12, 0))
+	if st.Active || st.NextChange != "2024-01-08T09:00:00Z" {
+		t.Errorf("StatusAt(Sat 12:00) = %+v", st)
+	}
+
+	always := mustSchedule(t, "UTC", mustWindow(t, nil, "00:00", "24:00"))
+	if st := always.StatusAt(at(t, time.UTC, 1, 12, 0)); !st.Active || st.NextChange != "" {
+		t.Errorf("StatusAt of a schedule that never changes = %+v", st)
+	}
+}
@@ -2,10 +2,14 @@ package stats
 
 import (
 	"encoding/json"
-	"os"
+	"errors"
+	"io/fs"
+	"log"
 	"sort"
 	"sync"
 	"time"
+
+	"github.com/lucastomic/fuckdopamine/pkg/atomicfile"
 )
 
 // Stats holds all DNS request statistics
@@ -15,12 +19,85 @@ type Stats struct {
 	BlockedRequests uint64            `json:"blocked_requests"`
 	AllowedRequests uint64            `json:"allowed_requests"`
 	DomainCounts    map[string]uint64 `json:"domain_counts"`
+	RuleCounts      map[string]uint64 `json:"rule_counts"` // Blocked requests per matching rule
 	StartTime       time.Time         `json:"start_time"`
 
 	// Pause tracking
-	PauseCount       uint64        `json:"pause_count"`
-	TotalPauseTime   time.Duration `json:"total_pause_time"`
-	pauseStartTime   time.Time     // Internal: when current pause started
+	PauseCount     uint64        `json:"pause_count"`
+	TotalPauseTime time.Duration `json:"total_pause_time"`
+	pauseStartTime time.Time     // Internal: when current pause started
+	PauseUsage     *PauseUsage   `json:"pause_usage,omitempty"` // Pauses of the current day, for the daily limits
+
+	// Pauses of a single domain, rule or group, keyed by scope such as "group:social"
+	ScopedPauseCount     uint64               `json:"scoped_pause_count"`
+	TotalScopedPauseTime time.Duration        `json:"total_scoped_pause_time"`
+	ScopedPauseCounts    map[string]uint64    `json:"scoped_pause_counts,omitempty"`
+	scopedPauseStarts    map[string]time.Time // Internal: when each current scoped pause started
+
+	// Response cache
+	CacheHits   uint64 `json:"cache_hits"`
+	CacheMisses uint64 `json:"cache_misses"`
+
+	// Block page
+	BlockPageViews     uint64 `json:"block_page_views"`      // Blocked sites opened over HTTP
+	BlockPageHTTPSHits uint64 `json:"block_page_https_hits"` // Blocked sites opened over HTTPS, which can't show the page
+
+	// System DNS settings changed behind the daemon's back
+	TamperCount  uint64        `json:"tamper_count"`
+	TamperEvents []TamperEvent `json:"tamper_events,omitempty"` // Most recent events, oldest first
+
+	// Daily quotas used per rule
+	QuotaUsage map[string]*QuotaUsage `json:"quota_usage,omitempty"`
+}
+
+// QuotaUsage is how much of a rule's daily quota has been used
+type QuotaUsage struct {
+	Period        time.Time `json:"period"` // Start of the day the usage counts towards
+	Queries       uint64    `json:"queries"`
+	ActiveMinutes int       `json:"active_minutes"` // Minutes with at least one query
+	LastMinute    time.Time `json:"last_minute"`    // Last minute counted as active
+}
+
+// PauseUsage is how much of the daily pause limits has been used, by
+// pauses of all blocking and scoped pauses alike
+type PauseUsage struct {
+	Period   time.Time            `json:"period"`    // Start of the day the pauses count towards
+	Count    int                  `json:"count"`     // Pauses started
+	Time     time.Duration        `json:"time"`      // Length of the pauses started
+	LastEnds map[string]time.Time `json:"last_ends"` // When the last pause of each scope ends or ended, "" for all blocking
+}
+
+// ScopedPause is a running pause of a single domain, rule or group
+type ScopedPause struct {
+	Scope  string `json:"scope"`  // "domain", "rule" or "group"
+	Target string `json:"target"` // The domain, rule or group name
+	Until  string `json:"until"`  // RFC 3339
+}
+
+// QuotaStatus is the state of a rule's daily quota
+type QuotaStatus struct {
+	Rule             string `json:"rule"`
+	Group            string `json:"group,omitempty"`
+	MaxMinutes       int    `json:"max_minutes,omitempty"`
+	MaxQueries       uint64 `json:"max_queries,omitempty"`
+	UsedMinutes      int    `json:"used_minutes"`
+	UsedQueries      uint64 `json:"used_queries"`
+	RemainingMinutes int    `json:"remaining_minutes,omitempty"`
+	RemainingQueries uint64 `json:"remaining_queries,omitempty"`
+	Exhausted        bool   `json:"exhausted"`
+	ResetsAt         string `json:"resets_at"`
+}
+
+// maxTamperEvents is how many tamper events are kept
+const maxTamperEvents = 100
+
+// TamperEvent records a network interface whose DNS settings were changed
+// away from the daemon
+type TamperEvent struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Interface  string    `json:"interface"`
+	OldServers []string  `json:"old_servers"` // Servers the daemon had set
+	NewServers []string  `json:"new_servers"` // Servers they were changed to
 }
 
 // DomainInfo represents domain statistics with block status
@@ -28,12 +105,24 @@ type DomainInfo struct {
 	Domain  string `json:"domain"`
 	Count   uint64 `json:"count"`
 	Blocked bool   `json:"blocked"`
+	Rule    string `json:"rule,omitempty"`  // Rule blocking the domain
+	Group   string `json:"group,omitempty"` // Group of the rule blocking the domain
+}
+
+// RuleInfo represents how many requests a blocking rule has blocked
+type RuleInfo struct {
+	Rule  string `json:"rule"`
+	Count uint64 `json:"count"`
 }
 
+// BlockLookup returns the rule currently blocking a domain and its group, if any
+type BlockLookup func(domain string) (rule, group string, blocked bool)
+
 // New creates a new Stats instance
 func New() *Stats {
 	return &Stats{
 		DomainCounts: make(map[string]uint64),
+		RuleCounts:   make(map[string]uint64),
 		StartTime:    time.Now(),
 	}
 }
@@ -52,20 +141,133 @@ func (s *Stats) RecordRequest(domain string, blocked bool) {
 	s.DomainCounts[domain]++
 }
 
-// GetTopDomains returns the top N most requested domains
-func (s *Stats) GetTopDomains(n int, blockedSites map[string]bool) []DomainInfo {
+// RecordRuleHit records a request blocked by rule
+func (s *Stats) RecordRuleHit(rule string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.RuleCounts[rule]++
+}
+
+// RecordCacheLookup records whether a forwarded query was answered from the cache
+func (s *Stats) RecordCacheLookup(hit bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if hit {
+		s.CacheHits++
+	} else {
+		s.CacheMisses++
+	}
+}
+
+// GetCacheStats returns cache hit and miss counts
+func (s *Stats) GetCacheStats() (hits, misses uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.CacheHits, s.CacheMisses
+}
+
+// RecordBlockPageHit records a browser request that reached the block page
+func (s *Stats) RecordBlockPageHit(https bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if https {
+		s.BlockPageHTTPSHits++
+	} else {
+		s.BlockPageViews++
+	}
+}
+
+// GetBlockPageStats returns block page views and HTTPS hits
+func (s *Stats) GetBlockPageStats() (views, httpsHits uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.BlockPageViews, s.BlockPageHTTPSHits
+}
+
+// RecordTamper records DNS settings that were changed away from the daemon
+func (s *Stats) RecordTamper(event TamperEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.TamperCount++
+	s.TamperEvents = append(s.TamperEvents, event)
+	if n := len(s.TamperEvents); n > maxTamperEvents {
+		s.TamperEvents = append([]TamperEvent(nil), s.TamperEvents[n-maxTamperEvents:]...)
+	}
+}
+
+// GetTamperStats returns the number of tamper events and the most recent one
+func (s *Stats) GetTamperStats() (count uint64, last *TamperEvent) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if n := len(s.TamperEvents); n > 0 {
+		event := s.TamperEvents[n-1]
+		last = &event
+	}
+	return s.TamperCount, last
+}
+
+// UseQuota records a query against the daily quota of rule and reports
+// whether any was left. A minute counts once however many queries it has,
+// so queries in a minute already counted are allowed even once the minutes
+// are used up. A zero maxQueries or maxMinutes is unlimited. Usage from
+// before period is discarded.
+func (s *Stats) UseQuota(rule string, period, now time.Time, maxQueries uint64, maxMinutes int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := s.QuotaUsage[rule]
+	if usage == nil || usage.Period.Before(period) {
+		usage = &QuotaUsage{Period: period}
+		if s.QuotaUsage == nil {
+			s.QuotaUsage = make(map[string]*QuotaUsage)
+		}
+		s.QuotaUsage[rule] = usage
+	}
+
+	minute := now.Truncate(time.Minute)
+	newMinute := !minute.Equal(usage.LastMinute)
+	if maxQueries > 0 && usage.Queries >= maxQueries {
+		return false
+	}
+	if maxMinutes > 0 && newMinute && usage.ActiveMinutes >= maxMinutes {
+		return false
+	}
+
+	usage.Queries++
+	if newMinute {
+		usage.ActiveMinutes++
+		usage.LastMinute = minute
+	}
+	return true
+}
+
+// GetQuotaUsage returns the quota used by rule since period
+func (s *Stats) GetQuotaUsage(rule string, period time.Time) QuotaUsage {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	usage := s.QuotaUsage[rule]
+	if usage == nil || usage.Period.Before(period) {
+		return QuotaUsage{Period: period}
+	}
+	return *usage
+}
+
+// GetTopDomains returns the top N most requested domains
+func (s *Stats) GetTopDomains(n int, lookup BlockLookup) []DomainInfo {
+	s.mu.RLock()
 	domains := make([]DomainInfo, 0, len(s.DomainCounts))
 	for domain, count := range s.DomainCounts {
-		_, isBlocked := blockedSites[domain]
 		domains = append(domains, DomainInfo{
-			Domain:  domain,
-			Count:   count,
-			Blocked: isBlocked,
+			Domain: domain,
+			Count:  count,
 		})
 	}
+	s.mu.RUnlock()
 
 	sort.Slice(domains, func(i, j int) bool {
 		return domains[i].Count > domains[j].Count
@@ -75,9 +277,36 @@ func (s *Stats) GetTopDomains(n int, blockedSites map[string]bool) []DomainInfo
 		domains = domains[:n]
 	}
 
+	// Only look up the block status of the domains that are returned, the
+	// lookup may read the stats itself
+	for i := range domains {
+		domains[i].Rule, domains[i].Group, domains[i].Blocked = lookup(domains[i].Domain)
+	}
+
 	return domains
 }
 
+// GetTopRules returns the N rules that blocked the most requests
+func (s *Stats) GetTopRules(n int) []RuleInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rules := make([]RuleInfo, 0, len(s.RuleCounts))
+	for rule, count := range s.RuleCounts {
+		rules = append(rules, RuleInfo{Rule: rule, Count: count})
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Count > rules[j].Count
+	})
+
+	if len(rules) > n {
+		rules = rules[:n]
+	}
+
+	return rules
+}
+
 // GetCounts returns total, blocked, and allowed counts
 func (s *Stats) GetCounts() (total, blocked, allowed uint64) {
 	s.mu.RLock()
@@ -92,7 +321,7 @@ func (s *Stats) GetUptime() time.Duration {
 	return time.Since(s.StartTime)
 }
 
-// Save saves stats to a file
+// Save atomically saves stats to a file, keeping the previous version as a backup
 func (s *Stats) Save(path string) error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -102,42 +331,154 @@ func (s *Stats) Save(path string) error {
 		return err
 	}
 
-	return os.WriteFile(path, data, 0644)
+	return atomicfile.WriteWithBackup(path, data, 0644, func(data []byte) error {
+		_, err := parse(data)
+		return err
+	})
 }
 
-// Load loads stats from a file
+// Load loads stats from a file, falling back to the backup kept by Save
+// when the file is corrupt. Fresh stats are returned if there are none yet,
+// or with an error if neither file can be read.
 func Load(path string) (*Stats, error) {
-	data, err := os.ReadFile(path)
+	data, used, err := atomicfile.ReadWithBackup(path, func(data []byte) error {
+		_, err := parse(data)
+		return err
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return New(), nil
+	}
 	if err != nil {
-		return New(), nil // Return new stats if file doesn't exist
+		return New(), err
+	}
+	if used != path {
+		log.Printf("[STATS] %s is missing or corrupt, loaded %s", path, used)
 	}
 
+	return parse(data)
+}
+
+func parse(data []byte) (*Stats, error) {
 	var s Stats
 	if err := json.Unmarshal(data, &s); err != nil {
-		return New(), nil
+		return nil, err
+	}
+	if s.DomainCounts == nil {
+		s.DomainCounts = make(map[string]uint64)
+	}
+	if s.RuleCounts == nil {
+		s.RuleCounts = make(map[string]uint64)
 	}
 
 	return &s, nil
 }
 
-// StartPause records the start of a pause period
-func (s *Stats) StartPause() {
+// StartPause records the start of a pause period lasting until until,
+// counted towards the daily pause limits of period. An empty scope pauses
+// all blocking, others a single domain, rule or group.
+func (s *Stats) StartPause(scope string, period, until time.Time) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.PauseCount++
-	s.pauseStartTime = time.Now()
+	now := time.Now()
+	if scope == "" {
+		s.PauseCount++
+		s.pauseStartTime = now
+	} else {
+		s.ScopedPauseCount++
+		if s.ScopedPauseCounts == nil {
+			s.ScopedPauseCounts = make(map[string]uint64)
+		}
+		s.ScopedPauseCounts[scope]++
+		if s.scopedPauseStarts == nil {
+			s.scopedPauseStarts = make(map[string]time.Time)
+		}
+		s.scopedPauseStarts[scope] = now
+	}
+
+	if s.PauseUsage == nil || !s.PauseUsage.Period.Equal(period) {
+		s.PauseUsage = &PauseUsage{Period: period, LastEnds: s.lastEnds()}
+	}
+	if s.PauseUsage.LastEnds == nil {
+		s.PauseUsage.LastEnds = make(map[string]time.Time)
+	}
+	s.PauseUsage.Count++
+	s.PauseUsage.Time += until.Sub(now)
+	s.PauseUsage.LastEnds[scope] = until
+}
+
+// lastEnds copies the last pause ends, which carry over into a new day so
+// a cooldown runs over its start
+func (s *Stats) lastEnds() map[string]time.Time {
+	ends := make(map[string]time.Time)
+	if s.PauseUsage != nil {
+		for scope, end := range s.PauseUsage.LastEnds {
+			ends[scope] = end
+		}
+	}
+	return ends
+}
+
+// GetPauseUsage returns the pauses taken since period
+func (s *Stats) GetPauseUsage(period time.Time) PauseUsage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.PauseUsage == nil || !s.PauseUsage.Period.Equal(period) {
+		return PauseUsage{Period: period, LastEnds: s.lastEnds()}
+	}
+	usage := *s.PauseUsage
+	usage.LastEnds = s.lastEnds()
+	return usage
 }
 
-// EndPause records the end of a pause period
-func (s *Stats) EndPause() {
+// EndPause records that the pause of scope ended at end. A pause cut short
+// gives its unused time back to the daily limits.
+func (s *Stats) EndPause(scope string, end time.Time) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if !s.pauseStartTime.IsZero() {
-		pauseDuration := time.Since(s.pauseStartTime)
-		s.TotalPauseTime += pauseDuration
-		s.pauseStartTime = time.Time{} // Reset
+	var start time.Time
+	if scope == "" {
+		start, s.pauseStartTime = s.pauseStartTime, time.Time{}
+	} else {
+		start = s.scopedPauseStarts[scope]
+		delete(s.scopedPauseStarts, scope)
+	}
+	if start.IsZero() {
+		return
+	}
+	if end.Before(start) {
+		end = start
+	}
+	if scope == "" {
+		s.TotalPauseTime += end.Sub(start)
+	} else {
+		s.TotalScopedPauseTime += end.Sub(start)
+	}
+
+	// Only when the pause counted towards the current usage
+	if u := s.PauseUsage; u != nil && !start.Before(u.Period) {
+		if planned := u.LastEnds[scope]; end.Before(planned) {
+			u.Time = max(u.Time-planned.Sub(end), 0)
+			u.LastEnds[scope] = end
+		}
+	}
+}
+
+// ExtendPause records that the running pause of scope now lasts until
+// until, the extra time counting towards the daily limits of period
+func (s *Stats) ExtendPause(scope string, period, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ends := s.lastEnds()
+	if s.PauseUsage == nil || !s.PauseUsage.Period.Equal(period) {
+		s.PauseUsage = &PauseUsage{Period: period, LastEnds: ends}
+	}
+	if planned, ok := ends[scope]; ok && until.After(planned) {
+		s.PauseUsage.Time += until.Sub(planned)
+		s.PauseUsage.LastEnds[scope] = until
 	}
 }
 
@@ -180,3 +521,16 @@ func (s *Stats) GetPauseStats() (pauseCount uint64, totalPauseTime, totalBlockin
 
 	return s.PauseCount, totalPause, totalBlocking
 }
+
+// GetScopedPauseStats returns the number of scoped pauses and their total
+// time, overlapping pauses each counting in full
+func (s *Stats) GetScopedPauseStats() (count uint64, totalTime time.Duration) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	totalTime = s.TotalScopedPauseTime
+	for _, start := range s.scopedPauseStarts {
+		totalTime += time.Since(start)
+	}
+	return s.ScopedPauseCount, totalTime
+}
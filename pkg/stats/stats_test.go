@@ -0,0 +1,243 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUseQuota(t *testing.T) {
+	day := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hour, minute, second int) time.Time {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(second)*time.Second)
+	}
+
+	type step struct {
+		now     time.Time
+		allowed bool
+	}
+	tests := []struct {
+		name        string
+		maxQueries  uint64
+		maxMinutes  int
+		steps       []step
+		wantQueries uint64
+		wantMinutes int
+	}{
+		{
+			name:       "minutes",
+			maxMinutes: 2,
+			steps: []step{
+				{at(10, 0, 0), true},
+				{at(10, 0, 59), true}, // Same minute
+				{at(10, 5, 30), true}, // Second minute
+				{at(10, 5, 45), true}, // Still in the last minute counted
+				{at(10, 6, 0), false}, // A third minute
+				{at(11, 0, 0), false},
+			},
+			wantQueries: 4,
+			wantMinutes: 2,
+		},
+		{
+			name:       "queries",
+			maxQueries: 3,
+			steps: []step{
+				{at(10, 0, 0), true},
+				{at(10, 0, 1), true},
+				{at(10, 0, 2), true},
+				{at(10, 0, 3), false},
+				{at(12, 0, 0), false},
+			},
+			wantQueries: 3,
+			wantMinutes: 1,
+		},
+		{
+			name:       "whichever comes first",
+			maxQueries: 10,
+			maxMinutes: 1,
+			steps: []step{
+				{at(10, 0, 0), true},
+				{at(10, 0, 10), true},
+				{at(10, 1, 0), false},
+			},
+			wantQueries: 2,
+			wantMinutes: 1,
+		},
+		{
+			name: "unlimited",
+			steps: []step{
+				{at(10, 0, 0), true},
+				{at(11, 0, 0), true},
+				{at(12, 0, 0), true},
+			},
+			wantQueries: 3,
+			wantMinutes: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New()
+			for i, st := range tt.steps {
+				if got := s.UseQuota("reddit.com", day, st.now, tt.maxQueries, tt.maxMinutes); got != st.allowed {
+					t.Errorf("query %d at %s: allowed = %v, want %v", i+1, st.now.Format("15:04:05"), got, st.allowed)
+				}
+			}
+			usage := s.GetQuotaUsage("reddit.com", day)
+			if usage.Queries != tt.wantQueries || usage.ActiveMinutes != tt.wantMinutes {
+				t.Errorf("usage = %d queries in %d minutes, want %d in %d", usage.Queries, usage.ActiveMinutes, tt.wantQueries, tt.wantMinutes)
+			}
+		})
+	}
+}
+
+func TestUseQuotaNewPeriod(t *testing.T) {
+	s := New()
+	day := time.Date(2024, time.January, 1, 4, 0, 0, 0, time.UTC)
+	next := day.AddDate(0, 0, 1)
+
+	if !s.UseQuota("reddit.com", day, day.Add(time.Hour), 1, 0) {
+		t.Fatal("first query refused")
+	}
+	if s.UseQuota("reddit.com", day, day.Add(2*time.Hour), 1, 0) {
+		t.Fatal("query over the quota allowed")
+	}
+
+	// Other rules have their own quota
+	if !s.UseQuota("youtube.com", day, day.Add(2*time.Hour), 1, 0) {
+		t.Error("quota of another rule used up")
+	}
+
+	// The usage of the day before doesn't count towards the next one
+	if usage := s.GetQuotaUsage("reddit.com", next); usage.Queries != 0 || !usage.Period.Equal(next) {
+		t.Errorf("usage in the next period = %+v", usage)
+	}
+	if !s.UseQuota("reddit.com", next, next.Add(time.Minute), 1, 0) {
+		t.Error("quota not reset in the next period")
+	}
+	if usage := s.GetQuotaUsage("reddit.com", next); usage.Queries != 1 || usage.ActiveMinutes != 1 {
+		t.Errorf("usage in the next period = %+v", usage)
+	}
+}
+
+func TestEndPause(t *testing.T) {
+	period := time.Now().Truncate(24 * time.Hour)
+
+	t.Run("cut short", func(t *testing.T) {
+		s := New()
+		s.StartPause("", period, time.Now().Add(10*time.Minute))
+		start := s.pauseStartTime
+
+		s.EndPause("", start.Add(3*time.Minute))
+
+		count, total, _ := s.GetPauseStats()
+		if count != 1 || total != 3*time.Minute {
+			t.Errorf("pause stats = %d pauses for %s, want 1 for 3m", count, total)
+		}
+		usage := s.GetPauseUsage(period)
+		if usage.Count != 1 || usage.Time != 3*time.Minute {
+			t.Errorf("usage = %d pauses for %s, want 1 for 3m", usage.Count, usage.Time)
+		}
+		if end := usage.LastEnds[""]; !end.Equal(start.Add(3 * time.Minute)) {
+			t.Errorf("last end = %s, want when the pause was cut short", end)
+		}
+		if s.IsPaused() {
+			t.Error("still paused")
+		}
+	})
+
+	t.Run("ran out", func(t *testing.T) {
+		s := New()
+		until := time.Now().Add(10 * time.Minute)
+		s.StartPause("", period, until)
+		start := s.pauseStartTime
+		planned := s.GetPauseUsage(period).Time
+
+		s.EndPause("", until)
+
+		if _, total, _ := s.GetPauseStats(); total != until.Sub(start) {
+			t.Errorf("total pause time = %s, want %s", total, until.Sub(start))
+		}
+		if usage := s.GetPauseUsage(period); usage.Time != planned {
+			t.Errorf("usage = %s, want the %s planned", usage.Time, planned)
+		}
+	})
+
+	t.Run("scoped", func(t *testing.T) {
+		s := New()
+		s.StartPause("group:social", period, time.Now().Add(10*time.Minute))
+		s.StartPause("domain:reddit.com", period, time.Now().Add(5*time.Minute))
+		start := s.scopedPauseStarts["group:social"]
+
+		s.EndPause("group:social", start.Add(time.Minute))
+
+		count, total := s.GetScopedPauseStats()
+		if count != 2 || total < time.Minute || total > time.Minute+time.Second {
+			t.Errorf("scoped pause stats = %d pauses for %s, want 2 for about 1m", count, total)
+		}
+		if _, paused, _ := s.GetPauseStats(); paused != 0 {
+			t.Errorf("total pause time of all blocking = %s", paused)
+		}
+		usage := s.GetPauseUsage(period)
+		if usage.Count != 2 || usage.Time < 6*time.Minute-time.Second || usage.Time > 6*time.Minute {
+			t.Errorf("usage = %d pauses for %s, want 2 for 6m", usage.Count, usage.Time)
+		}
+	})
+
+	t.Run("not paused", func(t *testing.T) {
+		s := New()
+		s.EndPause("", time.Now())
+		if count, total, _ := s.GetPauseStats(); count != 0 || total != 0 {
+			t.Errorf("pause stats = %d pauses for %s", count, total)
+		}
+	})
+
+	t.Run("from the day before", func(t *testing.T) {
+		s := New()
+		s.StartPause("", period.AddDate(0, 0, -1), time.Now().Add(10*time.Minute))
+		s.PauseUsage = &PauseUsage{Period: period, LastEnds: map[string]time.Time{}}
+
+		s.EndPause("", time.Now())
+
+		if usage := s.GetPauseUsage(period); usage.Time != 0 {
+			t.Errorf("usage of today = %s, time of a pause of the day before given back", usage.Time)
+		}
+	})
+}
+
+func TestExtendPause(t *testing.T) {
+	period := time.Now().Truncate(24 * time.Hour)
+	until := time.Now().Add(10 * time.Minute)
+
+	s := New()
+	s.StartPause("", period, until)
+	planned := s.GetPauseUsage(period).Time
+
+	s.ExtendPause("", period, until.Add(5*time.Minute))
+	usage := s.GetPauseUsage(period)
+	if usage.Count != 1 || usage.Time != planned+5*time.Minute {
+		t.Errorf("usage = %d pauses for %s, want 1 for %s", usage.Count, usage.Time, planned+5*time.Minute)
+	}
+	if end := usage.LastEnds[""]; !end.Equal(until.Add(5 * time.Minute)) {
+		t.Errorf("last end = %s, want the extended end", end)
+	}
+
+	// An earlier end isn't an extension
+	s.ExtendPause("", period, until)
+	if got := s.GetPauseUsage(period).Time; got != planned+5*time.Minute {
+		t.Errorf("usage after an earlier end = %s", got)
+	}
+
+	// Nor is a scope that isn't paused
+	s.ExtendPause("domain:reddit.com", period, until.Add(time.Hour))
+	if got := s.GetPauseUsage(period).Time; got != planned+5*time.Minute {
+		t.Errorf("usage after extending a scope that isn't paused = %s", got)
+	}
+
+	// Past the reset, only the extra time counts towards the new day
+	next := period.AddDate(0, 0, 1)
+	s.ExtendPause("", next, until.Add(7*time.Minute))
+	usage = s.GetPauseUsage(next)
+	if usage.Count != 0 || usage.Time != 2*time.Minute {
+		t.Errorf("usage of the next day = %d pauses for %s, want 0 for 2m", usage.Count, usage.Time)
+	}
+}
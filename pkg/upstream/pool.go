@@ -0,0 +1,156 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Strategy decides in which order healthy upstreams are tried
+type Strategy string
+
+const (
+	// StrategyFastest prefers the upstream with the lowest average response time
+	StrategyFastest Strategy = "fastest"
+	// StrategyRoundRobin spreads queries evenly across healthy upstreams
+	StrategyRoundRobin Strategy = "round_robin"
+)
+
+// Pool forwards queries to a set of upstreams, failing over between them
+type Pool struct {
+	upstreams []*Upstream
+	strategy  Strategy
+	next      atomic.Uint32
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewPool creates a pool for the given upstreams
+func NewPool(opts []Options, strategy Strategy) (*Pool, error) {
+	if len(opts) == 0 {
+		return nil, errors.New("at least one upstream is required")
+	}
+
+	switch strategy {
+	case "":
+		strategy = StrategyFastest
+	case StrategyFastest, StrategyRoundRobin:
+	default:
+		return nil, fmt.Errorf("unknown upstream strategy %q", strategy)
+	}
+
+	p := &Pool{
+		strategy: strategy,
+		stop:     make(chan struct{}),
+	}
+	for _, o := range opts {
+		if o.Address == "" {
+			return nil, errors.New("upstream address cannot be empty")
+		}
+		u, err := newUpstream(o)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", o.Address, err)
+		}
+		p.upstreams = append(p.upstreams, u)
+	}
+
+	return p, nil
+}
+
+// Exchange forwards r to the upstreams in strategy order and returns the
+// first successful response. When an upstream fails the next one is tried,
+// upstreams failing FailureThreshold times in a row are marked unhealthy.
+func (p *Pool) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	var lastErr error
+	for _, u := range p.candidates() {
+		resp, err := u.exchange(r)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = fmt.Errorf("%s: %w", u.address, err)
+	}
+	return nil, lastErr
+}
+
+// candidates returns the upstreams in the order they should be tried.
+// Unhealthy upstreams are kept at the end as a last resort.
+func (p *Pool) candidates() []*Upstream {
+	healthy := make([]*Upstream, 0, len(p.upstreams))
+	var unhealthy []*Upstream
+	for _, u := range p.upstreams {
+		if u.isHealthy() {
+			healthy = append(healthy, u)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+
+	if len(healthy) > 1 {
+		switch p.strategy {
+		case StrategyFastest:
+			sort.SliceStable(healthy, func(i, j int) bool {
+				return healthy[i].averageRTT() < healthy[j].averageRTT()
+			})
+		case StrategyRoundRobin:
+			start := int(p.next.Add(1)-1) % len(healthy)
+			healthy = append(healthy[start:], healthy[:start]...)
+		}
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+// StartHealthChecks probes every upstream once per interval until Stop is called
+func (p *Pool) StartHealthChecks(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		p.probeAll()
+		for {
+			select {
+			case <-ticker.C:
+				p.probeAll()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *Pool) probeAll() {
+	var wg sync.WaitGroup
+	for _, u := range p.upstreams {
+		wg.Add(1)
+		go func(u *Upstream) {
+			defer wg.Done()
+			u.probe()
+		}(u)
+	}
+	wg.Wait()
+}
+
+// Stop stops the health checks and closes idle upstream connections
+func (p *Pool) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		for _, u := range p.upstreams {
+			u.transport.close()
+		}
+	})
+}
+
+// Status returns the current health of every upstream in configuration order
+func (p *Pool) Status() []Status {
+	statuses := make([]Status, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		statuses = append(statuses, u.status())
+	}
+	return statuses
+}
@@ -0,0 +1,167 @@
+package upstream
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startUDPServer serves A records pointing at ip on addr, a random port if addr is empty
+func startUDPServer(t *testing.T, addr, ip string) *dns.Server {
+	t.Helper()
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A " + ip)
+			m.Answer = append(m.Answer, rr)
+			w.WriteMsg(m)
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return srv
+}
+
+func answeredBy(t *testing.T, resp *dns.Msg) string {
+	t.Helper()
+	if len(resp.Answer) != 1 {
+		t.Fatalf("got %d answers, want 1", len(resp.Answer))
+	}
+	return resp.Answer[0].(*dns.A).A.String()
+}
+
+func TestPoolFailover(t *testing.T) {
+	primary := startUDPServer(t, "", "192.0.2.1")
+	backup := startUDPServer(t, "", "192.0.2.2")
+	primaryAddr := primary.PacketConn.LocalAddr().String()
+
+	p, err := NewPool([]Options{
+		{Address: primaryAddr, Timeout: testTimeout},
+		{Address: backup.PacketConn.LocalAddr().String(), Timeout: testTimeout},
+	}, StrategyRoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.Exchange(query("example.com")); err != nil {
+			t.Fatalf("exchange with both upstreams up: %v", err)
+		}
+	}
+
+	// Round robin tries the primary first on every other query, until it
+	// has failed often enough to be demoted
+	primary.Shutdown()
+	for i := 0; i < 2*FailureThreshold; i++ {
+		resp, err := p.Exchange(query("example.com"))
+		if err != nil {
+			t.Fatalf("exchange %d with the primary down: %v", i, err)
+		}
+		if got := answeredBy(t, resp); got != "192.0.2.2" {
+			t.Fatalf("exchange %d answered by %s, want the backup", i, got)
+		}
+
+		st := p.Status()[0]
+		if want := st.Failures < FailureThreshold; st.Healthy != want {
+			t.Errorf("after %d failures healthy = %v, want %v", st.Failures, st.Healthy, want)
+		}
+	}
+
+	st := p.Status()[0]
+	if st.Healthy || st.Failures != FailureThreshold {
+		t.Errorf("primary healthy = %v with %d failures, want unhealthy with %d", st.Healthy, st.Failures, FailureThreshold)
+	}
+	if st.LastError == "" {
+		t.Error("primary has no last error")
+	}
+	if c := p.candidates(); c[len(c)-1] != p.upstreams[0] {
+		t.Error("unhealthy primary isn't tried last")
+	}
+
+	// A successful health check brings it back
+	startUDPServer(t, primaryAddr, "192.0.2.1")
+	p.probeAll()
+	if st := p.Status()[0]; !st.Healthy || st.LastError != "" {
+		t.Errorf("restarted primary healthy = %v, last error %q", st.Healthy, st.LastError)
+	}
+
+	backup.Shutdown()
+	for i := 0; i < 2; i++ {
+		resp, err := p.Exchange(query("example.com"))
+		if err != nil {
+			t.Fatalf("exchange %d with the backup down: %v", i, err)
+		}
+		if got := answeredBy(t, resp); got != "192.0.2.1" {
+			t.Errorf("exchange %d answered by %s, want the primary", i, got)
+		}
+	}
+}
+
+func TestPoolAllDown(t *testing.T) {
+	a := startUDPServer(t, "", "192.0.2.1")
+	b := startUDPServer(t, "", "192.0.2.2")
+
+	p, err := NewPool([]Options{
+		{Address: a.PacketConn.LocalAddr().String(), Timeout: testTimeout},
+		{Address: b.PacketConn.LocalAddr().String(), Timeout: testTimeout},
+	}, StrategyFastest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	a.Shutdown()
+	b.Shutdown()
+	if _, err := p.Exchange(query("example.com")); err == nil {
+		t.Fatal("exchange succeeded with every upstream down")
+	}
+	for i, st := range p.Status() {
+		if st.Queries != 1 || st.Failures != 1 {
+			t.Errorf("upstream %d: %d queries and %d failures, want 1 of each", i, st.Queries, st.Failures)
+		}
+	}
+}
+
+func TestUpstreamConsecutiveFailures(t *testing.T) {
+	errLost := errors.New("lost")
+	tests := []struct {
+		name    string
+		results []error
+		healthy bool
+	}{
+		{"no failures", []error{nil, nil}, true},
+		{"below threshold", []error{errLost, errLost}, true},
+		{"at threshold", []error{errLost, errLost, errLost}, false},
+		{"success resets the count", []error{errLost, errLost, nil, errLost, errLost}, true},
+		{"intermittent failures", []error{errLost, nil, errLost, nil, errLost, nil, errLost}, true},
+		{"recovers after demotion", []error{errLost, errLost, errLost, nil}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &Upstream{healthy: true}
+			for _, err := range tt.results {
+				u.record(0, err)
+			}
+			if u.isHealthy() != tt.healthy {
+				t.Errorf("healthy = %v, want %v", u.isHealthy(), tt.healthy)
+			}
+		})
+	}
+}
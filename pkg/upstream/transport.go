@@ -0,0 +1,372 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Protocol is the transport used to talk to an upstream
+type Protocol string
+
+const (
+	// ProtocolUDP is plain DNS over UDP port 53
+	ProtocolUDP Protocol = "udp"
+	// ProtocolTLS is DNS-over-TLS (RFC 7858)
+	ProtocolTLS Protocol = "tls"
+	// ProtocolHTTPS is DNS-over-HTTPS (RFC 8484)
+	ProtocolHTTPS Protocol = "https"
+)
+
+const (
+	dohMediaType    = "application/dns-message"
+	maxIdleTLSConns = 4
+)
+
+// DefaultBootstrap resolves the host names of upstreams that don't configure
+// their own bootstrap servers. The system resolver can't be used for this,
+// while the daemon manages the system DNS settings it is the daemon itself.
+var DefaultBootstrap = []string{"8.8.8.8:53", "1.1.1.1:53"}
+
+// transport sends a single query to an upstream
+type transport interface {
+	exchange(r *dns.Msg) (*dns.Msg, time.Duration, error)
+	close()
+}
+
+// newTransport creates the transport for opts and returns it together
+// with the normalized address used for display
+func newTransport(opts Options, timeout time.Duration) (transport, string, error) {
+	dialer, err := newDialer(opts.Bootstrap, timeout)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch opts.Protocol {
+	case "", ProtocolUDP:
+		address := withDefaultPort(opts.Address, "53")
+		return &udpTransport{
+			address:   address,
+			client:    &dns.Client{Net: "udp", Timeout: timeout, Dialer: dialer},
+			tcpClient: &dns.Client{Net: "tcp", Timeout: timeout, Dialer: dialer},
+		}, address, nil
+
+	case ProtocolTLS:
+		address := withDefaultPort(opts.Address, "853")
+		host, _, _ := net.SplitHostPort(address)
+		tlsConfig, err := newTLSConfig(opts, host)
+		if err != nil {
+			return nil, "", err
+		}
+		return &tlsTransport{
+			address: address,
+			client:  &dns.Client{Net: "tcp-tls", Timeout: timeout, TLSConfig: tlsConfig, Dialer: dialer},
+		}, "tls://" + address, nil
+
+	case ProtocolHTTPS:
+		u, err := url.Parse(opts.Address)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid DoH URL %q: %w", opts.Address, err)
+		}
+		if u.Scheme != "https" || u.Host == "" {
+			return nil, "", fmt.Errorf("invalid DoH URL %q: must be an https:// URL", opts.Address)
+		}
+
+		method := strings.ToUpper(opts.Method)
+		switch method {
+		case "":
+			method = http.MethodPost
+		case http.MethodGet, http.MethodPost:
+		default:
+			return nil, "", fmt.Errorf("unsupported DoH method %q", opts.Method)
+		}
+
+		tlsConfig, err := newTLSConfig(opts, u.Hostname())
+		if err != nil {
+			return nil, "", err
+		}
+		return &httpsTransport{
+			url:    u,
+			method: method,
+			client: &http.Client{
+				Timeout: timeout,
+				Transport: &http.Transport{
+					Proxy:               http.ProxyFromEnvironment,
+					DialContext:         dialer.DialContext,
+					TLSClientConfig:     tlsConfig,
+					ForceAttemptHTTP2:   true,
+					MaxIdleConnsPerHost: maxIdleTLSConns,
+					IdleConnTimeout:     90 * time.Second,
+				},
+			},
+		}, u.String(), nil
+
+	default:
+		return nil, "", fmt.Errorf("unknown upstream protocol %q", opts.Protocol)
+	}
+}
+
+// newDialer returns the dialer for connections to an upstream, resolving
+// host names through the bootstrap servers, DefaultBootstrap if empty
+func newDialer(bootstrap []string, timeout time.Duration) (*net.Dialer, error) {
+	if len(bootstrap) == 0 {
+		bootstrap = DefaultBootstrap
+	}
+	servers := make([]string, 0, len(bootstrap))
+	for _, b := range bootstrap {
+		server, err := BootstrapAddress(b)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+
+	// Retries of the resolver go to the next server
+	var next atomic.Uint32
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			server := servers[int(next.Add(1)-1)%len(servers)]
+			d := net.Dialer{Timeout: timeout}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+	return &net.Dialer{Timeout: timeout, Resolver: resolver}, nil
+}
+
+// BootstrapAddress checks that a bootstrap server is an IP address, with
+// an optional port, and returns it with port 53 added when missing
+func BootstrapAddress(server string) (string, error) {
+	address := withDefaultPort(server, "53")
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid bootstrap server %q: must be an IP address", server)
+	}
+	return address, nil
+}
+
+func withDefaultPort(address, port string) string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(address, port)
+	}
+	return address
+}
+
+// newTLSConfig builds the client TLS configuration for an encrypted upstream
+func newTLSConfig(opts Options, host string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if opts.ServerName != "" {
+		cfg.ServerName = opts.ServerName
+	}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", opts.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(opts.Pins) > 0 {
+		pins := make(map[string]bool, len(opts.Pins))
+		for _, pin := range opts.Pins {
+			raw, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(raw) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin %q: must be a base64 encoded SHA-256 hash", pin)
+			}
+			pins[pin] = true
+		}
+
+		serverName := cfg.ServerName
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+					return nil
+				}
+			}
+			return fmt.Errorf("no certificate presented by %s matches the configured pins", serverName)
+		}
+	}
+
+	return cfg, nil
+}
+
+// udpTransport is plain DNS over UDP, falling back to TCP for truncated responses
+type udpTransport struct {
+	address   string
+	client    *dns.Client
+	tcpClient *dns.Client
+}
+
+func (t *udpTransport) exchange(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+	resp, rtt, err := t.client.Exchange(r, t.address)
+	if err == nil && resp.Truncated {
+		// Retry over TCP to get the full answer
+		return t.tcpClient.Exchange(r, t.address)
+	}
+	return resp, rtt, err
+}
+
+func (t *udpTransport) close() {}
+
+// tlsTransport is DNS-over-TLS, keeping idle connections around for reuse
+type tlsTransport struct {
+	address string
+	client  *dns.Client
+
+	mu   sync.Mutex
+	idle []*dns.Conn
+}
+
+func (t *tlsTransport) exchange(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+	conn, reused, err := t.getConn()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, rtt, err := t.client.ExchangeWithConn(r, conn)
+	if err != nil && reused {
+		// The server may have closed the idle connection, retry once on a fresh one
+		conn.Close()
+		if conn, err = t.client.Dial(t.address); err != nil {
+			return nil, 0, err
+		}
+		resp, rtt, err = t.client.ExchangeWithConn(r, conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, rtt, err
+	}
+
+	t.putConn(conn)
+	return resp, rtt, nil
+}
+
+func (t *tlsTransport) getConn() (*dns.Conn, bool, error) {
+	t.mu.Lock()
+	if n := len(t.idle); n > 0 {
+		conn := t.idle[n-1]
+		t.idle = t.idle[:n-1]
+		t.mu.Unlock()
+		return conn, true, nil
+	}
+	t.mu.Unlock()
+
+	conn, err := t.client.Dial(t.address)
+	return conn, false, err
+}
+
+func (t *tlsTransport) putConn(conn *dns.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.idle) >= maxIdleTLSConns {
+		conn.Close()
+		return
+	}
+	t.idle = append(t.idle, conn)
+}
+
+func (t *tlsTransport) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, conn := range t.idle {
+		conn.Close()
+	}
+	t.idle = nil
+}
+
+// httpsTransport is DNS-over-HTTPS using the wire format in either GET or POST requests
+type httpsTransport struct {
+	url    *url.URL
+	method string
+	client *http.Client
+}
+
+func (t *httpsTransport) exchange(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+	// RFC 8484 recommends an ID of 0 so responses are cache friendly
+	query := r.Copy()
+	query.Id = 0
+	wire, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var req *http.Request
+	if t.method == http.MethodGet {
+		u := *t.url
+		values := u.Query()
+		values.Set("dns", base64.RawURLEncoding.EncodeToString(wire))
+		u.RawQuery = values.Encode()
+		req, err = http.NewRequest(http.MethodGet, u.String(), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, t.url.String(), bytes.NewReader(wire))
+		if req != nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	start := time.Now()
+	httpResp, err := t.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected HTTP status %s", httpResp.Status)
+	}
+	if ct := httpResp.Header.Get("Content-Type"); !strings.HasPrefix(ct, dohMediaType) {
+		return nil, 0, fmt.Errorf("unexpected content type %q", ct)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(body) > dns.MaxMsgSize {
+		return nil, 0, errors.New("response exceeds maximum DNS message size")
+	}
+	rtt := time.Since(start)
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, rtt, fmt.Errorf("invalid DNS response: %w", err)
+	}
+	resp.Id = r.Id
+
+	return resp, rtt, nil
+}
+
+func (t *httpsTransport) close() {
+	t.client.CloseIdleConnections()
+}
@@ -0,0 +1,512 @@
+package upstream
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testTimeout = time.Second
+
+// answer replies to every query with an A record for 192.0.2.1
+func answer(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if len(r.Question) > 0 {
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+	}
+	w.WriteMsg(m)
+}
+
+func query(name string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	return m
+}
+
+func checkAnswer(t *testing.T, resp *dns.Msg, r *dns.Msg) {
+	t.Helper()
+	if resp.Id != r.Id {
+		t.Errorf("response ID = %d, want %d", resp.Id, r.Id)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("got %d answers, want 1", len(resp.Answer))
+	}
+	if a, ok := resp.Answer[0].(*dns.A); !ok || a.A.String() != "192.0.2.1" {
+		t.Errorf("answer = %s, want 192.0.2.1", resp.Answer[0])
+	}
+}
+
+// writeCA writes the certificate of a TLS test server to a PEM file
+func writeCA(t *testing.T, cert []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// leaf returns the parsed leaf of a test server certificate
+func leaf(t *testing.T, cert *tls.Certificate) *x509.Certificate {
+	t.Helper()
+	if cert.Leaf != nil {
+		return cert.Leaf
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+// spkiPin returns the pin of cert as configured in Options.Pins
+func spkiPin(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+	sum := sha256.Sum256(leaf(t, cert).RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// dohServer is a DoH endpoint recording the HTTP methods it was queried with
+type dohServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	methods []string
+}
+
+func newDoHServer(t *testing.T) *dohServer {
+	t.Helper()
+	s := &dohServer{}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		s.methods = append(s.methods, req.Method)
+		s.mu.Unlock()
+
+		var wire []byte
+		var err error
+		switch req.Method {
+		case http.MethodGet:
+			wire, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if ct := req.Header.Get("Content-Type"); ct != dohMediaType {
+				http.Error(w, "bad content type "+ct, http.StatusUnsupportedMediaType)
+				return
+			}
+			wire, err = io.ReadAll(req.Body)
+		default:
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+			return
+		}
+		r := new(dns.Msg)
+		if err == nil {
+			err = r.Unpack(wire)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Id != 0 {
+			http.Error(w, "query ID is not 0", http.StatusBadRequest)
+			return
+		}
+
+		rec := &recorder{}
+		answer(rec, r)
+		out, _ := rec.msg.Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(out)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// recorder is a dns.ResponseWriter keeping the written message
+type recorder struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (r *recorder) WriteMsg(m *dns.Msg) error {
+	r.msg = m
+	return nil
+}
+
+// dotServer is a DNS-over-TLS server counting accepted connections
+type dotServer struct {
+	addr  string
+	cert  *tls.Certificate
+	conns atomic.Int32
+}
+
+type countingListener struct {
+	net.Listener
+	conns *atomic.Int32
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.conns.Add(1)
+	}
+	return conn, err
+}
+
+// newDoTServer starts a DoT server closing connections after maxQueries
+// queries, 0 keeps them open
+func newDoTServer(t *testing.T, maxQueries int) *dotServer {
+	t.Helper()
+
+	// Borrow the certificate httptest generates for 127.0.0.1
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	ts.Close()
+	cert := ts.TLS.Certificates[0]
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dotServer{addr: ln.Addr().String(), cert: &cert}
+	tlsLn := tls.NewListener(countingListener{ln, &s.conns}, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	started := make(chan struct{})
+	srv := &dns.Server{
+		Listener:          tlsLn,
+		Net:               "tcp-tls",
+		Handler:           dns.HandlerFunc(answer),
+		MaxTCPQueries:     maxQueries,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return s
+}
+
+func TestDoH(t *testing.T) {
+	s := newDoHServer(t)
+	caFile := writeCA(t, s.Certificate().Raw)
+
+	for _, method := range []string{http.MethodGet, http.MethodPost, ""} {
+		name := method
+		if name == "" {
+			name = "default"
+		}
+		t.Run(name, func(t *testing.T) {
+			s.mu.Lock()
+			s.methods = nil
+			s.mu.Unlock()
+
+			tr, address, err := newTransport(Options{
+				Address:  s.URL + "/dns-query",
+				Protocol: ProtocolHTTPS,
+				CAFile:   caFile,
+				Method:   method,
+			}, testTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.close()
+			if !strings.HasPrefix(address, "https://127.0.0.1:") {
+				t.Errorf("address = %q, want the DoH URL", address)
+			}
+
+			r := query("example.com")
+			resp, _, err := tr.exchange(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkAnswer(t, resp, r)
+
+			want := method
+			if want == "" {
+				want = http.MethodPost
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if len(s.methods) != 1 || s.methods[0] != want {
+				t.Errorf("server saw methods %v, want [%s]", s.methods, want)
+			}
+		})
+	}
+}
+
+func TestDoHTrust(t *testing.T) {
+	s := newDoHServer(t)
+	caFile := writeCA(t, s.Certificate().Raw)
+	pin := spkiPin(t, &s.TLS.Certificates[0])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr string
+	}{
+		{"system roots", Options{}, "certificate"},
+		{"ca file", Options{CAFile: caFile}, ""},
+		{"matching pin", Options{CAFile: caFile, Pins: []string{otherPin, pin}}, ""},
+		{"pin mismatch", Options{CAFile: caFile, Pins: []string{otherPin}}, "matches the configured pins"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Address = s.URL
+			opts.Protocol = ProtocolHTTPS
+			tr, _, err := newTransport(opts, testTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.close()
+
+			_, _, err = tr.exchange(query("example.com"))
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("exchange failed: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("exchange error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"missing ca file", Options{CAFile: filepath.Join(t.TempDir(), "missing.pem")}},
+		{"ca file without certificates", Options{CAFile: empty}},
+		{"pin not base64", Options{Pins: []string{"not base64!"}}},
+		{"pin wrong length", Options{Pins: []string{base64.StdEncoding.EncodeToString([]byte("short"))}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Address = "127.0.0.1"
+			opts.Protocol = ProtocolTLS
+			if _, _, err := newTransport(opts, testTimeout); err == nil {
+				t.Error("newTransport accepted invalid TLS options")
+			}
+		})
+	}
+}
+
+func TestDoTPinMismatch(t *testing.T) {
+	s := newDoTServer(t, 0)
+	caFile := writeCA(t, leaf(t, s.cert).Raw)
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tr, _, err := newTransport(Options{Address: s.addr, Protocol: ProtocolTLS, CAFile: caFile, Pins: []string{otherPin}}, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.close()
+
+	if _, _, err := tr.exchange(query("example.com")); err == nil || !strings.Contains(err.Error(), "matches the configured pins") {
+		t.Errorf("exchange error = %v, want a pin mismatch", err)
+	}
+}
+
+func TestDoTReusesIdleConnection(t *testing.T) {
+	s := newDoTServer(t, 0)
+	caFile := writeCA(t, leaf(t, s.cert).Raw)
+
+	tr, address, err := newTransport(Options{Address: s.addr, Protocol: ProtocolTLS, CAFile: caFile, Pins: []string{spkiPin(t, s.cert)}}, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.close()
+	if address != "tls://"+s.addr {
+		t.Errorf("address = %q, want %q", address, "tls://"+s.addr)
+	}
+
+	for i := 0; i < 3; i++ {
+		r := query("example.com")
+		resp, _, err := tr.exchange(r)
+		if err != nil {
+			t.Fatalf("exchange %d: %v", i, err)
+		}
+		checkAnswer(t, resp, r)
+	}
+	if got := s.conns.Load(); got != 1 {
+		t.Errorf("server accepted %d connections, want 1", got)
+	}
+}
+
+func TestDoTRetriesStaleConnection(t *testing.T) {
+	// The server closes every connection after one query, so the idle
+	// connection kept from the first exchange is stale by the second
+	s := newDoTServer(t, 1)
+	caFile := writeCA(t, leaf(t, s.cert).Raw)
+
+	tr, _, err := newTransport(Options{Address: s.addr, Protocol: ProtocolTLS, CAFile: caFile}, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.close()
+
+	for i := 0; i < 3; i++ {
+		r := query("example.com")
+		resp, _, err := tr.exchange(r)
+		if err != nil {
+			t.Fatalf("exchange %d: %v", i, err)
+		}
+		checkAnswer(t, resp, r)
+	}
+	if got := s.conns.Load(); got != 3 {
+		t.Errorf("server accepted %d connections, want 3", got)
+	}
+}
+
+// bootstrapServer answers A queries for every name with 127.0.0.1 and
+// records the names it was asked about
+type bootstrapServer struct {
+	addr  string
+	mu    sync.Mutex
+	names []string
+}
+
+func newBootstrapServer(t *testing.T) *bootstrapServer {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &bootstrapServer{addr: pc.LocalAddr().String()}
+
+	started := make(chan struct{})
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			s.mu.Lock()
+			s.names = append(s.names, r.Question[0].Name)
+			s.mu.Unlock()
+
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if r.Question[0].Qtype == dns.TypeA {
+				rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 127.0.0.1")
+				m.Answer = append(m.Answer, rr)
+			}
+			w.WriteMsg(m)
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return s
+}
+
+func (s *bootstrapServer) asked(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.names {
+		if n == dns.Fqdn(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBootstrap(t *testing.T) {
+	// The test certificates are issued to example.com, which only resolves
+	// to the test servers through the bootstrap server
+	doh := newDoHServer(t)
+	_, dohPort, _ := net.SplitHostPort(doh.Listener.Addr().String())
+	dot := newDoTServer(t, 0)
+	_, dotPort, _ := net.SplitHostPort(dot.addr)
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"https", Options{
+			Address:  "https://example.com:" + dohPort + "/dns-query",
+			Protocol: ProtocolHTTPS,
+			CAFile:   writeCA(t, doh.Certificate().Raw),
+		}},
+		{"tls", Options{
+			Address:  net.JoinHostPort("example.com", dotPort),
+			Protocol: ProtocolTLS,
+			CAFile:   writeCA(t, leaf(t, dot.cert).Raw),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bootstrap := newBootstrapServer(t)
+			opts := tt.opts
+			opts.Bootstrap = []string{bootstrap.addr}
+
+			tr, _, err := newTransport(opts, testTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.close()
+
+			r := query("example.org")
+			resp, _, err := tr.exchange(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkAnswer(t, resp, r)
+			if !bootstrap.asked("example.com") {
+				t.Error("upstream host name wasn't resolved through the bootstrap server")
+			}
+		})
+	}
+}
+
+func TestBootstrapAddress(t *testing.T) {
+	tests := []struct {
+		server string
+		want   string
+	}{
+		{"9.9.9.9", "9.9.9.9:53"},
+		{"9.9.9.9:5353", "9.9.9.9:5353"},
+		{"2620:fe::fe", "[2620:fe::fe]:53"},
+		{"[2620:fe::fe]:53", "[2620:fe::fe]:53"},
+		{"dns.quad9.net", ""},
+		{"dns.quad9.net:53", ""},
+	}
+
+	for _, tt := range tests {
+		got, err := BootstrapAddress(tt.server)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("BootstrapAddress(%q) accepted a host name", tt.server)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("BootstrapAddress(%q) = %q, %v, want %q", tt.server, got, err, tt.want)
+		}
+	}
+
+	if _, _, err := newTransport(Options{Address: "https://dns.quad9.net/dns-query", Protocol: ProtocolHTTPS, Bootstrap: []string{"dns.google"}}, testTimeout); err == nil {
+		t.Error("newTransport accepted a host name as bootstrap server")
+	}
+}
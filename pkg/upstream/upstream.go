@@ -0,0 +1,165 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultTimeout is used for upstreams that don't configure their own timeout
+const DefaultTimeout = 2 * time.Second
+
+// FailureThreshold is the number of consecutive failed exchanges or health
+// checks after which an upstream is marked unhealthy, so a single lost
+// packet doesn't demote it
+const FailureThreshold = 3
+
+// Options describes a single upstream resolver
+type Options struct {
+	Address  string        // host:port for udp/tls, URL for https
+	Protocol Protocol      // ProtocolUDP if empty
+	Timeout  time.Duration // Per-query timeout, DefaultTimeout if zero
+
+	// Encrypted transports only
+	ServerName string   // TLS server name (SNI), defaults to the address host
+	Pins       []string // Base64 SHA-256 hashes of an accepted certificate's public key
+	CAFile     string   // PEM bundle used instead of the system roots
+	Method     string   // DoH only: "GET" or "POST" (default)
+
+	// Plain DNS servers resolving a host name in Address, DefaultBootstrap if empty
+	Bootstrap []string
+}
+
+// Status is a snapshot of an upstream's health
+type Status struct {
+	Address   string `json:"address"`
+	Protocol  string `json:"protocol"`
+	Healthy   bool   `json:"healthy"`
+	RTT       string `json:"rtt,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+	LastCheck string `json:"last_check,omitempty"`
+	Queries   uint64 `json:"queries"`
+	Failures  uint64 `json:"failures"`
+}
+
+// Upstream is a single resolver together with its health state
+type Upstream struct {
+	address   string
+	protocol  Protocol
+	transport transport
+
+	mu        sync.RWMutex
+	healthy   bool
+	rtt       time.Duration // Moving average of successful exchanges
+	lastErr   error
+	lastCheck time.Time
+	queries   uint64
+	failures  uint64
+	failing   int // Consecutive failures since the last success
+}
+
+func newUpstream(opts Options) (*Upstream, error) {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	protocol := opts.Protocol
+	if protocol == "" {
+		protocol = ProtocolUDP
+	}
+
+	t, address, err := newTransport(opts, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Upstream{
+		address:   address,
+		protocol:  protocol,
+		transport: t,
+		healthy:   true, // Assume healthy until proven otherwise
+	}, nil
+}
+
+// exchange sends r to the upstream and records the outcome
+func (u *Upstream) exchange(r *dns.Msg) (*dns.Msg, error) {
+	resp, rtt, err := u.transport.exchange(r)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.queries++
+	u.record(rtt, err)
+
+	return resp, err
+}
+
+// probe checks whether the upstream answers a root NS query
+func (u *Upstream) probe() {
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+	_, rtt, err := u.transport.exchange(m)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.lastCheck = time.Now()
+	u.record(rtt, err)
+}
+
+// record updates the health state, caller must hold u.mu
+func (u *Upstream) record(rtt time.Duration, err error) {
+	if err != nil {
+		u.lastErr = err
+		u.failures++
+		u.failing++
+		if u.failing >= FailureThreshold {
+			u.healthy = false
+		}
+		return
+	}
+
+	u.healthy = true
+	u.lastErr = nil
+	u.failing = 0
+	if u.rtt == 0 {
+		u.rtt = rtt
+	} else {
+		u.rtt = (u.rtt*7 + rtt) / 8
+	}
+}
+
+func (u *Upstream) isHealthy() bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.healthy
+}
+
+func (u *Upstream) averageRTT() time.Duration {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.rtt
+}
+
+func (u *Upstream) status() Status {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	s := Status{
+		Address:  u.address,
+		Protocol: string(u.protocol),
+		Healthy:  u.healthy,
+		Queries:  u.queries,
+		Failures: u.failures,
+	}
+	if u.rtt > 0 {
+		s.RTT = u.rtt.Round(time.Microsecond).String()
+	}
+	if u.lastErr != nil {
+		s.LastError = u.lastErr.Error()
+	}
+	if !u.lastCheck.IsZero() {
+		s.LastCheck = u.lastCheck.Format(time.RFC3339)
+	}
+	return s
+}
@@ -20,6 +20,8 @@ echo ""
 # Stop and unload LaunchDaemon
 echo "[1/5] Stopping daemon..."
 launchctl unload /Library/LaunchDaemons/com.fuckdopamine.daemon.plist 2>/dev/null || true
+# Restore DNS settings in case the daemon didn't shut down cleanly
+/usr/local/bin/fuckdopamined --restore-dns 2>/dev/null || true
 
 # Remove LaunchDaemon plist
 echo "[2/5] Removing LaunchDaemon configuration..."